@@ -1,32 +1,267 @@
 package api
 
 import (
+	"context"
 	"strconv"
+	"time"
 
 	"xfsquotas/internal/project"
 
 	"github.com/docker/go-units"
 )
 
+// DiskQuotaSize is the limits and usage of a quota
+type DiskQuotaSize = project.DiskQuotaSize
+
+// QuotaEntry describes a managed path and its quota
+type QuotaEntry = project.QuotaEntry
+
+// Backend is the system interaction layer a QuotaManager runs on
+type Backend = project.Backend
+
+// Pool is a range of project ids reserved for one consumer
+type Pool = project.Pool
+
+// PoolUsage is the occupancy of a Pool
+type PoolUsage = project.PoolUsage
+
+// QuotaSpec is the quota of one path in a batch
+type QuotaSpec = project.QuotaSpec
+
+// BatchResult is the outcome of one QuotaSpec of a batch
+type BatchResult = project.BatchResult
+
+// BatchMode decides what happens to a batch when one of its specs fails
+type BatchMode = project.BatchMode
+
+const (
+	// AllOrNothing applies a batch only if every spec can be applied
+	AllOrNothing = project.AllOrNothing
+	// ContinueOnError applies every spec of a batch that can be applied
+	ContinueOnError = project.ContinueOnError
+)
+
+// OverCommitPolicy admits the hard limits set on a filesystem against its
+// capacity, see WithOverCommitPolicy
+type OverCommitPolicy = project.OverCommitPolicy
+
+// OverCommitMode is what setting a quota does when a filesystem would be
+// over-committed
+type OverCommitMode = project.OverCommitMode
+
+const (
+	// OverCommitAllow sets any limit, the default
+	OverCommitAllow = project.OverCommitAllow
+	// OverCommitWarn sets the limit and logs a warning
+	OverCommitWarn = project.OverCommitWarn
+	// OverCommitReject fails with ErrOverCommitted
+	OverCommitReject = project.OverCommitReject
+)
+
+// ErrBatchAborted is the error of the specs of an AllOrNothing batch that
+// were not applied because another spec failed
+var ErrBatchAborted = project.ErrBatchAborted
+
+// Kinds of errors returned by a QuotaManager, test for them with errors.Is.
+// Errors of system calls also wrap their errno.
+var (
+	ErrNotXFS             = project.ErrNotXFS
+	ErrQuotaDisabled      = project.ErrQuotaDisabled
+	ErrNotEnforced        = project.ErrNotEnforced
+	ErrPermission         = project.ErrPermission
+	ErrIDExhausted        = project.ErrIDExhausted
+	ErrPathNotFound       = project.ErrPathNotFound
+	ErrConflictingProject = project.ErrConflictingProject
+	ErrProjectNotFound    = project.ErrProjectNotFound
+	ErrOverCommitted      = project.ErrOverCommitted
+)
+
+// Error is an error of one of the kinds above, wrapping its cause
+type Error = project.Error
+
+// Journal records the steps of an interrupted operation
+type Journal = project.Journal
+
+// Plan is what an operation of a dry run would change
+type Plan = project.Plan
+
+// ImportSource is where Import finds the projects set up by hand
+type ImportSource = project.ImportSource
+
+// ImportResult is the outcome of Import
+type ImportResult = project.ImportResult
+
+// GraceTimes are how long, in seconds, usage may exceed the soft limits
+type GraceTimes = project.GraceTimes
+
+// QuotaExport is the quota configuration of the managed paths, see Export
+type QuotaExport = project.QuotaExport
+
+// RestoreOptions configures Restore
+type RestoreOptions = project.RestoreOptions
+
+// RestoreResult is the outcome of restoring one project
+type RestoreResult = project.RestoreResult
+
+// Capacity is the size of a filesystem and what is left of it
+type Capacity = project.Capacity
+
+// FilesystemReport is the projects of a filesystem with their totals
+type FilesystemReport = project.FilesystemReport
+
+// ReportEntry is a project of a FilesystemReport
+type ReportEntry = project.ReportEntry
+
+// Growth is how fast a project consumed its limits between two samples
+type Growth = project.Growth
+
+// NewGrowth returns the growth of the usage from prev to cur, sampled
+// elapsed apart, with the time until a hard limit is hit at that rate
+func NewGrowth(prev, cur *DiskQuotaSize, elapsed time.Duration) *Growth {
+	return project.NewGrowth(prev, cur, elapsed)
+}
+
+// FakeBackend is an in-memory Backend for unit tests
+type FakeBackend = project.FakeBackend
+
+// NewFakeBackend creates an in-memory Backend with a single XFS filesystem
+// mounted at "/". Use it with WithBackend to test code depending on
+// QuotaManager without root.
+func NewFakeBackend() *FakeBackend {
+	return project.NewFakeBackend()
+}
+
 // QuotaManager provides a high-level interface for managing XFS quotas
 type QuotaManager struct {
 	quota *project.ProjectQuota
 }
 
+// options collects the Options of a QuotaManager
+type options struct {
+	projectOpts []project.Option
+}
+
+// Option configures a QuotaManager
+type Option func(*options)
+
+// WithBackend makes the QuotaManager use backend instead of the kernel
+func WithBackend(backend Backend) Option {
+	return func(o *options) {
+		o.projectOpts = append(o.projectOpts, project.WithBackend(backend))
+	}
+}
+
+// WithHostRoot manages the quotas of the host whose root directory is
+// mounted at root, e.g. /host in a privileged DaemonSet. Paths passed to the
+// QuotaManager are host paths.
+func WithHostRoot(root string) Option {
+	return func(o *options) {
+		o.projectOpts = append(o.projectOpts, project.WithHostRoot(root))
+	}
+}
+
+// WithMountRegistry records the projects of each filesystem in a hidden
+// directory at its mount root, so they move with the disk. /etc/projects and
+// /etc/projid are generated from these registries.
+func WithMountRegistry() Option {
+	return func(o *options) {
+		o.projectOpts = append(o.projectOpts, project.WithMountRegistry())
+	}
+}
+
+// WithRegistryDir records the projects of each filesystem in dir, under the
+// UUID of the filesystem
+func WithRegistryDir(dir string) Option {
+	return func(o *options) {
+		o.projectOpts = append(o.projectOpts, project.WithRegistryDir(dir))
+	}
+}
+
+// WithIDRange allocates project ids from [first, first+count)
+func WithIDRange(first uint32, count int) Option {
+	return func(o *options) {
+		o.projectOpts = append(o.projectOpts, project.WithIDRange(first, count))
+	}
+}
+
+// WithPools adds named pools of project ids next to the default one, see
+// SetQuotaInPool
+func WithPools(pools ...Pool) Option {
+	return func(o *options) {
+		o.projectOpts = append(o.projectOpts, project.WithPools(pools...))
+	}
+}
+
+// WithOverCommitPolicy checks the hard limits set by SetQuota, ApplyBatch
+// and Restore against the capacity of their filesystem. The sum of the block
+// hard limits of its projects may reach policy.Ratio times the capacity,
+// beyond that the limit is rejected or set with a warning.
+func WithOverCommitPolicy(policy OverCommitPolicy) Option {
+	return func(o *options) {
+		o.projectOpts = append(o.projectOpts, project.WithOverCommitPolicy(policy))
+	}
+}
+
+// WithDryRun makes the QuotaManager report what its operations would change
+// instead of changing it. The plans are returned by Plans.
+func WithDryRun() Option {
+	return func(o *options) {
+		o.projectOpts = append(o.projectOpts, project.WithDryRun())
+	}
+}
+
 // NewQuotaManager creates a new QuotaManager instance
-func NewQuotaManager() *QuotaManager {
+func NewQuotaManager(opts ...Option) *QuotaManager {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
 	return &QuotaManager{
-		quota: project.NewProjectQuota(),
+		quota: project.NewProjectQuota(o.projectOpts...),
 	}
 }
 
 // GetQuota returns the quota information for the given path
-func (q *QuotaManager) GetQuota(path string) (*project.DiskQuotaSize, error) {
-	return q.quota.GetQuota(path)
+func (q *QuotaManager) GetQuota(path string) (*DiskQuotaSize, error) {
+	return q.GetQuotaContext(context.Background(), path)
+}
+
+// GetQuotaContext is GetQuota, failing if ctx is done
+func (q *QuotaManager) GetQuotaContext(ctx context.Context, path string) (*DiskQuotaSize, error) {
+	return q.quota.GetQuotaContext(ctx, path)
+}
+
+// GetQuotaByID returns the quota of the project id on the filesystem
+// mounted at mountPath
+func (q *QuotaManager) GetQuotaByID(mountPath string, id uint32) (*DiskQuotaSize, error) {
+	return q.GetQuotaByIDContext(context.Background(), mountPath, id)
+}
+
+// GetQuotaByIDContext is GetQuotaByID, failing if ctx is done
+func (q *QuotaManager) GetQuotaByIDContext(ctx context.Context, mountPath string, id uint32) (*DiskQuotaSize, error) {
+	return q.quota.GetQuotaByIDContext(ctx, mountPath, id)
+}
+
+// GetQuotaByName returns the quota of the project with the name recorded
+// in /etc/projid
+func (q *QuotaManager) GetQuotaByName(name string) (*DiskQuotaSize, error) {
+	return q.GetQuotaByNameContext(context.Background(), name)
+}
+
+// GetQuotaByNameContext is GetQuotaByName, failing if ctx is done
+func (q *QuotaManager) GetQuotaByNameContext(ctx context.Context, name string) (*DiskQuotaSize, error) {
+	return q.quota.GetQuotaByNameContext(ctx, name)
 }
 
 // SetQuota sets the quota for the given path
 func (q *QuotaManager) SetQuota(path string, sizeVal, inodeVal string) error {
+	return q.SetQuotaContext(context.Background(), path, sizeVal, inodeVal)
+}
+
+// SetQuotaContext is SetQuota, waiting for the lock of the project files and
+// retagging the directory tree until ctx is done. A cancelled set is rolled
+// back.
+func (q *QuotaManager) SetQuotaContext(ctx context.Context, path string, sizeVal, inodeVal string) error {
 	size, err := units.RAMInBytes(sizeVal)
 	if err != nil {
 		return err
@@ -35,13 +270,152 @@ func (q *QuotaManager) SetQuota(path string, sizeVal, inodeVal string) error {
 	if err != nil {
 		return err
 	}
-	return q.quota.SetQuota(path, &project.DiskQuotaSize{
+	return q.quota.SetQuotaContext(ctx, path, &project.DiskQuotaSize{
 		Quota:  uint64(size),
 		Inodes: inodes,
 	})
 }
 
+// SetQuotaLimits sets all the limits of the given path, including the
+// realtime block limit
+func (q *QuotaManager) SetQuotaLimits(path string, limits *DiskQuotaSize) error {
+	return q.SetQuotaLimitsContext(context.Background(), path, limits)
+}
+
+// SetQuotaLimitsContext is SetQuotaLimits, see SetQuotaContext
+func (q *QuotaManager) SetQuotaLimitsContext(ctx context.Context, path string, limits *DiskQuotaSize) error {
+	return q.quota.SetQuotaContext(ctx, path, limits)
+}
+
+// SetQuotaInPool sets all the limits of the given path, allocating its
+// project id from the named pool
+func (q *QuotaManager) SetQuotaInPool(path string, limits *DiskQuotaSize, pool string) error {
+	return q.SetQuotaInPoolContext(context.Background(), path, limits, pool)
+}
+
+// SetQuotaInPoolContext is SetQuotaInPool, see SetQuotaContext
+func (q *QuotaManager) SetQuotaInPoolContext(ctx context.Context, path string, limits *DiskQuotaSize, pool string) error {
+	return q.quota.SetQuotaInPoolContext(ctx, path, limits, pool)
+}
+
+// ApplyBatch sets the quotas of many paths at once, resolving mounts,
+// allocating ids and writing the project files once. It returns the result
+// of every spec in order, and an error if any of them failed.
+func (q *QuotaManager) ApplyBatch(specs []QuotaSpec, mode BatchMode) ([]*BatchResult, error) {
+	return q.ApplyBatchContext(context.Background(), specs, mode)
+}
+
+// ApplyBatchContext is ApplyBatch, stopping when ctx is done. The specs not
+// applied by then fail with the error of ctx.
+func (q *QuotaManager) ApplyBatchContext(ctx context.Context, specs []QuotaSpec, mode BatchMode) ([]*BatchResult, error) {
+	return q.quota.ApplyBatchContext(ctx, specs, mode)
+}
+
+// Track assigns and persists a project id for the given path without limits,
+// so that its usage can be queried but is never capped
+func (q *QuotaManager) Track(path string) error {
+	return q.TrackContext(context.Background(), path)
+}
+
+// TrackContext is Track, see SetQuotaContext
+func (q *QuotaManager) TrackContext(ctx context.Context, path string) error {
+	return q.quota.TrackQuotaContext(ctx, path)
+}
+
+// List returns the quota and usage of every managed path
+func (q *QuotaManager) List() ([]*QuotaEntry, error) {
+	return q.ListContext(context.Background())
+}
+
+// ListContext is List, stopping when ctx is done
+func (q *QuotaManager) ListContext(ctx context.Context) ([]*QuotaEntry, error) {
+	return q.quota.ListQuotasContext(ctx)
+}
+
+// PoolUsage returns the occupancy of every pool of project ids
+func (q *QuotaManager) PoolUsage() ([]*PoolUsage, error) {
+	return q.quota.PoolUsage()
+}
+
+// Recover finishes the operations interrupted by a crash, or rolls them back
+// if rollback is true. It returns their journals, none if nothing was
+// interrupted.
+func (q *QuotaManager) Recover(rollback bool) ([]*Journal, error) {
+	return q.RecoverContext(context.Background(), rollback)
+}
+
+// RecoverContext is Recover, stopping when ctx is done. A journal is kept
+// until its recovery completes.
+func (q *QuotaManager) RecoverContext(ctx context.Context, rollback bool) ([]*Journal, error) {
+	return q.quota.RecoverContext(ctx, rollback)
+}
+
+// GC removes the records of paths that no longer exist or were retagged,
+// and returns them
+func (q *QuotaManager) GC() ([]string, error) {
+	return q.GCContext(context.Background())
+}
+
+// GCContext is GC, stopping when ctx is done
+func (q *QuotaManager) GCContext(ctx context.Context) ([]string, error) {
+	return q.quota.GCContext(ctx)
+}
+
+// Import registers the projects of existing project files, e.g. set up with
+// xfs_quota, as managed without changing their ids
+func (q *QuotaManager) Import(source ImportSource) (*ImportResult, error) {
+	return q.ImportContext(context.Background(), source)
+}
+
+// ImportContext is Import, stopping when ctx is done
+func (q *QuotaManager) ImportContext(ctx context.Context, source ImportSource) (*ImportResult, error) {
+	return q.quota.ImportContext(ctx, source)
+}
+
+// Export returns the paths, ids, names, limits and grace times of the
+// managed projects, to back them up or move them to another host
+func (q *QuotaManager) Export() (*QuotaExport, error) {
+	return q.ExportContext(context.Background())
+}
+
+// ExportContext is Export, stopping when ctx is done
+func (q *QuotaManager) ExportContext(ctx context.Context) (*QuotaExport, error) {
+	return q.quota.ExportContext(ctx)
+}
+
+// Restore records, tags and sets the limits of the projects of an export
+func (q *QuotaManager) Restore(export *QuotaExport, opts RestoreOptions) ([]*RestoreResult, error) {
+	return q.RestoreContext(context.Background(), export, opts)
+}
+
+// RestoreContext is Restore, stopping when ctx is done
+func (q *QuotaManager) RestoreContext(ctx context.Context, export *QuotaExport, opts RestoreOptions) ([]*RestoreResult, error) {
+	return q.quota.RestoreContext(ctx, export, opts)
+}
+
+// Report returns the projects of every mounted filesystem with project
+// quota, or of the given mount points, with their totals and capacity
+func (q *QuotaManager) Report(mountPaths ...string) ([]*FilesystemReport, error) {
+	return q.ReportContext(context.Background(), mountPaths...)
+}
+
+// ReportContext is Report, stopping when ctx is done
+func (q *QuotaManager) ReportContext(ctx context.Context, mountPaths ...string) ([]*FilesystemReport, error) {
+	return q.quota.ReportContext(ctx, mountPaths...)
+}
+
+// Plans returns what the operations since the last call would change, with
+// WithDryRun
+func (q *QuotaManager) Plans() []*Plan {
+	return q.quota.Plans()
+}
+
 // CleanQuota clears the quota for the given path
 func (q *QuotaManager) CleanQuota(path string) error {
-	return q.quota.ClearQuota(path)
+	return q.CleanQuotaContext(context.Background(), path)
+}
+
+// CleanQuotaContext is CleanQuota, see SetQuotaContext
+func (q *QuotaManager) CleanQuotaContext(ctx context.Context, path string) error {
+	return q.quota.ClearQuotaContext(ctx, path)
 }
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"os"
+	"os/signal"
+	"syscall"
 
 	internalcli "xfsquotas/internal/cli"
 
@@ -12,19 +16,68 @@ const (
 	version = "v0.0.2"
 )
 
+// signalError is the cause of the cancellation of the command by a signal
+type signalError struct {
+	signal syscall.Signal
+}
+
+func (e signalError) Error() string {
+	return e.signal.String() + " received"
+}
+
 func main() {
+	// -v is the log verbosity
+	cli.VersionFlag = &cli.BoolFlag{
+		Name:               "version",
+		Usage:              "print the version",
+		DisableDefaultText: true,
+	}
 	app := &cli.App{
 		Name:    "xfsquota",
 		Usage:   "A tool for managing XFS quotas",
 		Version: version,
+		Flags:   internalcli.GlobalFlags(),
+		Before:  internalcli.Before,
 		Commands: []*cli.Command{
 			internalcli.GetCommand(),
 			internalcli.SetCommand(),
 			internalcli.CleanCommand(),
+			internalcli.TrackCommand(),
+			internalcli.ListCommand(),
+			internalcli.RecoverCommand(),
+			internalcli.GCCommand(),
+			internalcli.ImportCommand(),
+			internalcli.ExportCommand(),
+			internalcli.RestoreCommand(),
+			internalcli.ReportCommand(),
+			internalcli.TopCommand(),
+			internalcli.IDsCommand(),
+			internalcli.ConfigCommand(),
 		},
 	}
 
-	err := app.Run(os.Args)
+	// Cancel the running command on SIGINT or SIGTERM, a transaction in
+	// progress is rolled back
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		// A second signal kills the process, e.g. if the rollback hangs
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
+		cancel(signalError{sig.(syscall.Signal)})
+	}()
+	// A command cancelled by a signal exits with 128 plus its number, like
+	// a process killed by it
+	app.ExitErrHandler = func(cCtx *cli.Context, err error) {
+		var sig signalError
+		if errors.Is(err, context.Canceled) && errors.As(context.Cause(ctx), &sig) {
+			err = cli.Exit(err.Error(), 128+int(sig.signal))
+		}
+		cli.HandleExitCoder(err)
+	}
+	err := app.RunContext(ctx, os.Args)
 	if err != nil {
 		os.Exit(1)
 	}
@@ -0,0 +1,11 @@
+//go:build fakebackend
+
+package cli
+
+import "xfsquotas/internal/project"
+
+// The in-memory backend loses everything on exit, it is only built with
+// -tags fakebackend for trying the CLI out
+func init() {
+	backends["fake"] = func() project.Backend { return project.NewFakeBackend() }
+}
@@ -3,8 +3,6 @@ package cli
 import (
 	"fmt"
 
-	"xfsquotas/internal/project"
-
 	"github.com/urfave/cli/v2"
 )
 
@@ -13,19 +11,24 @@ func CleanCommand() *cli.Command {
 	return &cli.Command{
 		Name:      "clean",
 		Usage:     "Clean quota information",
-		UsageText: "xfsquota clean <path>",
+		UsageText: "xfsquota clean [--dry-run] <path>",
+		Flags:     []cli.Flag{dryRunFlag()},
 		Action: func(c *cli.Context) error {
 			if c.NArg() == 0 {
 				return cli.Exit("path is required", 1)
 			}
 			path := c.Args().Get(0)
 
-			quota := project.NewProjectQuota()
-			err := quota.ClearQuota(path)
+			quota := newProjectQuota(c)
+			err := quota.ClearQuotaContext(c.Context, path)
 			if err != nil {
-				return cli.Exit(err.Error(), 1)
+				return exitError(err)
+			}
+			if quota.DryRun() {
+				return printPlans(c, quota.Plans())
 			}
 
+			printResolvedPath(quota, path)
 			fmt.Println("clean quota success, path:", path)
 			return nil
 		},
@@ -0,0 +1,149 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"xfsquotas/internal/project"
+
+	"github.com/urfave/cli/v2"
+)
+
+// backends creates the backends other than kernel built in, see
+// backend_fake.go
+var backends = map[string]func() project.Backend{}
+
+// newProjectQuota creates a ProjectQuota configured by the resolved Config
+func newProjectQuota(c *cli.Context) *project.ProjectQuota {
+	config := getConfig(c)
+	opts := []project.Option{
+		project.WithHostRoot(config.HostRoot),
+		project.WithProjectFiles(config.ProjectsFile, config.ProjidFile),
+		project.WithIDRange(config.FirstID, config.IDCount),
+		project.WithPools(config.Pools...),
+		project.WithOverCommitPolicy(config.OverCommit),
+	}
+	if config.RegistryDir != "" {
+		opts = append(opts, project.WithRegistryDir(config.RegistryDir))
+	} else if config.MountRegistry {
+		opts = append(opts, project.WithMountRegistry())
+	}
+	if newBackend, ok := backends[config.Backend]; ok {
+		opts = append(opts, project.WithBackend(newBackend()))
+	}
+	if c.Bool("dry-run") {
+		opts = append(opts, project.WithDryRun())
+	}
+	return project.NewProjectQuota(opts...)
+}
+
+// quotaInfo is the JSON output of the limits and usage of a project
+type quotaInfo struct {
+	Quota       uint64 `json:"quota"`
+	Inodes      uint64 `json:"inodes"`
+	QuotaUsed   uint64 `json:"quotaUsed"`
+	InodesUsed  uint64 `json:"inodesUsed"`
+	RtQuota     uint64 `json:"rtQuota"`
+	RtQuotaUsed uint64 `json:"rtQuotaUsed"`
+}
+
+// newQuotaInfo returns the JSON output of size
+func newQuotaInfo(size *project.DiskQuotaSize) quotaInfo {
+	return quotaInfo{
+		Quota:       size.Quota,
+		Inodes:      size.Inodes,
+		QuotaUsed:   size.QuotaUsed,
+		InodesUsed:  size.InodesUsed,
+		RtQuota:     size.RtQuota,
+		RtQuotaUsed: size.RtQuotaUsed,
+	}
+}
+
+// printJSON prints v as indented JSON
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// printResolvedPath prints the path the quota of an overlay or bind mount
+// path is applied to
+func printResolvedPath(quota *project.ProjectQuota, path string) {
+	if resolved, err := quota.ResolvePath(path); err == nil && resolved != filepath.Clean(path) {
+		fmt.Printf("path: %s, resolved to: %s\n", path, resolved)
+	}
+}
+
+// dryRunFlag is the --dry-run flag of the commands changing quotas
+func dryRunFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "print what would change without changing anything",
+	}
+}
+
+// printPlans prints what the operations of a dry run would change
+func printPlans(c *cli.Context, plans []*project.Plan) error {
+	if plans == nil {
+		plans = []*project.Plan{}
+	}
+	config := getConfig(c)
+	if config.Output == "json" {
+		return printJSON(plans)
+	}
+	if len(plans) == 0 {
+		fmt.Println("nothing would change")
+	}
+	for _, plan := range plans {
+		fmt.Printf("would %s %s:\n", plan.Op, plan.Path)
+		if plan.NewID != 0 {
+			fmt.Printf("  allocate project id %d\n", plan.NewID)
+		}
+		printLines(config.ProjectsFile, "+", plan.ProjectsAdded)
+		printLines(config.ProjectsFile, "-", plan.ProjectsRemoved)
+		printLines(config.ProjidFile, "+", plan.ProjidAdded)
+		printLines(config.ProjidFile, "-", plan.ProjidRemoved)
+		for _, step := range plan.Steps {
+			switch step.Kind {
+			case project.StepTag:
+				fmt.Printf("  retag %s: project id %d -> %d\n", step.Path, step.OldID, step.ID)
+				subtrees := make([]string, 0, len(step.OldIDs))
+				for dir := range step.OldIDs {
+					subtrees = append(subtrees, dir)
+				}
+				sort.Strings(subtrees)
+				for _, dir := range subtrees {
+					if step.OldIDs[dir] != step.ID {
+						fmt.Printf("    including %s: project id %d -> %d\n", dir, step.OldIDs[dir], step.ID)
+					}
+				}
+				for _, dir := range step.Skip {
+					fmt.Printf("    leaving %s and below as is\n", dir)
+				}
+			case project.StepLimit:
+				before, after := step.Old, step.New
+				if before == nil {
+					before = &project.DiskQuotaSize{}
+				}
+				if after == nil {
+					after = &project.DiskQuotaSize{}
+				}
+				fmt.Printf("  limits of project %d: size %d -> %d, inodes %d -> %d, rt-size %d -> %d\n",
+					step.ID, before.Quota, after.Quota, before.Inodes, after.Inodes, before.RtQuota, after.RtQuota)
+			}
+		}
+	}
+	return nil
+}
+
+// printLines prints the lines added to or removed from a project file
+func printLines(file, sign string, lines []string) {
+	for _, line := range lines {
+		fmt.Printf("  %s: %s %s\n", file, sign, line)
+	}
+}
@@ -0,0 +1,259 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+
+	"xfsquotas/internal/project"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultConfigPath = "/etc/xfsquota/config.yaml"
+	// configKey is the App.Metadata key of the resolved Config
+	configKey = "config"
+)
+
+// Config is the configuration of the CLI. Each setting is taken from, in
+// order of precedence: its command line flag, its environment variable, the
+// config file, and the default.
+type Config struct {
+	ProjectsFile  string `yaml:"projectsFile" json:"projectsFile"`
+	ProjidFile    string `yaml:"projidFile" json:"projidFile"`
+	HostRoot      string `yaml:"hostRoot" json:"hostRoot"`
+	MountRegistry bool   `yaml:"mountRegistry" json:"mountRegistry"`
+	RegistryDir   string `yaml:"registryDir" json:"registryDir"`
+	FirstID       uint32 `yaml:"firstID" json:"firstID"`
+	IDCount       int    `yaml:"idCount" json:"idCount"`
+	Verbosity     int    `yaml:"verbosity" json:"verbosity"`
+	// text or json
+	Output string `yaml:"output" json:"output"`
+	// kernel, or fake for an in-memory backend in builds with -tags
+	// fakebackend
+	Backend string `yaml:"backend" json:"backend"`
+	// named pools of project ids next to the default one
+	Pools []project.Pool `yaml:"pools" json:"pools"`
+	// admission of the hard limits against the capacity of the filesystem
+	OverCommit project.OverCommitPolicy `yaml:"overCommit" json:"overCommit"`
+}
+
+// defaultConfig returns the settings used when nothing else is configured
+func defaultConfig() *Config {
+	return &Config{
+		ProjectsFile: "/etc/projects",
+		ProjidFile:   "/etc/projid",
+		HostRoot:     "/",
+		FirstID:      1048577,
+		IDCount:      256,
+		Output:       "text",
+		Backend:      "kernel",
+		OverCommit:   project.OverCommitPolicy{Mode: project.OverCommitAllow, Ratio: 1},
+	}
+}
+
+// GlobalFlags returns the flags shared by all commands
+func GlobalFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "config file",
+			Value:   defaultConfigPath,
+			EnvVars: []string{"XFSQUOTA_CONFIG"},
+		},
+		&cli.StringFlag{
+			Name:    "host-root",
+			Usage:   "host root directory when running in a container, e.g. /host",
+			EnvVars: []string{"XFSQUOTA_HOST_ROOT"},
+		},
+		&cli.BoolFlag{
+			Name:    "mount-registry",
+			Usage:   "record projects per filesystem in .xfsquota at the mount root and generate /etc/projects from them",
+			EnvVars: []string{"XFSQUOTA_MOUNT_REGISTRY"},
+		},
+		&cli.StringFlag{
+			Name:    "registry-dir",
+			Usage:   "record projects per filesystem in this directory, keyed by filesystem UUID",
+			EnvVars: []string{"XFSQUOTA_REGISTRY_DIR"},
+		},
+		&cli.StringFlag{
+			Name:    "projects-file",
+			Usage:   "file recording project id:path, /etc/projects by default",
+			EnvVars: []string{"XFSQUOTA_PROJECTS_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "projid-file",
+			Usage:   "file recording project name:id, /etc/projid by default",
+			EnvVars: []string{"XFSQUOTA_PROJID_FILE"},
+		},
+		&cli.UintFlag{
+			Name:    "first-id",
+			Usage:   "first project id to allocate",
+			EnvVars: []string{"XFSQUOTA_FIRST_ID"},
+		},
+		&cli.IntFlag{
+			Name:    "id-count",
+			Usage:   "number of project ids to allocate from",
+			EnvVars: []string{"XFSQUOTA_ID_COUNT"},
+		},
+		&cli.IntFlag{
+			Name:    "verbosity",
+			Aliases: []string{"v"},
+			Usage:   "log verbosity",
+			EnvVars: []string{"XFSQUOTA_VERBOSITY"},
+		},
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "output format, text or json",
+			EnvVars: []string{"XFSQUOTA_OUTPUT"},
+		},
+		&cli.StringFlag{
+			Name:    "backend",
+			Usage:   "kernel, or fake for an in-memory backend if built with -tags fakebackend",
+			EnvVars: []string{"XFSQUOTA_BACKEND"},
+		},
+		&cli.StringFlag{
+			Name:    "over-commit",
+			Usage:   "allow, warn or reject hard limits whose sum exceeds the over-commit ratio of the filesystem size",
+			EnvVars: []string{"XFSQUOTA_OVER_COMMIT"},
+		},
+		&cli.Float64Flag{
+			Name:    "over-commit-ratio",
+			Usage:   "the sum of the hard limits of a filesystem allowed, as a ratio of its size, e.g. 1.5",
+			EnvVars: []string{"XFSQUOTA_OVER_COMMIT_RATIO"},
+		},
+	}
+}
+
+// Before resolves the Config and sets up logging, it runs before any command
+func Before(c *cli.Context) error {
+	config, err := loadConfig(c)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	c.App.Metadata[configKey] = config
+
+	klogFlags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(klogFlags)
+	return klogFlags.Set("v", strconv.Itoa(config.Verbosity))
+}
+
+// loadConfig reads the config file, then applies the flags and environment
+// variables that are set. A missing config file is only an error if it was
+// asked for explicitly.
+func loadConfig(c *cli.Context) (*Config, error) {
+	config := defaultConfig()
+	path := c.String("config")
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+	case errors.Is(err, fs.ErrNotExist) && !c.IsSet("config"):
+	default:
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	if c.IsSet("projects-file") {
+		config.ProjectsFile = c.String("projects-file")
+	}
+	if c.IsSet("projid-file") {
+		config.ProjidFile = c.String("projid-file")
+	}
+	if c.IsSet("host-root") {
+		config.HostRoot = c.String("host-root")
+	}
+	if c.IsSet("mount-registry") {
+		config.MountRegistry = c.Bool("mount-registry")
+	}
+	if c.IsSet("registry-dir") {
+		config.RegistryDir = c.String("registry-dir")
+	}
+	if c.IsSet("first-id") {
+		config.FirstID = uint32(c.Uint("first-id"))
+	}
+	if c.IsSet("id-count") {
+		config.IDCount = c.Int("id-count")
+	}
+	if c.IsSet("verbosity") {
+		config.Verbosity = c.Int("verbosity")
+	}
+	if c.IsSet("output") {
+		config.Output = c.String("output")
+	}
+	if c.IsSet("backend") {
+		config.Backend = c.String("backend")
+	}
+	if c.IsSet("over-commit") {
+		config.OverCommit.Mode = project.OverCommitMode(c.String("over-commit"))
+	}
+	if c.IsSet("over-commit-ratio") {
+		config.OverCommit.Ratio = c.Float64("over-commit-ratio")
+	}
+	return config, config.validate()
+}
+
+// validate checks the settings that can't be checked when they are used
+func (config *Config) validate() error {
+	if config.Output != "text" && config.Output != "json" {
+		return fmt.Errorf("unknown output format %q, expected text or json", config.Output)
+	}
+	if _, ok := backends[config.Backend]; config.Backend != "kernel" && !ok {
+		return fmt.Errorf("unknown backend %q, expected kernel", config.Backend)
+	}
+	if config.FirstID == 0 || config.IDCount <= 0 {
+		return fmt.Errorf("invalid project id range: first id %d, count %d", config.FirstID, config.IDCount)
+	}
+	switch config.OverCommit.Mode {
+	case project.OverCommitAllow, project.OverCommitWarn, project.OverCommitReject:
+	default:
+		return fmt.Errorf("unknown over-commit mode %q, expected allow, warn or reject", config.OverCommit.Mode)
+	}
+	if config.OverCommit.Ratio <= 0 {
+		return fmt.Errorf("invalid over-commit ratio %v, expected a positive ratio", config.OverCommit.Ratio)
+	}
+	return nil
+}
+
+// getConfig returns the Config resolved by Before
+func getConfig(c *cli.Context) *Config {
+	if config, ok := c.App.Metadata[configKey].(*Config); ok {
+		return config
+	}
+	return defaultConfig()
+}
+
+// ConfigCommand returns the config command
+func ConfigCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "config",
+		Usage: "Show the configuration",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "view",
+				Usage:     "Print the effective configuration after applying the config file, environment and flags",
+				UsageText: "xfsquota config view",
+				Action: func(c *cli.Context) error {
+					config := getConfig(c)
+					if config.Output == "json" {
+						return printJSON(config)
+					}
+					data, err := yaml.Marshal(config)
+					if err != nil {
+						return cli.Exit(err.Error(), 1)
+					}
+					fmt.Print(string(data))
+					return nil
+				},
+			},
+		},
+	}
+}
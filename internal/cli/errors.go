@@ -0,0 +1,38 @@
+package cli
+
+import (
+	"context"
+	"errors"
+
+	"xfsquotas/internal/project"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Exit codes of the kinds of errors, any other error exits with 1
+var exitCodes = []struct {
+	kind error
+	code int
+}{
+	{project.ErrPathNotFound, 2},
+	{project.ErrPermission, 3},
+	{project.ErrNotXFS, 4},
+	{project.ErrQuotaDisabled, 5},
+	{project.ErrNotEnforced, 6},
+	{project.ErrIDExhausted, 7},
+	{project.ErrConflictingProject, 8},
+	{project.ErrProjectNotFound, 9},
+	{project.ErrOverCommitted, 10},
+	// interrupted, main exits with 128 plus the number of the signal
+	{context.Canceled, 130},
+}
+
+// exitError returns the error exiting with the code of its kind
+func exitError(err error) cli.ExitCoder {
+	for _, e := range exitCodes {
+		if errors.Is(err, e.kind) {
+			return cli.Exit(err.Error(), e.code)
+		}
+	}
+	return cli.Exit(err.Error(), 1)
+}
@@ -0,0 +1,118 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"xfsquotas/internal/project"
+
+	"github.com/urfave/cli/v2"
+)
+
+// ExportCommand returns the export command
+func ExportCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "export",
+		Usage:     "Print the paths, ids, names, limits and grace times of the managed projects as JSON",
+		UsageText: "xfsquota export > quotas.json",
+		Action: func(c *cli.Context) error {
+			quota := newProjectQuota(c)
+			export, err := quota.ExportContext(c.Context)
+			if err != nil {
+				return exitError(err)
+			}
+			return printJSON(export)
+		},
+	}
+}
+
+// restoreOutput is the JSON output of a restored project
+type restoreOutput struct {
+	*project.RestoreResult
+	Error string `json:"error,omitempty"`
+}
+
+// RestoreCommand returns the restore command
+func RestoreCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "restore",
+		Usage:     "Retag, record and set the limits of the projects of an export",
+		UsageText: "xfsquota restore [--remap] [--dry-run] <quotas.json>",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "remap",
+				Usage: "give projects whose id is used on this host a new id",
+			},
+			dryRunFlag(),
+		},
+		Action: func(c *cli.Context) error {
+			if c.NArg() == 0 {
+				return cli.Exit("export file is required, - for stdin", 1)
+			}
+			name := c.Args().Get(0)
+			var r io.Reader = os.Stdin
+			if name != "-" {
+				file, err := os.Open(name)
+				if err != nil {
+					return cli.Exit(err.Error(), 1)
+				}
+				defer file.Close()
+				r = file
+			}
+			export := &project.QuotaExport{}
+			if err := json.NewDecoder(r).Decode(export); err != nil {
+				return cli.Exit(fmt.Sprintf("invalid export file %s: %v", name, err), 1)
+			}
+
+			quota := newProjectQuota(c)
+			results, restoreErr := quota.RestoreContext(c.Context, export, project.RestoreOptions{Remap: c.Bool("remap")})
+			if quota.DryRun() {
+				if err := printPlans(c, quota.Plans()); err != nil {
+					return err
+				}
+			} else if getConfig(c).Output == "json" {
+				out := make([]restoreOutput, 0, len(results))
+				for _, result := range results {
+					entry := restoreOutput{RestoreResult: result}
+					if result.Err != nil {
+						entry.Error = result.Err.Error()
+					}
+					out = append(out, entry)
+				}
+				if err := printJSON(out); err != nil {
+					return err
+				}
+			} else {
+				printRestore(results)
+			}
+			if restoreErr != nil {
+				return exitError(restoreErr)
+			}
+			for _, result := range results {
+				if result.Err != nil {
+					return exitError(result.Err)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// printRestore prints the outcome of each project of a restore
+func printRestore(results []*project.RestoreResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MOUNT\tID\tNEW ID\tNAME\tPATHS\tSTATUS")
+	for _, result := range results {
+		status := "ok"
+		if result.Err != nil {
+			status = result.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\n", result.Mount, result.ID, result.NewID, result.Name,
+			strings.Join(result.Paths, ","), status)
+	}
+	w.Flush()
+}
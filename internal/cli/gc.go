@@ -0,0 +1,39 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+// GCCommand returns the gc command
+func GCCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "gc",
+		Usage:     "Remove the records of paths that no longer exist or were retagged",
+		UsageText: "xfsquota gc [--dry-run]",
+		Flags:     []cli.Flag{dryRunFlag()},
+		Action: func(c *cli.Context) error {
+			quota := newProjectQuota(c)
+			removed, err := quota.GCContext(c.Context)
+			if err != nil {
+				return exitError(err)
+			}
+			if quota.DryRun() {
+				return printPlans(c, quota.Plans())
+			}
+
+			if getConfig(c).Output == "json" {
+				if removed == nil {
+					removed = []string{}
+				}
+				return printJSON(removed)
+			}
+			for _, path := range removed {
+				fmt.Println("removed stale path:", path)
+			}
+			fmt.Printf("gc success, %d stale paths removed\n", len(removed))
+			return nil
+		},
+	}
+}
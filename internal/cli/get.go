@@ -11,25 +11,59 @@ import (
 // GetCommand returns the get command
 func GetCommand() *cli.Command {
 	return &cli.Command{
-		Name:      "get",
-		Usage:     "Get quota information",
-		UsageText: "xfsquota get <path>",
+		Name:  "get",
+		Usage: "Get quota information",
+		UsageText: "xfsquota get <path>\n" +
+			"xfsquota get --id <id> --mount <mount>\n" +
+			"xfsquota get --name <name>",
+		Flags: []cli.Flag{
+			&cli.UintFlag{
+				Name:  "id",
+				Usage: "get the quota of the project id, on the filesystem of --mount",
+			},
+			&cli.StringFlag{
+				Name:  "mount",
+				Usage: "mount point of the filesystem of --id",
+			},
+			&cli.StringFlag{
+				Name:  "name",
+				Usage: "get the quota of the project with the name in /etc/projid",
+			},
+		},
 		Action: func(c *cli.Context) error {
-			if c.NArg() == 0 {
+			quota := newProjectQuota(c)
+			var quotaRes *project.DiskQuotaSize
+			var err error
+			switch {
+			case c.IsSet("id"):
+				if !c.IsSet("mount") {
+					return cli.Exit("--mount is required with --id", 1)
+				}
+				quotaRes, err = quota.GetQuotaByIDContext(c.Context, c.String("mount"), uint32(c.Uint("id")))
+			case c.IsSet("name"):
+				quotaRes, err = quota.GetQuotaByNameContext(c.Context, c.String("name"))
+			case c.NArg() == 0:
 				return cli.Exit("path is required", 1)
+			default:
+				path := c.Args().Get(0)
+				quotaRes, err = quota.GetQuotaContext(c.Context, path)
+				if err == nil && getConfig(c).Output != "json" {
+					printResolvedPath(quota, path)
+				}
 			}
-			path := c.Args().Get(0)
-
-			quota := project.NewProjectQuota()
-			quotaRes, err := quota.GetQuota(path)
 			if err != nil {
-				return cli.Exit(err.Error(), 1)
+				return exitError(err)
 			}
 
+			if getConfig(c).Output == "json" {
+				return printJSON(newQuotaInfo(quotaRes))
+			}
 			fmt.Println("quota Size(bytes):", quotaRes.Quota)
 			fmt.Println("quota Inodes:", quotaRes.Inodes)
 			fmt.Println("diskUsage Size(bytes):", quotaRes.QuotaUsed)
 			fmt.Println("diskUsage Inodes:", quotaRes.InodesUsed)
+			fmt.Println("quota RtSize(bytes):", quotaRes.RtQuota)
+			fmt.Println("diskUsage RtSize(bytes):", quotaRes.RtQuotaUsed)
 			return nil
 		},
 	}
@@ -0,0 +1,36 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+)
+
+// IDsCommand returns the ids command
+func IDsCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "ids",
+		Usage:     "Show the occupancy of each project id pool",
+		UsageText: "xfsquota ids",
+		Action: func(c *cli.Context) error {
+			quota := newProjectQuota(c)
+			usage, err := quota.PoolUsage()
+			if err != nil {
+				return exitError(err)
+			}
+
+			if getConfig(c).Output == "json" {
+				return printJSON(usage)
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "POOL\tFIRST ID\tLAST ID\tUSED\tFREE")
+			for _, pool := range usage {
+				fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", pool.Name, pool.First,
+					int64(pool.First)+int64(pool.Count)-1, pool.Used, pool.Count-pool.Used)
+			}
+			return w.Flush()
+		},
+	}
+}
@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"xfsquotas/internal/project"
+
+	"github.com/urfave/cli/v2"
+)
+
+// ImportCommand returns the import command
+func ImportCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "import",
+		Usage:     "Manage the projects set up by hand, e.g. with xfs_quota",
+		UsageText: "xfsquota import [--projects <file>] [--projid <file>] [--dry-run] [mount...]",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "projects",
+				Usage: "projects file to import, the configured one if empty",
+			},
+			&cli.StringFlag{
+				Name:  "projid",
+				Usage: "projid file to import, the configured one if empty",
+			},
+			dryRunFlag(),
+		},
+		Action: func(c *cli.Context) error {
+			quota := newProjectQuota(c)
+			result, err := quota.ImportContext(c.Context, project.ImportSource{
+				ProjectsPath: c.String("projects"),
+				ProjidPath:   c.String("projid"),
+				Mounts:       c.Args().Slice(),
+			})
+			if err != nil {
+				return exitError(err)
+			}
+			if quota.DryRun() {
+				if err := printPlans(c, quota.Plans()); err != nil {
+					return err
+				}
+				for _, skip := range result.Skipped {
+					fmt.Fprintf(os.Stderr, "skip %s: %s\n", skip.Path, skip.Reason)
+				}
+			} else if getConfig(c).Output == "json" {
+				if err := printJSON(result); err != nil {
+					return err
+				}
+			} else {
+				printImport(result)
+			}
+			if len(result.Skipped) > 0 {
+				return cli.Exit(fmt.Sprintf("%d records not imported", len(result.Skipped)), 1)
+			}
+			return nil
+		},
+	}
+}
+
+// printImport prints the imported and skipped records and the projects
+// without a recorded path
+func printImport(result *project.ImportResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tID\tNAME\tSTATUS")
+	for _, entry := range result.Imported {
+		fmt.Fprintf(w, "%s\t%d\t%s\timported\n", entry.Path, entry.ID, entry.Name)
+	}
+	for _, skip := range result.Skipped {
+		fmt.Fprintf(w, "%s\t%d\t\t%s\n", skip.Path, skip.ID, skip.Reason)
+	}
+	w.Flush()
+	for _, p := range result.Unrecorded {
+		fmt.Printf("project %d on %s has no recorded path: quota %d bytes, %d inodes, used %d bytes, %d inodes\n",
+			p.ID, p.Mount, p.Size.Quota, p.Size.Inodes, p.Size.QuotaUsed, p.Size.InodesUsed)
+	}
+}
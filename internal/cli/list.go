@@ -0,0 +1,74 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"xfsquotas/internal/project"
+
+	"github.com/urfave/cli/v2"
+)
+
+// listEntry is the JSON output of a managed path
+type listEntry struct {
+	Path string `json:"path"`
+	ID   uint32 `json:"id"`
+	Name string `json:"name"`
+	// limit or track
+	Mode string `json:"mode"`
+	quotaInfo
+}
+
+// ListCommand returns the list command
+func ListCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "list",
+		Usage:     "List quota information of all managed paths",
+		UsageText: "xfsquota list",
+		Action: func(c *cli.Context) error {
+			quota := newProjectQuota(c)
+			entries, err := quota.ListQuotasContext(c.Context)
+			if err != nil {
+				return exitError(err)
+			}
+
+			if getConfig(c).Output == "json" {
+				return printJSON(listOutput(entries))
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "PATH\tID\tNAME\tMODE\tSIZE\tUSED\tINODES\tINODES USED\tRT SIZE\tRT USED")
+			for _, entry := range entries {
+				fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\n",
+					entry.Path, entry.ID, entry.Name, quotaMode(entry.Size),
+					entry.Size.Quota, entry.Size.QuotaUsed,
+					entry.Size.Inodes, entry.Size.InodesUsed,
+					entry.Size.RtQuota, entry.Size.RtQuotaUsed)
+			}
+			return w.Flush()
+		},
+	}
+}
+
+// listOutput returns the JSON output of the entries
+func listOutput(entries []*project.QuotaEntry) []listEntry {
+	out := make([]listEntry, 0, len(entries))
+	for _, entry := range entries {
+		out = append(out, listEntry{
+			Path:      entry.Path,
+			ID:        entry.ID,
+			Name:      entry.Name,
+			Mode:      quotaMode(entry.Size),
+			quotaInfo: newQuotaInfo(entry.Size),
+		})
+	}
+	return out
+}
+
+// quotaMode returns limit for a project with limits, track otherwise
+func quotaMode(size *project.DiskQuotaSize) string {
+	if size.HasLimits() {
+		return "limit"
+	}
+	return "track"
+}
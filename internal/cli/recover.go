@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+// RecoverCommand returns the recover command
+func RecoverCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "recover",
+		Usage:     "Finish or roll back an operation interrupted by a crash",
+		UsageText: "xfsquota recover [--rollback] [--dry-run]",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "rollback",
+				Usage: "undo the interrupted operation instead of finishing it",
+			},
+			dryRunFlag(),
+		},
+		Action: func(c *cli.Context) error {
+			quota := newProjectQuota(c)
+			journals, err := quota.RecoverContext(c.Context, c.Bool("rollback"))
+			if quota.DryRun() && err == nil {
+				return printPlans(c, quota.Plans())
+			}
+
+			action := "finished"
+			if c.Bool("rollback") {
+				action = "rolled back"
+			}
+			for _, journal := range journals {
+				fmt.Printf("%s the interrupted %s of %s\n", action, journal.Op, journal.Path)
+			}
+			if err != nil {
+				return exitError(err)
+			}
+			if len(journals) == 0 {
+				fmt.Println("nothing to recover")
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,202 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"xfsquotas/internal/project"
+
+	"github.com/docker/go-units"
+	"github.com/urfave/cli/v2"
+)
+
+// reportFilesystem is the JSON output of a filesystem of the report
+type reportFilesystem struct {
+	Mount    string            `json:"mount"`
+	Device   string            `json:"device"`
+	Type     string            `json:"type"`
+	Enforced bool              `json:"enforced"`
+	Capacity *project.Capacity `json:"capacity,omitempty"`
+	// the sum of the block hard limits over the capacity
+	OverCommit float64       `json:"overCommit,omitempty"`
+	Total      quotaInfo     `json:"total"`
+	Projects   []reportEntry `json:"projects"`
+}
+
+// reportEntry is the JSON output of a project of the report
+type reportEntry struct {
+	ID          uint32   `json:"id"`
+	Name        string   `json:"name"`
+	Paths       []string `json:"paths"`
+	UsedPercent float64  `json:"usedPercent"`
+	OverSoft    bool     `json:"overSoftLimit"`
+	AtHard      bool     `json:"atHardLimit"`
+	quotaInfo
+}
+
+// ReportCommand returns the report command
+func ReportCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "report",
+		Usage: "Report the projects of all filesystems with project quota, with totals against their capacity",
+		UsageText: "xfsquota report [--sort used|percent|name] [--over <percent>] [--name-prefix <prefix>] " +
+			"[mount...]",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "sort",
+				Usage: "sort the projects by used (bytes, descending), percent (of the limit, descending) or name",
+			},
+			&cli.StringFlag{
+				Name:  "over",
+				Usage: "only the projects using at least this percent of a limit, e.g. 80%",
+			},
+			&cli.StringFlag{
+				Name:  "name-prefix",
+				Usage: "only the projects whose name starts with the prefix",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			var over float64
+			if c.IsSet("over") {
+				var err error
+				over, err = strconv.ParseFloat(strings.TrimSuffix(c.String("over"), "%"), 64)
+				if err != nil {
+					return cli.Exit(fmt.Sprintf("invalid --over %q, expected a percent like 80%%", c.String("over")), 1)
+				}
+			}
+			less, err := reportOrder(c.String("sort"))
+			if err != nil {
+				return cli.Exit(err.Error(), 1)
+			}
+
+			quota := newProjectQuota(c)
+			reports, err := quota.ReportContext(c.Context, c.Args().Slice()...)
+			if err != nil {
+				return exitError(err)
+			}
+			// Totals are of all the projects, the filters only select
+			// the rows
+			for _, report := range reports {
+				kept := report.Projects[:0]
+				for _, entry := range report.Projects {
+					if c.IsSet("over") && entry.Size.UsedPercent() < over {
+						continue
+					}
+					if !strings.HasPrefix(entry.Name, c.String("name-prefix")) {
+						continue
+					}
+					kept = append(kept, entry)
+				}
+				report.Projects = kept
+				sort.SliceStable(report.Projects, func(i, j int) bool {
+					return less(report.Projects[i], report.Projects[j])
+				})
+			}
+
+			if getConfig(c).Output == "json" {
+				return printJSON(reportOutput(reports))
+			}
+			for i, report := range reports {
+				if i > 0 {
+					fmt.Println()
+				}
+				printReport(report)
+			}
+			return nil
+		},
+	}
+}
+
+// reportOrder returns how the --sort flag orders projects, by id if empty
+func reportOrder(key string) (func(a, b *project.ReportEntry) bool, error) {
+	switch key {
+	case "":
+		return func(a, b *project.ReportEntry) bool { return a.ID < b.ID }, nil
+	case "used":
+		return func(a, b *project.ReportEntry) bool { return a.Size.QuotaUsed > b.Size.QuotaUsed }, nil
+	case "percent":
+		return func(a, b *project.ReportEntry) bool {
+			return a.Size.UsedPercent() > b.Size.UsedPercent()
+		}, nil
+	case "name":
+		return func(a, b *project.ReportEntry) bool { return a.Name < b.Name }, nil
+	}
+	return nil, fmt.Errorf("invalid --sort %q, expected used, percent or name", key)
+}
+
+// printReport prints the summary and the projects of a filesystem
+func printReport(report *project.FilesystemReport) {
+	mode := "enforced"
+	if !report.Enforced {
+		mode = "not enforced"
+	}
+	fmt.Printf("%s (%s %s, %s): %s limits, %s used",
+		report.Mount, report.Type, report.Device, mode,
+		units.BytesSize(float64(report.Total.Quota)), units.BytesSize(float64(report.Total.QuotaUsed)))
+	if report.Capacity != nil && report.Capacity.Bytes != 0 {
+		fmt.Printf(", capacity %s, %s free, %.0f%% committed",
+			units.BytesSize(float64(report.Capacity.Bytes)), units.BytesSize(float64(report.Capacity.BytesFree)),
+			report.OverCommit()*100)
+		if report.OverCommit() > 1 {
+			fmt.Print(" (over-committed)")
+		}
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tPATHS\tUSED\tQUOTA\tUSE%\tINODES USED\tINODES\tFLAGS")
+	for _, entry := range report.Projects {
+		size := entry.Size
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%.0f%%\t%d\t%d\t%s\n",
+			entry.ID, entry.Name, strings.Join(entry.Paths, ","),
+			units.BytesSize(float64(size.QuotaUsed)), units.BytesSize(float64(size.Quota)), size.UsedPercent(),
+			size.InodesUsed, size.Inodes, limitFlags(size))
+	}
+	w.Flush()
+}
+
+// limitFlags returns hard if the project reached a hard limit, soft if it
+// is over a soft limit
+func limitFlags(size *project.DiskQuotaSize) string {
+	if size.AtHardLimit() {
+		return "hard"
+	}
+	if size.OverSoftLimit() {
+		return "soft"
+	}
+	return ""
+}
+
+// reportOutput returns the JSON output of the reports
+func reportOutput(reports []*project.FilesystemReport) []reportFilesystem {
+	out := make([]reportFilesystem, 0, len(reports))
+	for _, report := range reports {
+		fs := reportFilesystem{
+			Mount:      report.Mount,
+			Device:     report.Device,
+			Type:       report.Type,
+			Enforced:   report.Enforced,
+			Capacity:   report.Capacity,
+			OverCommit: report.OverCommit(),
+			Total:      newQuotaInfo(report.Total),
+			Projects:   make([]reportEntry, 0, len(report.Projects)),
+		}
+		for _, entry := range report.Projects {
+			fs.Projects = append(fs.Projects, reportEntry{
+				ID:          entry.ID,
+				Name:        entry.Name,
+				Paths:       entry.Paths,
+				UsedPercent: entry.Size.UsedPercent(),
+				OverSoft:    entry.Size.OverSoftLimit(),
+				AtHard:      entry.Size.AtHardLimit(),
+				quotaInfo:   newQuotaInfo(entry.Size),
+			})
+		}
+		out = append(out, fs)
+	}
+	return out
+}
@@ -1,8 +1,14 @@
 package cli
 
 import (
+	"encoding/csv"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"strconv"
+	"strings"
+	"text/tabwriter"
 
 	"xfsquotas/internal/project"
 
@@ -13,9 +19,10 @@ import (
 // SetCommand returns the set command
 func SetCommand() *cli.Command {
 	return &cli.Command{
-		Name:      "set",
-		Usage:     "Set quota information",
-		UsageText: "xfsquota set <path> -s <size> -i <inodes>",
+		Name:  "set",
+		Usage: "Set quota information",
+		UsageText: "xfsquota set -s <size> -i <inodes> [--rt-size <size>] [--pool <pool>] [--dry-run] <path>\n" +
+			"xfsquota set -f <specs.csv> [--continue-on-error] [--dry-run]",
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:    "size",
@@ -29,38 +36,199 @@ func SetCommand() *cli.Command {
 				Usage:   "quota inodes",
 				Value:   "0",
 			},
+			&cli.StringFlag{
+				Name:  "rt-size",
+				Usage: "quota size on the xfs realtime subvolume",
+				Value: "0",
+			},
+			&cli.StringFlag{
+				Name:  "pool",
+				Usage: "pool to allocate the project id from, the default pool if empty",
+			},
+			&cli.StringFlag{
+				Name:    "file",
+				Aliases: []string{"f"},
+				Usage:   "set the quotas listed in a CSV file of path,size,inodes[,rt-size[,pool]], - for stdin",
+			},
+			&cli.BoolFlag{
+				Name:  "continue-on-error",
+				Usage: "with -f, set the quotas that can be set instead of none if any fails",
+			},
+			dryRunFlag(),
 		},
 		Action: func(c *cli.Context) error {
+			if c.IsSet("file") {
+				return setBatch(c)
+			}
 			if c.NArg() == 0 {
 				return cli.Exit("path is required", 1)
 			}
 			path := c.Args().Get(0)
 			size := c.String("size")
 			inodes := c.String("inodes")
+			rtSize := c.String("rt-size")
 
-			// Parse size
-			sizeBytes, err := units.RAMInBytes(size)
+			limits, err := parseLimits(size, inodes, rtSize)
 			if err != nil {
-				return cli.Exit(fmt.Sprintf("invalid size format: %v", err), 1)
+				return cli.Exit(err.Error(), 1)
 			}
 
-			// Parse inodes
-			inodesNum, err := strconv.ParseUint(inodes, 10, 64)
+			quota := newProjectQuota(c)
+			err = quota.SetQuotaInPoolContext(c.Context, path, limits, c.String("pool"))
 			if err != nil {
-				return cli.Exit(fmt.Sprintf("invalid inodes format: %v", err), 1)
+				return exitError(err)
 			}
-
-			quota := project.NewProjectQuota()
-			err = quota.SetQuota(path, &project.DiskQuotaSize{
-				Quota:  uint64(sizeBytes),
-				Inodes: inodesNum,
-			})
-			if err != nil {
-				return cli.Exit(err.Error(), 1)
+			if quota.DryRun() {
+				return printPlans(c, quota.Plans())
 			}
 
-			fmt.Printf("set quota success, path: %s, size:%s, inodes:%s\n", path, size, inodes)
+			printResolvedPath(quota, path)
+			fmt.Printf("set quota success, path: %s, size:%s, inodes:%s, rt-size:%s\n", path, size, inodes, rtSize)
 			return nil
 		},
 	}
 }
+
+// parseLimits parses the size, inodes and realtime size of a quota
+func parseLimits(size, inodes, rtSize string) (*project.DiskQuotaSize, error) {
+	// Parse size
+	sizeBytes, err := units.RAMInBytes(size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid size format: %v", err)
+	}
+
+	// Parse inodes
+	inodesNum, err := strconv.ParseUint(inodes, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid inodes format: %v", err)
+	}
+
+	// Parse realtime size
+	rtSizeBytes, err := units.RAMInBytes(rtSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rt-size format: %v", err)
+	}
+
+	return &project.DiskQuotaSize{
+		Quota:   uint64(sizeBytes),
+		Inodes:  inodesNum,
+		RtQuota: uint64(rtSizeBytes),
+	}, nil
+}
+
+// batchOutput is the JSON output of a BatchResult
+type batchOutput struct {
+	Path  string `json:"path"`
+	ID    uint32 `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+// setBatch sets the quotas listed in the file of the -f flag
+func setBatch(c *cli.Context) error {
+	name := c.String("file")
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		defer file.Close()
+		r = file
+	}
+	specs, err := readSpecs(r)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("invalid spec file %s: %v", name, err), 1)
+	}
+
+	mode := project.AllOrNothing
+	if c.Bool("continue-on-error") {
+		mode = project.ContinueOnError
+	}
+	quota := newProjectQuota(c)
+	results, batchErr := quota.ApplyBatchContext(c.Context, specs, mode)
+	if results == nil {
+		return exitError(batchErr)
+	}
+	if quota.DryRun() {
+		if err := printPlans(c, quota.Plans()); err != nil {
+			return err
+		}
+		if batchErr != nil {
+			return cli.Exit(batchErr.Error(), 1)
+		}
+		return nil
+	}
+
+	if getConfig(c).Output == "json" {
+		out := make([]batchOutput, 0, len(results))
+		for _, result := range results {
+			entry := batchOutput{Path: result.Path, ID: result.ID}
+			if result.Err != nil {
+				entry.Error = result.Err.Error()
+			}
+			out = append(out, entry)
+		}
+		if err := printJSON(out); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PATH\tID\tSTATUS")
+		for _, result := range results {
+			status := "ok"
+			if result.Err != nil {
+				status = result.Err.Error()
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\n", result.Path, result.ID, status)
+		}
+		w.Flush()
+	}
+	if batchErr != nil {
+		return cli.Exit(batchErr.Error(), 1)
+	}
+	return nil
+}
+
+// readSpecs parses CSV records of path,size,inodes[,rt-size[,pool]]. Empty
+// fields default to 0 and the default pool, and a header line starting with
+// "path" is skipped.
+func readSpecs(r io.Reader) ([]project.QuotaSpec, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	var specs []project.QuotaSpec
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 && strings.EqualFold(record[0], "path") {
+			continue
+		}
+		if len(record) > 5 || record[0] == "" {
+			return nil, fmt.Errorf("line %d: expected path,size,inodes[,rt-size[,pool]]", line)
+		}
+		fields := make([]string, 5)
+		copy(fields, record)
+		for i := 1; i <= 3; i++ {
+			if fields[i] == "" {
+				fields[i] = "0"
+			}
+		}
+		limits, err := parseLimits(fields[1], fields[2], fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		specs = append(specs, project.QuotaSpec{
+			Path: fields[0],
+			Size: limits,
+			Pool: fields[4],
+		})
+	}
+	return specs, nil
+}
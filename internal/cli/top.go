@@ -0,0 +1,216 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"xfsquotas/internal/project"
+
+	"github.com/docker/go-units"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/unix"
+)
+
+// topEntry is a project of a refresh of top
+type topEntry struct {
+	Mount           string   `json:"mount"`
+	ID              uint32   `json:"id"`
+	Name            string   `json:"name"`
+	Paths           []string `json:"paths"`
+	BytesPerSecond  float64  `json:"bytesPerSecond"`
+	InodesPerSecond float64  `json:"inodesPerSecond"`
+	UsedPercent     float64  `json:"usedPercent"`
+	// seconds until a hard limit is hit at the current rate, 0 if none is
+	// approached
+	UntilFull int64 `json:"untilFullSeconds,omitempty"`
+	AtHard    bool  `json:"atHardLimit"`
+	size      *project.DiskQuotaSize
+	untilFull time.Duration
+	quotaInfo
+}
+
+// topFrame is a refresh of top
+type topFrame struct {
+	Time     time.Time   `json:"time"`
+	Projects []*topEntry `json:"projects"`
+}
+
+// TopCommand returns the top command
+func TopCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "top",
+		Usage:     "Show the projects growing fastest, refreshed every interval until interrupted",
+		UsageText: "xfsquota top [--interval 2s] [--limit 20] [--count n] [mount...]",
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:    "interval",
+				Aliases: []string{"n"},
+				Value:   2 * time.Second,
+				Usage:   "the time between refreshes, the rates are over this time",
+			},
+			&cli.IntFlag{
+				Name:    "limit",
+				Aliases: []string{"l"},
+				Value:   20,
+				Usage:   "show at most this many projects, 0 for all",
+			},
+			&cli.IntFlag{
+				Name:    "count",
+				Aliases: []string{"c"},
+				Usage:   "exit after this many refreshes, 0 to run until interrupted",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			interval := c.Duration("interval")
+			if interval <= 0 {
+				return cli.Exit(fmt.Sprintf("invalid --interval %s", interval), 1)
+			}
+			quota := newProjectQuota(c)
+			jsonOutput := getConfig(c).Output == "json"
+			clearScreen := !jsonOutput && isTerminal(os.Stdout)
+
+			// the last sample of each project, by mount and id
+			var previous map[string]*project.DiskQuotaSize
+			var sampled time.Time
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for refresh := 1; ; refresh++ {
+				reports, err := quota.ReportContext(c.Context, c.Args().Slice()...)
+				if err != nil {
+					if c.Context.Err() != nil {
+						return nil
+					}
+					return exitError(err)
+				}
+				now := time.Now()
+				frame := topSample(reports, previous, now.Sub(sampled))
+				frame.Time = now
+				if limit := c.Int("limit"); limit > 0 && len(frame.Projects) > limit {
+					frame.Projects = frame.Projects[:limit]
+				}
+
+				previous = make(map[string]*project.DiskQuotaSize)
+				for _, report := range reports {
+					for _, entry := range report.Projects {
+						previous[topKey(report.Mount, entry.ID)] = entry.Size
+					}
+				}
+				sampled = now
+
+				if jsonOutput {
+					if err := printJSON(frame); err != nil {
+						return err
+					}
+				} else {
+					if clearScreen {
+						fmt.Print("\033[H\033[2J")
+					}
+					printTop(frame, interval, refresh == 1)
+				}
+				if count := c.Int("count"); count > 0 && refresh >= count {
+					return nil
+				}
+				// Interrupting is how top is meant to end
+				select {
+				case <-c.Context.Done():
+					return nil
+				case <-ticker.C:
+				}
+			}
+		},
+	}
+}
+
+// topSample returns the projects of the reports with their growth since the
+// previous sample, fastest first
+func topSample(reports []*project.FilesystemReport, previous map[string]*project.DiskQuotaSize,
+	elapsed time.Duration) *topFrame {
+	frame := &topFrame{Projects: []*topEntry{}}
+	for _, report := range reports {
+		for _, entry := range report.Projects {
+			// No rates for a project seen for the first time
+			growth := project.NewGrowth(previous[topKey(report.Mount, entry.ID)], entry.Size, elapsed)
+			frame.Projects = append(frame.Projects, &topEntry{
+				Mount:           report.Mount,
+				ID:              entry.ID,
+				Name:            entry.Name,
+				Paths:           entry.Paths,
+				BytesPerSecond:  growth.BytesPerSecond,
+				InodesPerSecond: growth.InodesPerSecond,
+				UsedPercent:     entry.Size.UsedPercent(),
+				UntilFull:       int64(growth.UntilFull.Seconds()),
+				AtHard:          entry.Size.AtHardLimit(),
+				size:            entry.Size,
+				untilFull:       growth.UntilFull,
+				quotaInfo:       newQuotaInfo(entry.Size),
+			})
+		}
+	}
+	sort.SliceStable(frame.Projects, func(i, j int) bool {
+		a, b := frame.Projects[i], frame.Projects[j]
+		if a.BytesPerSecond != b.BytesPerSecond {
+			return a.BytesPerSecond > b.BytesPerSecond
+		}
+		if a.InodesPerSecond != b.InodesPerSecond {
+			return a.InodesPerSecond > b.InodesPerSecond
+		}
+		return a.size.QuotaUsed > b.size.QuotaUsed
+	})
+	return frame
+}
+
+// topKey identifies a project of a filesystem across samples
+func topKey(mountPath string, id uint32) string {
+	return fmt.Sprintf("%s:%d", mountPath, id)
+}
+
+// printTop prints a refresh of top
+func printTop(frame *topFrame, interval time.Duration, first bool) {
+	fmt.Printf("xfsquota top - %s, every %s, %d projects", frame.Time.Format("15:04:05"), interval,
+		len(frame.Projects))
+	if first {
+		fmt.Print(", rates from the next refresh")
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MOUNT\tID\tNAME\tBYTES/S\tINODES/S\tUSED\tQUOTA\tUSE%\tINODES USED\tINODES\tFULL IN")
+	for _, entry := range frame.Projects {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%.1f\t%s\t%s\t%.0f%%\t%d\t%d\t%s\n",
+			entry.Mount, entry.ID, entry.Name, byteRate(entry.BytesPerSecond), entry.InodesPerSecond,
+			units.BytesSize(float64(entry.size.QuotaUsed)), units.BytesSize(float64(entry.size.Quota)),
+			entry.UsedPercent, entry.size.InodesUsed, entry.size.Inodes, untilFull(entry))
+	}
+	w.Flush()
+}
+
+// byteRate formats a rate of bytes per second
+func byteRate(rate float64) string {
+	if rate < 0 {
+		return "-" + units.BytesSize(-rate) + "/s"
+	}
+	return units.BytesSize(rate) + "/s"
+}
+
+// untilFull formats the time until the project hits a hard limit
+func untilFull(entry *topEntry) string {
+	switch {
+	case entry.AtHard:
+		return "full"
+	case entry.untilFull >= time.Minute:
+		return strings.TrimSuffix(entry.untilFull.Round(time.Minute).String(), "0s")
+	case entry.untilFull > 0:
+		return entry.untilFull.Round(time.Second).String()
+	}
+	return "-"
+}
+
+// isTerminal reports whether the file is a terminal
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
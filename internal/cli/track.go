@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"fmt"
+
+	"xfsquotas/internal/project"
+
+	"github.com/urfave/cli/v2"
+)
+
+// TrackCommand returns the track command
+func TrackCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "track",
+		Usage:     "Account usage of a path without limiting it",
+		UsageText: "xfsquota track [--pool <pool>] [--dry-run] <path>",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "pool",
+				Usage: "pool to allocate the project id from, the default pool if empty",
+			},
+			dryRunFlag(),
+		},
+		Action: func(c *cli.Context) error {
+			if c.NArg() == 0 {
+				return cli.Exit("path is required", 1)
+			}
+			path := c.Args().Get(0)
+
+			quota := newProjectQuota(c)
+			err := quota.SetQuotaInPoolContext(c.Context, path, &project.DiskQuotaSize{}, c.String("pool"))
+			if err != nil {
+				return exitError(err)
+			}
+			if quota.DryRun() {
+				return printPlans(c, quota.Plans())
+			}
+
+			printResolvedPath(quota, path)
+			fmt.Println("track quota success, path:", path)
+			return nil
+		},
+	}
+}
@@ -28,18 +28,25 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"golang.org/x/sys/unix"
 	"k8s.io/klog/v2"
 )
 
-var (
-	MountsInitialized = false
-	mountsByDevice    map[DeviceNumber]*Mount
+const (
+	defaultMountInfoPath = "/proc/self/mountinfo"
+	// HostMountInfoPath is the mountinfo of the host's init process, seen
+	// from a container sharing the host PID namespace
+	HostMountInfoPath = "/proc/1/mountinfo"
 )
 
+// defaultCache serves the package level lookups
+var defaultCache = NewCache(defaultMountInfoPath)
+
 type DeviceNumber uint64
 
 // String return format device number
@@ -49,16 +56,69 @@ func (num DeviceNumber) String() string {
 
 // Mount describe mount info
 type Mount struct {
-	// mount point path
+	// mount point path, as seen by the host
 	Path string
 	// xfs/ext4
 	FilesystemType string
-	// /dev/sda
-	Device       string
+	// /dev/sda, reachable from the current root, empty if there is no
+	// usable device node
+	Device string
+	// the mount source, e.g. /dev/mapper/vg-lv
+	Source       string
 	DeviceNumber DeviceNumber
 	Subtree      string
 	ReadOnly     bool
 	Options      string
+	// upper and work directories of an overlay mount
+	UpperDir string
+	WorkDir  string
+	// the main mount of the filesystem, the mount itself unless it is a
+	// bind mount. nil if the filesystem has no unambiguous main mount.
+	Main *Mount
+}
+
+// FilesystemPath returns the path of a path under the mount relative to the
+// root of the filesystem, the same from every bind mount
+func (m *Mount) FilesystemPath(path string) (string, error) {
+	rel, err := filepath.Rel(m.Path, path)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s is not under mount point %s", path, m.Path)
+	}
+	return filepath.Join(m.Subtree, rel), nil
+}
+
+// CanonicalPath returns the path of a path under the mount as seen through
+// the main mount of the filesystem. The path is returned unchanged if it is
+// not reachable from the main mount.
+func (m *Mount) CanonicalPath(path string) string {
+	if m.Main == nil || m.Main == m {
+		return path
+	}
+	fsPath, err := m.FilesystemPath(path)
+	if err != nil {
+		return path
+	}
+	canonicalPath, err := m.Main.PathOf(fsPath)
+	if err != nil {
+		return path
+	}
+	return canonicalPath
+}
+
+// PathOf returns the path a path relative to the root of the filesystem is
+// reached at under the mount, the inverse of FilesystemPath
+func (m *Mount) PathOf(fsPath string) (string, error) {
+	rel, err := filepath.Rel(m.Subtree, fsPath)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s is not under the subtree %s mounted at %s", fsPath, m.Subtree, m.Path)
+	}
+	return filepath.Join(m.Path, rel), nil
 }
 
 type mountpointTreeNode struct {
@@ -67,16 +127,75 @@ type mountpointTreeNode struct {
 	children []*mountpointTreeNode
 }
 
+// Cache is a thread-safe view of a mountinfo file. It keeps the file open
+// and polls it for POLLPRI, which the kernel raises whenever the mount table
+// changes, so lookups never see stale mounts.
+type Cache struct {
+	mu sync.Mutex
+	// the host's root directory, e.g. /host in a container
+	root          string
+	mountInfoPath string
+	file          *os.File
+	// main mount of each filesystem
+	mountsByDevice map[DeviceNumber]*Mount
+	// every mount, including bind mounts
+	mountsByPath map[string]*Mount
+}
+
+// NewCache creates a Cache of the mountinfo file, the file is read on the
+// first lookup
+func NewCache(mountInfoPath string) *Cache {
+	return NewHostCache("/", mountInfoPath)
+}
+
+// NewHostCache creates a Cache of a host's mountinfo file when the host's
+// root directory is mounted at root, e.g. in a privileged container. Paths
+// passed to and returned by the Cache are as seen by the host, while device
+// nodes are resolved under root.
+func NewHostCache(root, mountInfoPath string) *Cache {
+	return &Cache{root: root, mountInfoPath: mountInfoPath}
+}
+
 // FindMount find mount point info for the path
 func FindMount(path string) (*Mount, error) {
-	if err := loadMountInfo(); err != nil {
+	return defaultCache.FindMount(path)
+}
+
+// Refresh reloads the mount table of the package level lookups
+func Refresh() error {
+	return defaultCache.Refresh()
+}
+
+// Mounts returns the main mount of every filesystem of the package level
+// lookups
+func Mounts() ([]*Mount, error) {
+	return defaultCache.Mounts()
+}
+
+// FindMount find the mount containing the path, which is a bind mount if
+// the path is under one. Its Main is the main mount of the filesystem.
+func (c *Cache) FindMount(path string) (*Mount, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.loadMountInfo(); err != nil {
 		return nil, err
 	}
-	deviceNumber, err := getNumberOfContainingDevice(path)
+	deviceNumber, err := getNumberOfContainingDevice(HostPath(c.root, path))
 	if err != nil {
 		return nil, err
 	}
-	mnt, ok := mountsByDevice[deviceNumber]
+	// The deepest mount point above the path on the same filesystem, the
+	// path may be reached through a symlink when there is none
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		if mnt, ok := c.mountsByPath[p]; ok && mnt.DeviceNumber == deviceNumber {
+			return mnt, nil
+		}
+		if p == "/" || p == "." {
+			break
+		}
+	}
+	mnt, ok := c.mountsByDevice[deviceNumber]
 	if !ok {
 		return nil, fmt.Errorf("couldn't find mountpoint containing %q", path)
 	}
@@ -86,26 +205,99 @@ func FindMount(path string) (*Mount, error) {
 	return mnt, nil
 }
 
-// loadMountInfo store all mount points
-func loadMountInfo() error {
-	if !MountsInitialized {
-		file, err := os.Open("/proc/self/mountinfo")
-		if err != nil {
-			return err
+// Mounts returns the main mount of every filesystem, sorted by path.
+// Filesystems without an unambiguous main mount are left out.
+func (c *Cache) Mounts() ([]*Mount, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.loadMountInfo(); err != nil {
+		return nil, err
+	}
+	mounts := make([]*Mount, 0, len(c.mountsByDevice))
+	for _, mnt := range c.mountsByDevice {
+		if mnt != nil {
+			mounts = append(mounts, mnt)
 		}
-		defer file.Close()
-		if err := readMountInfo(file); err != nil {
-			return err
+	}
+	sort.Slice(mounts, func(i, j int) bool {
+		return mounts[i].Path < mounts[j].Path
+	})
+	return mounts, nil
+}
+
+// Refresh rereads the mountinfo file
+func (c *Cache) Refresh() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.mountsByDevice = nil
+	c.mountsByPath = nil
+	return c.loadMountInfo()
+}
+
+// Close releases the mountinfo file, a later lookup reopens it
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.mountsByDevice = nil
+	c.mountsByPath = nil
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// loadMountInfo store all mount points, rereading them if the mount table
+// changed since the last load. The caller must hold c.mu.
+func (c *Cache) loadMountInfo() error {
+	if c.file == nil {
+		// Keep the fd out of the runtime poller, its epoll registration
+		// would consume the POLLPRI events
+		fd, err := unix.Open(c.mountInfoPath, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return &os.PathError{Op: "open", Path: c.mountInfoPath, Err: err}
 		}
-		MountsInitialized = true
+		c.file = os.NewFile(uintptr(fd), c.mountInfoPath)
+		c.mountsByDevice = nil
 	}
+	if c.mountsByDevice != nil && !c.changed() {
+		return nil
+	}
+	if _, err := c.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	mountsByDevice, mountsByPath, err := readMountInfo(c.file, c.root)
+	if err != nil {
+		return err
+	}
+	c.mountsByDevice = mountsByDevice
+	c.mountsByPath = mountsByPath
 	return nil
 }
 
-// readMountInfo parse mount point
-func readMountInfo(r io.Reader) error {
+// changed polls the mountinfo file without blocking, the kernel reports a
+// mount table change since the last poll as POLLPRI. The caller must hold
+// c.mu.
+func (c *Cache) changed() bool {
+	fds := []unix.PollFd{{Fd: int32(c.file.Fd()), Events: unix.POLLPRI}}
+	n, err := unix.Poll(fds, 0)
+	if err != nil {
+		// Can't tell, reread to be safe
+		klog.V(3).Infof("failed to poll %s: %v", c.mountInfoPath, err)
+		return true
+	}
+	return n > 0 && fds[0].Revents&(unix.POLLPRI|unix.POLLERR) != 0
+}
+
+// readMountInfo parse mount point of the host whose root directory is root,
+// returning the main mount of each filesystem and all mounts by path
+func readMountInfo(r io.Reader, root string) (map[DeviceNumber]*Mount, map[string]*Mount, error) {
 	mountsByPath := make(map[string]*Mount)
-	mountsByDevice = make(map[DeviceNumber]*Mount)
+	mountsByDevice := make(map[DeviceNumber]*Mount)
 
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
@@ -117,16 +309,21 @@ func readMountInfo(r io.Reader) error {
 		}
 
 		// We can only use mountpoints that are directories for fscrypt.
-		if !isDir(mnt.Path) {
+		if !isDir(HostPath(root, mnt.Path)) {
 			klog.V(3).Infof("ignoring mountpoint %q because it is not a directory", mnt.Path)
 			continue
 		}
 
+		mnt.Device = getDeviceName(root, mnt.DeviceNumber, mnt.Source)
+
 		// Note this overrides the info if we have seen the mountpoint
 		// earlier in the file. This is correct behavior because the
 		// mountpoints are listed in mount order.
 		mountsByPath[mnt.Path] = mnt
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
 	// For each filesystem, choose a "main" Mount and discard any additional
 	// bind mounts.  fscrypt only cares about the main Mount, since it's
 	// where the fscrypt metadata is stored.  Store all main Mounts in
@@ -137,11 +334,15 @@ func readMountInfo(r io.Reader) error {
 			append(allMountsByDevice[mnt.DeviceNumber], mnt)
 	}
 	for deviceNumber, filesystemMounts := range allMountsByDevice {
-		mountsByDevice[deviceNumber] = findMainMount(filesystemMounts)
+		mainMount := findMainMount(filesystemMounts)
+		for _, mnt := range filesystemMounts {
+			mnt.Main = mainMount
+		}
+		mountsByDevice[deviceNumber] = mainMount
 		klog.V(2).Infof("generating mount info for dev(%v): %+v",
 			deviceNumber, mountsByDevice[deviceNumber])
 	}
-	return nil
+	return mountsByDevice, mountsByPath, nil
 }
 
 // findMainMount find main mount point if the device has multi mount points
@@ -244,11 +445,26 @@ func parseMountInfoLine(line string) *Mount {
 		}
 	}
 	mnt.FilesystemType = unescapeString(fields[n+1])
-	mnt.Device = getDeviceName(mnt.DeviceNumber)
+	mnt.Source = unescapeString(fields[n+2])
 	mnt.Options = fields[len(fields)-1]
+	if mnt.FilesystemType == "overlay" {
+		parseOverlayOptions(mnt)
+	}
 	return mnt
 }
 
+// parseOverlayOptions set the upper and work directories of an overlay mount
+// from its super options. Commas in the paths are escaped in mountinfo.
+func parseOverlayOptions(mnt *Mount) {
+	for _, opt := range strings.Split(mnt.Options, ",") {
+		if dir, ok := strings.CutPrefix(opt, "upperdir="); ok {
+			mnt.UpperDir = unescapeString(dir)
+		} else if dir, ok := strings.CutPrefix(opt, "workdir="); ok {
+			mnt.WorkDir = unescapeString(dir)
+		}
+	}
+}
+
 func addUncontainedSubtreesRecursive(dst map[string]bool,
 	node *mountpointTreeNode, allUncontainedSubtrees map[string]bool) {
 	if allUncontainedSubtrees[node.mount.Subtree] {
@@ -296,19 +512,56 @@ func unescapeString(str string) string {
 	return sb.String()
 }
 
-func getDeviceName(num DeviceNumber) string {
-	linkPath := fmt.Sprintf("/sys/dev/block/%v", num)
+// getDeviceName resolve the block device node of the device number. The
+// sysfs name is tried first, preferring the /dev/mapper name of
+// device-mapper devices, then udev's /dev/block link and the mount source.
+// Only existing nodes of the device are returned, "" if there is none.
+func getDeviceName(root string, num DeviceNumber, source string) string {
+	linkPath := HostPath(root, fmt.Sprintf("/sys/dev/block/%v", num))
 	if target, err := os.Readlink(linkPath); err == nil {
-		devDir := "/dev"
-		return path.Join(devDir, filepath.Base(target))
+		if dmName, err := os.ReadFile(filepath.Join(linkPath, "dm", "name")); err == nil {
+			devPath := HostPath(root, path.Join("/dev/mapper", strings.TrimSpace(string(dmName))))
+			if isBlockDevice(devPath, num) {
+				return devPath
+			}
+		}
+		devDir := HostPath(root, "/dev")
+		if devPath := path.Join(devDir, filepath.Base(target)); isBlockDevice(devPath, num) {
+			return devPath
+		}
+	}
+	if devPath := HostPath(root, path.Join("/dev/block", num.String())); isBlockDevice(devPath, num) {
+		return devPath
 	}
+	if strings.HasPrefix(source, "/dev/") {
+		if devPath := HostPath(root, source); isBlockDevice(devPath, num) {
+			return devPath
+		}
+	}
+	klog.V(3).Infof("no block device node found for %v (source %q)", num, source)
 	return ""
 }
 
+// isBlockDevice returns true if the path is a block device node of num
+func isBlockDevice(path string, num DeviceNumber) bool {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return false
+	}
+	return stat.Mode&unix.S_IFMT == unix.S_IFBLK && DeviceNumber(stat.Rdev) == num
+}
+
+// HostPath returns the path of a host path under the host's root directory.
+// The path is cleaned as an absolute path first, so that .. can't escape
+// the root.
+func HostPath(root, path string) string {
+	return filepath.Join(root, filepath.Clean("/"+path))
+}
+
 func getNumberOfContainingDevice(path string) (DeviceNumber, error) {
 	var stat unix.Stat_t
 	if err := unix.Lstat(path, &stat); err != nil {
-		return 0, err
+		return 0, &os.PathError{Op: "lstat", Path: path, Err: err}
 	}
 	return DeviceNumber(stat.Dev), nil
 }
@@ -0,0 +1,339 @@
+package project
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"xfsquotas/internal/mount"
+
+	"golang.org/x/sys/unix"
+)
+
+// Backend is the system interaction layer used by ProjectQuota. It resolves
+// the mount of a path, reads and writes directory project ids and talks to
+// the kernel quota subsystem.
+type Backend interface {
+	// FindMount returns the mount containing the path
+	FindMount(path string) (*mount.Mount, error)
+	// GetProjectID returns the project id the path is tagged with
+	GetProjectID(path string) (uint32, error)
+	// SetProjectID tags the path and everything below it with the project
+	// id, so that existing content is accounted to the project
+	SetProjectID(path string, id uint32) error
+	// GetQuota returns the limits and usage of the project on the mount
+	GetQuota(mnt *mount.Mount, id uint32) (*DiskQuotaSize, error)
+	// SetQuota sets the limits of the project on the mount
+	SetQuota(mnt *mount.Mount, id uint32, size *DiskQuotaSize) error
+	// FilesystemUUID returns the UUID of the filesystem of the mount
+	FilesystemUUID(mnt *mount.Mount) (string, error)
+}
+
+// contextTagger is implemented by Backends whose SetProjectID can be
+// cancelled while walking the tree
+type contextTagger interface {
+	// SetProjectIDContext is SetProjectID, stopping when ctx is done
+	SetProjectIDContext(ctx context.Context, path string, id uint32) error
+}
+
+// treeTagger is implemented by Backends that can tag a tree while leaving
+// some of its subtrees alone, e.g. the nested trees of other projects, and
+// tell how a tree is tagged so that a retag can be undone subtree by subtree
+type treeTagger interface {
+	// SetProjectIDSkipping is SetProjectIDContext, leaving the directories
+	// of skip and everything below them untouched
+	SetProjectIDSkipping(ctx context.Context, path string, id uint32, skip []string) error
+	// ProjectIDs returns the project id of the path and of the directories
+	// below it tagged differently from their parent, not looking below the
+	// directories of skip
+	ProjectIDs(ctx context.Context, path string, skip []string) (map[string]uint32, error)
+}
+
+// quotaLister is implemented by Backends that can enumerate the projects
+// with a dquot on a filesystem, whether or not they are recorded
+type quotaLister interface {
+	// ListQuotas returns the limits and usage of the projects with a
+	// dquot on the filesystem of the mount, by project id
+	ListQuotas(mnt *mount.Mount) (map[uint32]*DiskQuotaSize, error)
+}
+
+// graceManager is implemented by Backends that can read and set the grace
+// times of a filesystem
+type graceManager interface {
+	// GetGrace returns the grace times of project quota on the filesystem
+	// of the mount
+	GetGrace(mnt *mount.Mount) (*GraceTimes, error)
+	// SetGrace sets the grace times of project quota on the filesystem of
+	// the mount
+	SetGrace(mnt *mount.Mount, grace *GraceTimes) error
+}
+
+// filesystemLister is implemented by Backends that can enumerate the
+// mounted filesystems and their capacity
+type filesystemLister interface {
+	// Mounts returns the main mount of every filesystem
+	Mounts() ([]*mount.Mount, error)
+	// Capacity returns the size of the filesystem of the mount
+	Capacity(mnt *mount.Mount) (*Capacity, error)
+}
+
+// fileStore reads and writes the project files. A Backend may implement it
+// to keep the project files somewhere other than the host filesystem.
+type fileStore interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte) error
+	// RemoveFile removes the named file, it is not an error if it
+	// doesn't exist
+	RemoveFile(name string) error
+}
+
+// kernelBackend is the Backend talking to the running kernel
+type kernelBackend struct {
+	// the host's root directory, paths are resolved under it
+	root string
+	// mounts of the host, nil for the package level lookups
+	mounts *mount.Cache
+}
+
+// newKernelBackend creates a kernelBackend for the host whose root
+// directory is mounted at root
+func newKernelBackend(root string) *kernelBackend {
+	if root == "" || root == "/" {
+		return &kernelBackend{root: "/"}
+	}
+	return &kernelBackend{
+		root:   root,
+		mounts: mount.NewHostCache(root, mount.HostMountInfoPath),
+	}
+}
+
+// FindMount returns the mount containing the path
+func (k *kernelBackend) FindMount(path string) (*mount.Mount, error) {
+	if k.mounts == nil {
+		mnt, err := mount.FindMount(path)
+		return mnt, wrapErrno(err)
+	}
+	mnt, err := k.mounts.FindMount(path)
+	return mnt, wrapErrno(err)
+}
+
+// GetProjectID returns the project id the path is tagged with
+func (k *kernelBackend) GetProjectID(path string) (uint32, error) {
+	id, err := getProjectID(mount.HostPath(k.root, path))
+	return uint32(id), wrapErrno(err)
+}
+
+// SetProjectID tags the path and everything below it with the project id
+func (k *kernelBackend) SetProjectID(path string, id uint32) error {
+	return k.SetProjectIDContext(context.Background(), path, id)
+}
+
+// SetProjectIDContext is SetProjectID, stopping when ctx is done
+func (k *kernelBackend) SetProjectIDContext(ctx context.Context, path string, id uint32) error {
+	return k.SetProjectIDSkipping(ctx, path, id, nil)
+}
+
+// SetProjectIDSkipping is SetProjectIDContext, leaving the directories of
+// skip and everything below them untouched
+func (k *kernelBackend) SetProjectIDSkipping(ctx context.Context, path string, id uint32, skip []string) error {
+	return wrapErrno(setProjectIDRecursive(ctx, mount.HostPath(k.root, path), quotaID(id), k.hostPaths(skip)))
+}
+
+// ProjectIDs returns the project id of the path and of the directories below
+// it tagged differently from their parent
+func (k *kernelBackend) ProjectIDs(ctx context.Context, path string, skip []string) (map[string]uint32, error) {
+	hostPath := mount.HostPath(k.root, path)
+	ids, err := getProjectIDs(ctx, hostPath, k.hostPaths(skip))
+	if err != nil {
+		return nil, wrapErrno(err)
+	}
+	// Back to paths as seen by the host
+	tags := make(map[string]uint32, len(ids))
+	for dir, id := range ids {
+		rel, err := filepath.Rel(hostPath, dir)
+		if err != nil {
+			return nil, err
+		}
+		tags[filepath.Join(path, rel)] = uint32(id)
+	}
+	return tags, nil
+}
+
+// hostPaths returns the set of the paths under the host's root directory
+func (k *kernelBackend) hostPaths(paths []string) map[string]bool {
+	set := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		set[mount.HostPath(k.root, path)] = true
+	}
+	return set
+}
+
+// GetQuota returns the limits and usage of the project on the mount. XFS has
+// its own quotactl interface, other filesystems use the generic one.
+func (k *kernelBackend) GetQuota(mnt *mount.Mount, id uint32) (*DiskQuotaSize, error) {
+	target, err := k.openQuotaTarget(mnt)
+	if err != nil {
+		return nil, wrapErrno(err)
+	}
+	defer target.close()
+
+	var size *DiskQuotaSize
+	if mnt.FilesystemType == "xfs" {
+		size, err = getProjectQuota(target, quotaID(id))
+	} else {
+		size, err = getGenericProjectQuota(target, quotaID(id))
+	}
+	return size, wrapErrno(err)
+}
+
+// SetQuota sets the limits of the project on the mount
+func (k *kernelBackend) SetQuota(mnt *mount.Mount, id uint32, size *DiskQuotaSize) error {
+	target, err := k.openQuotaTarget(mnt)
+	if err != nil {
+		return wrapErrno(err)
+	}
+	defer target.close()
+
+	if mnt.FilesystemType == "xfs" {
+		return wrapErrno(setProjectQuota(target, quotaID(id), size))
+	}
+	return wrapErrno(setGenericProjectQuota(target, quotaID(id), size))
+}
+
+// ListQuotas returns the limits and usage of the projects with a dquot on
+// the filesystem of the mount
+func (k *kernelBackend) ListQuotas(mnt *mount.Mount) (map[uint32]*DiskQuotaSize, error) {
+	target, err := k.openQuotaTarget(mnt)
+	if err != nil {
+		return nil, wrapErrno(err)
+	}
+	defer target.close()
+
+	var quotas map[uint32]*DiskQuotaSize
+	if mnt.FilesystemType == "xfs" {
+		quotas, err = listProjectQuotas(target)
+	} else {
+		quotas, err = listGenericProjectQuotas(target)
+	}
+	return quotas, wrapErrno(err)
+}
+
+// GetGrace returns the grace times of project quota on the filesystem of
+// the mount
+func (k *kernelBackend) GetGrace(mnt *mount.Mount) (*GraceTimes, error) {
+	target, err := k.openQuotaTarget(mnt)
+	if err != nil {
+		return nil, wrapErrno(err)
+	}
+	defer target.close()
+
+	var grace *GraceTimes
+	if mnt.FilesystemType == "xfs" {
+		grace, err = getGraceTimes(target)
+	} else {
+		grace, err = getGenericGraceTimes(target)
+	}
+	return grace, wrapErrno(err)
+}
+
+// SetGrace sets the grace times of project quota on the filesystem of the
+// mount
+func (k *kernelBackend) SetGrace(mnt *mount.Mount, grace *GraceTimes) error {
+	target, err := k.openQuotaTarget(mnt)
+	if err != nil {
+		return wrapErrno(err)
+	}
+	defer target.close()
+
+	if mnt.FilesystemType == "xfs" {
+		return wrapErrno(setGraceTimes(target, grace))
+	}
+	return wrapErrno(setGenericGraceTimes(target, grace))
+}
+
+// Mounts returns the main mount of every filesystem of the host
+func (k *kernelBackend) Mounts() ([]*mount.Mount, error) {
+	if k.mounts == nil {
+		return mount.Mounts()
+	}
+	return k.mounts.Mounts()
+}
+
+// Capacity returns the size of the filesystem of the mount from statfs(2)
+func (k *kernelBackend) Capacity(mnt *mount.Mount) (*Capacity, error) {
+	var stat unix.Statfs_t
+	mountPath := mount.HostPath(k.root, mnt.Path)
+	if err := unix.Statfs(mountPath, &stat); err != nil {
+		return nil, wrapErrno(&os.PathError{Op: "statfs", Path: mountPath, Err: err})
+	}
+	return &Capacity{
+		Bytes:      stat.Blocks * uint64(stat.Bsize),
+		BytesFree:  stat.Bavail * uint64(stat.Bsize),
+		Inodes:     stat.Files,
+		InodesFree: stat.Ffree,
+	}, nil
+}
+
+// openQuotaTarget returns the target quota commands on the mount are issued
+// on. The block device is used when its node was found, otherwise the mount
+// point is opened for quotactl_fd(2), which needs no device node at all.
+func (k *kernelBackend) openQuotaTarget(mnt *mount.Mount) (*quotaTarget, error) {
+	if mnt.Device != "" {
+		return &quotaTarget{device: mnt.Device, mountPath: mnt.Path, mountFd: -1}, nil
+	}
+	if !hasQuotactlFd() {
+		return nil, fmt.Errorf("no block device node found for %s (device %s, source %q) and the kernel lacks quotactl_fd(2)",
+			mnt.Path, mnt.DeviceNumber, mnt.Source)
+	}
+	mountPath := mount.HostPath(k.root, mnt.Path)
+	fd, err := unix.Open(mountPath, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("no block device node found for %s (device %s, source %q) and its mount point can't be opened: %w",
+			mnt.Path, mnt.DeviceNumber, mnt.Source, err)
+	}
+	return &quotaTarget{mountPath: mnt.Path, mountFd: fd}, nil
+}
+
+// fsIocGetFSUUID is FS_IOC_GETFSUUID, _IOR(0x15, 0, struct fsuuid2)
+const fsIocGetFSUUID = 0x80111500
+
+// fsuuid2 is the argument of FS_IOC_GETFSUUID
+type fsuuid2 struct {
+	len  uint8
+	uuid [16]byte
+}
+
+// FilesystemUUID returns the UUID of the filesystem of the mount. It is
+// asked from the kernel (Linux 6.5+), falling back to udev's
+// /dev/disk/by-uuid links.
+func (k *kernelBackend) FilesystemUUID(mnt *mount.Mount) (string, error) {
+	fd, err := unix.Open(mount.HostPath(k.root, mnt.Path), unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return "", err
+	}
+	var u fsuuid2
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), fsIocGetFSUUID, uintptr(unsafe.Pointer(&u)))
+	unix.Close(fd)
+	if errno == 0 && u.len == 16 {
+		b := u.uuid
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+	}
+
+	byUUID := mount.HostPath(k.root, "/dev/disk/by-uuid")
+	entries, err := os.ReadDir(byUUID)
+	if err != nil {
+		return "", fmt.Errorf("FS_IOC_GETFSUUID failed (%v) and %v", errno, err)
+	}
+	for _, entry := range entries {
+		var stat unix.Stat_t
+		if err := unix.Stat(filepath.Join(byUUID, entry.Name()), &stat); err != nil {
+			continue
+		}
+		if stat.Mode&unix.S_IFMT == unix.S_IFBLK && mount.DeviceNumber(stat.Rdev) == mnt.DeviceNumber {
+			return entry.Name(), nil
+		}
+	}
+	return "", fmt.Errorf("no uuid found for device %s", mnt.DeviceNumber)
+}
@@ -0,0 +1,469 @@
+package project
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"xfsquotas/internal/mount"
+
+	"k8s.io/klog/v2"
+)
+
+// QuotaSpec is the quota of one path in a batch
+type QuotaSpec struct {
+	Path string `json:"path"`
+	// limits, nil only accounts usage like TrackQuota
+	Size *DiskQuotaSize `json:"size"`
+	// pool to allocate a new project id from, the default pool if empty
+	Pool string `json:"pool"`
+}
+
+// BatchResult is the outcome of one QuotaSpec of a batch
+type BatchResult struct {
+	Path string `json:"path"`
+	// the project id of the path, 0 if it wasn't applied
+	ID  uint32 `json:"id"`
+	Err error  `json:"-"`
+}
+
+// BatchMode decides what happens to a batch when one of its specs fails
+type BatchMode int
+
+const (
+	// AllOrNothing applies the batch only if every spec can be applied,
+	// changes already made are reverted when one fails
+	AllOrNothing BatchMode = iota
+	// ContinueOnError applies every spec that can be applied
+	ContinueOnError
+)
+
+// ErrBatchAborted is the error of the specs of an AllOrNothing batch that
+// were not applied because another spec failed
+var ErrBatchAborted = errors.New("not applied, the batch was aborted")
+
+// preparedSpec is a QuotaSpec whose path has been resolved
+type preparedSpec struct {
+	path  string
+	mount *mount.Mount
+	pool  *Pool
+	size  *DiskQuotaSize
+}
+
+// batchItem tracks a spec through ApplyBatch
+type batchItem struct {
+	*preparedSpec
+	result *BatchResult
+	id     quotaID
+	// the id was allocated by this batch
+	isNewId bool
+	// the new id was recorded before the specs were applied
+	reserved bool
+}
+
+// batchGroup is the specs of a batch sharing project files, and the project
+// ids loaded from them
+type batchGroup struct {
+	mount    *mount.Mount
+	items    []*batchItem
+	registry *registry
+	idNames  map[quotaID]string
+	idPaths  map[quotaID][]string
+	pathIds  map[string]quotaID
+	nameIds  map[string]quotaID
+	// the global project ids as last read and the lock, see session
+	loadedPaths map[quotaID][]string
+	loadedNames map[quotaID]string
+	lockName    string
+}
+
+// save remembers the project ids of the group while another one is loaded
+func (g *batchGroup) save(s *session) {
+	g.registry = s.registry
+	g.idNames, g.idPaths, g.pathIds, g.nameIds = s.idNames, s.idPaths, s.pathIds, s.nameIds
+	g.loadedPaths, g.loadedNames, g.lockName = s.loadedPaths, s.loadedNames, s.lockName
+}
+
+// filesystems returns a mount of each filesystem of the specs of the group
+func (g *batchGroup) filesystems() []*mount.Mount {
+	seen := make(map[mount.DeviceNumber]bool)
+	var mounts []*mount.Mount
+	for _, item := range g.items {
+		if !seen[item.mount.DeviceNumber] {
+			seen[item.mount.DeviceNumber] = true
+			mounts = append(mounts, item.mount)
+		}
+	}
+	return mounts
+}
+
+// loadMount returns the mount the project ids of the group are loaded for:
+// nil for the global project files, and their lock, if its specs are on
+// several filesystems
+func (g *batchGroup) loadMount() *mount.Mount {
+	if len(g.filesystems()) > 1 {
+		return nil
+	}
+	return g.mount
+}
+
+// restore makes the project ids of the group current
+func (g *batchGroup) restore(s *session) {
+	s.registry = g.registry
+	s.idNames, s.idPaths, s.pathIds, s.nameIds = g.idNames, g.idPaths, g.pathIds, g.nameIds
+	s.loadedPaths, s.loadedNames, s.lockName = g.loadedPaths, g.loadedNames, g.lockName
+}
+
+// ApplyBatch sets the quotas of many paths at once. Mounts are resolved
+// once per spec, ids are allocated in a single pass under the lock of the
+// project files and the new ones recorded with a single write. Changes are
+// journaled like those of SetQuota: an AllOrNothing batch is a single
+// transaction, a ContinueOnError one a transaction per spec. The result of every spec is returned in order,
+// along with an error if any of them failed.
+func (p *ProjectQuota) ApplyBatch(specs []QuotaSpec, mode BatchMode) ([]*BatchResult, error) {
+	return p.ApplyBatchContext(context.Background(), specs, mode)
+}
+
+// ApplyBatchContext is ApplyBatch, stopping when ctx is done. The specs not
+// applied by then fail with the error of ctx.
+func (p *ProjectQuota) ApplyBatchContext(ctx context.Context, specs []QuotaSpec, mode BatchMode) ([]*BatchResult, error) {
+	return p.newSession().applyBatch(ctx, specs, mode)
+}
+
+// applyBatch applies the batch
+func (s *session) applyBatch(ctx context.Context, specs []QuotaSpec, mode BatchMode) ([]*BatchResult, error) {
+	results := make([]*BatchResult, len(specs))
+	var groups []*batchGroup
+	groupOf := make(map[string]*batchGroup)
+	failed := 0
+	for i := range specs {
+		results[i] = &BatchResult{Path: specs[i].Path}
+		spec, err := s.prepareSpec(&specs[i])
+		if err != nil {
+			results[i].Err = err
+			failed++
+			continue
+		}
+		item := &batchItem{preparedSpec: spec, result: results[i]}
+		// Specs share the global project files unless each filesystem
+		// has its own registry
+		key := ""
+		if s.mountRegistry {
+			key = spec.mount.DeviceNumber.String()
+		}
+		group, ok := groupOf[key]
+		if !ok {
+			group = &batchGroup{mount: spec.mount}
+			groupOf[key] = group
+			groups = append(groups, group)
+		}
+		group.items = append(group.items, item)
+	}
+	if failed > 0 && mode == AllOrNothing {
+		return abortBatch(results, failed)
+	}
+
+	// A group on several filesystems also takes the global lock
+	var mounts []*mount.Mount
+	for _, group := range groups {
+		mounts = append(mounts, group.filesystems()...)
+		mounts = append(mounts, group.loadMount())
+	}
+	unlock, err := s.lock(ctx, mounts...)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	defer func() {
+		if err := s.releaseBatchIds(groups); err != nil {
+			klog.Errorf("failed to release the project ids of the batch: %v", err)
+		}
+	}()
+
+	allocated, err := s.allocateBatchIds(groups, mode)
+	if err != nil {
+		return failBatch(results, err)
+	}
+	failed += allocated
+	if failed > 0 && mode == AllOrNothing {
+		return abortBatch(results, failed)
+	}
+	if s.dryRun {
+		return s.planBatch(ctx, groups, results, failed)
+	}
+
+	if mode == AllOrNothing {
+		return s.applyAllOrNothing(ctx, groups, results)
+	}
+
+	for _, group := range groups {
+		group.restore(s)
+		for _, item := range group.items {
+			if item.result.Err != nil {
+				continue
+			}
+			if err := s.applyBatchItem(ctx, item); err != nil {
+				item.result.Err = err
+				failed++
+				// Release the id allocated for the failed spec
+				if item.isNewId {
+					s.removeProjectId(item.path, !persistToFile)
+				}
+				continue
+			}
+			item.result.ID = uint32(item.id)
+		}
+		group.save(s)
+	}
+
+	// The ids of the failed specs are released, the applied ones were
+	// recorded beforehand
+	if err := s.releaseBatchIds(groups); err != nil {
+		return results, err
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d quotas failed", failed, len(specs))
+	}
+	return results, nil
+}
+
+// allocateBatchIds allocates the ids of the specs of the groups and admits
+// their limits before anything is changed, returning how many specs failed.
+// Unless the batch is aborted or a dry run, the new ids of each group are
+// then recorded with a single write. The global lock is held throughout, so
+// that operations on other filesystems don't take the ids meanwhile, and
+// the steps of the batch leave the recording to it.
+func (s *session) allocateBatchIds(groups []*batchGroup, mode BatchMode) (int, error) {
+	unlock, err := s.lockGlobal()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	s.deferRecords = true
+	failed := 0
+	commitments := make(map[mount.DeviceNumber]*commitment)
+	for _, group := range groups {
+		if err := s.loadProjectIds(group.loadMount()); err != nil {
+			return failed, err
+		}
+		if err := s.checkJournal(); err != nil {
+			return failed, err
+		}
+		for _, item := range group.items {
+			item.id, item.isNewId, err = s.findOrCreateProjectId(item.path, item.pool, !projIdNoCreate, !persistToFile)
+			if err != nil {
+				item.result.Err = err
+				failed++
+			}
+		}
+		for _, item := range group.items {
+			if item.result.Err != nil {
+				continue
+			}
+			c, ok := commitments[item.mount.DeviceNumber]
+			if !ok {
+				if c, err = s.newCommitment(item.mount); err != nil {
+					return failed, err
+				}
+				commitments[item.mount.DeviceNumber] = c
+			}
+			if err := s.admit(c, item.path, item.id, item.size.Quota); err != nil {
+				item.result.Err = err
+				failed++
+				if item.isNewId {
+					s.removeProjectId(item.path, !persistToFile)
+				}
+			}
+		}
+		group.save(s)
+	}
+	if failed > 0 && mode == AllOrNothing || s.dryRun {
+		return failed, nil
+	}
+
+	for _, group := range groups {
+		var reserved []*batchItem
+		for _, item := range group.items {
+			if item.isNewId && item.result.Err == nil {
+				reserved = append(reserved, item)
+			}
+		}
+		if len(reserved) == 0 {
+			continue
+		}
+		group.restore(s)
+		if err := s.persistProjectIds(); err != nil {
+			return failed, err
+		}
+		group.save(s)
+		for _, item := range reserved {
+			item.reserved = true
+		}
+	}
+	return failed, nil
+}
+
+// applyAllOrNothing applies the batch as a single transaction. The journals
+// of the project files of every group are written before any step is made,
+// so a failed step reverts the whole batch, and recover finishes or rolls
+// back all of it after a crash.
+func (s *session) applyAllOrNothing(ctx context.Context, groups []*batchGroup, results []*BatchResult) ([]*BatchResult, error) {
+	steps := make([][]*JournalStep, len(groups))
+	// the item of each step, by group
+	owners := make([][]*batchItem, len(groups))
+	for i, group := range groups {
+		group.restore(s)
+		for _, item := range group.items {
+			itemSteps, err := s.setSteps(ctx, item.preparedSpec, item.id, item.isNewId)
+			if err != nil {
+				item.result.Err = err
+				return abortBatch(results, 1)
+			}
+			steps[i] = append(steps[i], itemSteps...)
+			for range itemSteps {
+				owners[i] = append(owners[i], item)
+			}
+		}
+	}
+	for i, group := range groups {
+		group.restore(s)
+		if err := s.writeJournal(&Journal{Op: "batch", Path: group.mount.Path, Steps: steps[i], Lock: s.scope()}); err != nil {
+			if removeErr := s.removeBatchJournals(groups[:i]); removeErr != nil {
+				klog.Errorf("failed to remove journal %s: %v", s.journalPath, removeErr)
+			}
+			return nil, err
+		}
+	}
+
+	for i, group := range groups {
+		group.restore(s)
+		done, err := s.doSteps(ctx, "batch", group.mount.Path, steps[i])
+		if err == nil {
+			continue
+		}
+		owners[i][done].result.Err = err
+		undoCtx := context.WithoutCancel(ctx)
+		undoErr := s.undoSteps(undoCtx, steps[i][:done])
+		for j := i - 1; j >= 0 && undoErr == nil; j-- {
+			groups[j].restore(s)
+			undoErr = s.undoSteps(undoCtx, steps[j])
+		}
+		if undoErr != nil {
+			klog.Errorf("failed to roll back the batch, run xfsquota recover: %v", undoErr)
+		} else if removeErr := s.removeBatchJournals(groups); removeErr != nil {
+			klog.Errorf("failed to remove journal %s: %v", s.journalPath, removeErr)
+		}
+		return abortBatch(results, 1)
+	}
+	if err := s.removeBatchJournals(groups); err != nil {
+		return results, err
+	}
+	for _, group := range groups {
+		for _, item := range group.items {
+			item.result.ID = uint32(item.id)
+		}
+	}
+	return results, nil
+}
+
+// releaseBatchIds forgets the ids recorded for the specs that were not
+// applied
+func (s *session) releaseBatchIds(groups []*batchGroup) error {
+	for _, group := range groups {
+		var released []*batchItem
+		for _, item := range group.items {
+			if item.reserved && item.result.ID == 0 {
+				released = append(released, item)
+			}
+		}
+		if len(released) == 0 {
+			continue
+		}
+		group.restore(s)
+		for _, item := range released {
+			s.removeProjectId(item.path, !persistToFile)
+		}
+		if err := s.persistProjectIds(); err != nil {
+			return err
+		}
+		group.save(s)
+		for _, item := range released {
+			item.reserved = false
+		}
+	}
+	return nil
+}
+
+// removeBatchJournals removes the journals of a batch from the project files
+// of the groups
+func (s *session) removeBatchJournals(groups []*batchGroup) error {
+	for _, group := range groups {
+		group.restore(s)
+		if err := s.removeJournal(s.scope()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// planBatch records the plan of every spec of the batch whose id could be
+// allocated, without applying any
+func (s *session) planBatch(ctx context.Context, groups []*batchGroup, results []*BatchResult,
+	failed int) ([]*BatchResult, error) {
+	for _, group := range groups {
+		group.restore(s)
+		for _, item := range group.items {
+			if item.result.Err != nil {
+				continue
+			}
+			steps, err := s.setSteps(ctx, item.preparedSpec, item.id, item.isNewId)
+			if err != nil {
+				item.result.Err = err
+				failed++
+				continue
+			}
+			s.addPlan("set", item.path, steps)
+			item.result.ID = uint32(item.id)
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d quotas failed", failed, len(results))
+	}
+	return results, nil
+}
+
+// applyBatchItem sets the quota of the item in a transaction of its own
+func (s *session) applyBatchItem(ctx context.Context, item *batchItem) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	steps, err := s.setSteps(ctx, item.preparedSpec, item.id, item.isNewId)
+	if err != nil {
+		return err
+	}
+	return s.runTransaction(ctx, "set", item.path, steps)
+}
+
+// failBatch fails the specs of the batch without an error with err
+func failBatch(results []*BatchResult, err error) ([]*BatchResult, error) {
+	for _, result := range results {
+		result.ID = 0
+		if result.Err == nil {
+			result.Err = err
+		}
+	}
+	return results, err
+}
+
+// abortBatch marks the specs without an error of an AllOrNothing batch as
+// aborted
+func abortBatch(results []*BatchResult, failed int) ([]*BatchResult, error) {
+	for _, result := range results {
+		result.ID = 0
+		if result.Err == nil {
+			result.Err = ErrBatchAborted
+		}
+	}
+	return results, fmt.Errorf("%d of %d quotas failed, none applied", failed, len(results))
+}
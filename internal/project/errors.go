@@ -0,0 +1,93 @@
+package project
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// Kinds of errors, test for them with errors.Is. Errors caused by a system
+// call also wrap its errno, e.g. both ErrPermission and unix.EPERM.
+var (
+	// ErrNotXFS means the filesystem of the path has no project quota
+	// support, only xfs and ext4 have
+	ErrNotXFS = errors.New("filesystem doesn't support project quota")
+	// ErrQuotaDisabled means project quota accounting is off on the
+	// filesystem, e.g. it isn't mounted with prjquota
+	ErrQuotaDisabled = errors.New("project quota is not enabled")
+	// ErrNotEnforced means limits were set on a filesystem that only
+	// accounts project quota, e.g. mounted with pqnoenforce
+	ErrNotEnforced = errors.New("project quota is not enforced")
+	// ErrPermission means the caller lacks the privileges, usually
+	// CAP_SYS_ADMIN
+	ErrPermission = errors.New("permission denied")
+	// ErrIDExhausted means every project id of the pool is used
+	ErrIDExhausted = errors.New("no unused project id")
+	// ErrPathNotFound means the path doesn't exist
+	ErrPathNotFound = errors.New("path not found")
+	// ErrConflictingProject means the path already belongs to a project
+	// that can't be used for the operation
+	ErrConflictingProject = errors.New("conflicting project")
+	// ErrProjectNotFound means no project in the project files has the
+	// name
+	ErrProjectNotFound = errors.New("project not found")
+	// ErrOverCommitted means the hard limits of a filesystem would exceed
+	// its capacity by more than the over-commit policy allows
+	ErrOverCommitted = errors.New("over-committed")
+)
+
+// NotSupported is the former name of ErrNotXFS
+//
+// Deprecated: use ErrNotXFS
+var NotSupported = ErrNotXFS
+
+// Error is an error of one of the kinds above. It reads as the error that
+// caused it, and unwraps to both its kind and its cause.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+// Error returns the message of the cause
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Kind.Error()
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the kind and the cause of the error
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// wrapErrno gives err the kind of the errno it wraps, if any. Errors without
+// a known errno are returned as is.
+func wrapErrno(err error) error {
+	var typed *Error
+	if err == nil || errors.As(err, &typed) {
+		return err
+	}
+	var errno unix.Errno
+	if !errors.As(err, &errno) {
+		return err
+	}
+	var kind error
+	switch errno {
+	case unix.ENOENT:
+		kind = ErrPathNotFound
+	case unix.EPERM, unix.EACCES:
+		kind = ErrPermission
+	case unix.ESRCH, unix.ENOSYS:
+		// Older kernels fail quota commands with ENOSYS when quota is off
+		kind = ErrQuotaDisabled
+	case unix.ENOTTY, unix.EOPNOTSUPP:
+		kind = ErrNotXFS
+	default:
+		return err
+	}
+	return &Error{Kind: kind, Err: err}
+}
@@ -0,0 +1,395 @@
+package project
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"xfsquotas/internal/mount"
+
+	"k8s.io/klog/v2"
+)
+
+// exportVersion is the version of the QuotaExport format
+const exportVersion = 1
+
+// GraceTimes are how long, in seconds, the usage of a project may exceed
+// its soft limits. They are set per filesystem.
+type GraceTimes struct {
+	Blocks   uint32 `json:"blocks"`
+	Inodes   uint32 `json:"inodes"`
+	RtBlocks uint32 `json:"rtBlocks,omitempty"`
+}
+
+// QuotaExport is the quota configuration of the managed paths, which lives
+// partly in the project files and partly in the kernel dquots
+type QuotaExport struct {
+	Version     int                   `json:"version"`
+	Filesystems []*ExportedFilesystem `json:"filesystems"`
+}
+
+// ExportedFilesystem is the quota configuration of a filesystem
+type ExportedFilesystem struct {
+	// the mount point, filesystems reached only through quotactl_fd
+	// have no device
+	Mount string `json:"mount"`
+	Type  string `json:"type"`
+	// nil if the backend can't read them
+	Grace    *GraceTimes        `json:"grace,omitempty"`
+	Projects []*ExportedProject `json:"projects"`
+}
+
+// ExportedProject is a project with its paths and limits, without usage
+type ExportedProject struct {
+	ID     uint32         `json:"id"`
+	Name   string         `json:"name,omitempty"`
+	Paths  []string       `json:"paths"`
+	Limits *DiskQuotaSize `json:"limits"`
+}
+
+// RestoreOptions configures Restore
+type RestoreOptions struct {
+	// Remap gives a project whose id is used by another project of the
+	// filesystem a new id from its pool, instead of failing it
+	Remap bool
+}
+
+// RestoreResult is the outcome of restoring one project
+type RestoreResult struct {
+	Mount string   `json:"mount"`
+	Name  string   `json:"name,omitempty"`
+	Paths []string `json:"paths"`
+	// the exported id and the id the project got, they differ if it
+	// was remapped
+	ID    uint32 `json:"id"`
+	NewID uint32 `json:"newID,omitempty"`
+	// nil if the project was restored
+	Err error `json:"-"`
+}
+
+// Export returns the paths, ids, names and limits of the managed projects
+// and the grace times of their filesystems. Paths on filesystems that aren't
+// mounted are left out.
+func (p *ProjectQuota) Export() (*QuotaExport, error) {
+	return p.ExportContext(context.Background())
+}
+
+// ExportContext is Export, stopping when ctx is done
+func (p *ProjectQuota) ExportContext(ctx context.Context) (*QuotaExport, error) {
+	return p.newSession().export(ctx)
+}
+
+// export reads the records of all filesystems
+func (s *session) export(ctx context.Context) (*QuotaExport, error) {
+	if err := s.loadProjectIds(nil); err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(s.pathIds))
+	for path := range s.pathIds {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	// device number => filesystem, device number => id => project
+	filesystems := make(map[mount.DeviceNumber]*ExportedFilesystem)
+	projects := make(map[mount.DeviceNumber]map[quotaID]*ExportedProject)
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		projectID := s.pathIds[path]
+		backingDev, err := s.findAvailableBackingDev(path)
+		if err != nil {
+			klog.Errorf("skip project %d of %s: %v", projectID, path, err)
+			continue
+		}
+		if !backingDev.supported {
+			klog.Errorf("skip project %d of %s: %v", projectID, path, unsupportedError(path, backingDev.mount))
+			continue
+		}
+		mnt := backingDev.mount
+		fs, ok := filesystems[mnt.DeviceNumber]
+		if !ok {
+			fs = &ExportedFilesystem{Mount: mnt.Path, Type: mnt.FilesystemType}
+			if g, ok := s.backend.(graceManager); ok {
+				if fs.Grace, err = g.GetGrace(mnt); err != nil {
+					return nil, err
+				}
+			}
+			filesystems[mnt.DeviceNumber] = fs
+			projects[mnt.DeviceNumber] = make(map[quotaID]*ExportedProject)
+		}
+		project, ok := projects[mnt.DeviceNumber][projectID]
+		if !ok {
+			size, err := s.backend.GetQuota(mnt, uint32(projectID))
+			if err != nil {
+				return nil, err
+			}
+			project = &ExportedProject{
+				ID:   uint32(projectID),
+				Name: s.idNames[projectID],
+				Limits: &DiskQuotaSize{
+					Quota:       size.Quota,
+					Inodes:      size.Inodes,
+					RtQuota:     size.RtQuota,
+					QuotaSoft:   size.QuotaSoft,
+					InodesSoft:  size.InodesSoft,
+					RtQuotaSoft: size.RtQuotaSoft,
+				},
+			}
+			projects[mnt.DeviceNumber][projectID] = project
+			fs.Projects = append(fs.Projects, project)
+		}
+		project.Paths = append(project.Paths, path)
+	}
+
+	export := &QuotaExport{Version: exportVersion, Filesystems: []*ExportedFilesystem{}}
+	for _, fs := range filesystems {
+		sort.Slice(fs.Projects, func(i, j int) bool {
+			return fs.Projects[i].ID < fs.Projects[j].ID
+		})
+		export.Filesystems = append(export.Filesystems, fs)
+	}
+	sort.Slice(export.Filesystems, func(i, j int) bool {
+		return export.Filesystems[i].Mount < export.Filesystems[j].Mount
+	})
+	return export, nil
+}
+
+// Restore records the projects of an export, tags their paths and sets
+// their limits and the grace times of their filesystems. The paths must
+// exist. Projects are restored one by one, the error of each is in its
+// result. Grace times aren't part of a dry run.
+func (p *ProjectQuota) Restore(export *QuotaExport, opts RestoreOptions) ([]*RestoreResult, error) {
+	return p.RestoreContext(context.Background(), export, opts)
+}
+
+// RestoreContext is Restore, stopping when ctx is done. A project being
+// restored when ctx is done is rolled back.
+func (p *ProjectQuota) RestoreContext(ctx context.Context, export *QuotaExport, opts RestoreOptions) ([]*RestoreResult, error) {
+	if export.Version != exportVersion {
+		return nil, fmt.Errorf("unsupported export version %d, expected %d", export.Version, exportVersion)
+	}
+	if err := p.checkPools(); err != nil {
+		return nil, err
+	}
+	s := p.newSession()
+	if p.dryRun {
+		// A dry run keeps the records planned so far
+		if err := s.loadProjectIds(nil); err != nil {
+			return nil, err
+		}
+	}
+	var results []*RestoreResult
+	for _, fs := range export.Filesystems {
+		fsResults, err := s.restoreFilesystem(ctx, fs, opts)
+		results = append(results, fsResults...)
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// restoreFilesystem restores the projects of the filesystem under the lock
+// of its project files
+func (s *session) restoreFilesystem(ctx context.Context, fs *ExportedFilesystem, opts RestoreOptions) ([]*RestoreResult, error) {
+	results := make([]*RestoreResult, 0, len(fs.Projects))
+	for _, project := range fs.Projects {
+		results = append(results, &RestoreResult{Mount: fs.Mount, Name: project.Name, Paths: project.Paths, ID: project.ID})
+	}
+	failAll := func(err error) ([]*RestoreResult, error) {
+		for _, result := range results {
+			result.Err = err
+		}
+		return results, nil
+	}
+	backingDev, err := s.findAvailableBackingDev(fs.Mount)
+	if err != nil {
+		return failAll(err)
+	}
+	mnt := backingDev.mount
+	if !backingDev.supported {
+		return failAll(unsupportedError(fs.Mount, mnt))
+	}
+
+	unlock, err := s.lock(ctx, mnt)
+	if err != nil {
+		return failAll(err)
+	}
+	defer unlock()
+	if !s.dryRun {
+		if err := s.loadProjectIds(mnt); err != nil {
+			return failAll(err)
+		}
+	}
+	for i, project := range fs.Projects {
+		if err := ctx.Err(); err != nil {
+			for _, result := range results[i:] {
+				result.Err = err
+			}
+			return results, err
+		}
+		results[i].NewID, results[i].Name, results[i].Err = s.restoreProject(ctx, mnt, project, opts)
+	}
+
+	if fs.Grace == nil || s.dryRun {
+		return results, nil
+	}
+	g, ok := s.backend.(graceManager)
+	if !ok {
+		klog.Warningf("grace times of %s not restored, the backend can't set them", fs.Mount)
+		return results, nil
+	}
+	return results, g.SetGrace(mnt, fs.Grace)
+}
+
+// restoreProject restores the project on the mount, and returns the id and
+// name it got
+func (s *session) restoreProject(ctx context.Context, mnt *mount.Mount, project *ExportedProject,
+	opts RestoreOptions) (uint32, string, error) {
+	if len(project.Paths) == 0 {
+		return 0, project.Name, fmt.Errorf("project %d has no paths", project.ID)
+	}
+	limits := project.Limits
+	if limits == nil {
+		limits = &DiskQuotaSize{}
+	}
+	if limits.RtQuota > 0 && mnt.FilesystemType != "xfs" {
+		return 0, project.Name, fmt.Errorf("realtime quota is only supported on xfs, %s is on %s",
+			mnt.Path, mnt.FilesystemType)
+	}
+	if limits.HasLimits() && hasMountOption(mnt, "pqnoenforce") {
+		return 0, project.Name, fmt.Errorf("%w: %s is mounted with pqnoenforce, use track to only account usage",
+			ErrNotEnforced, mnt.Path)
+	}
+
+	// The paths, as resolved on this host, and their project ids
+	paths := make([]string, 0, len(project.Paths))
+	tags := make(map[string]uint32)
+	for _, path := range project.Paths {
+		resolved, err := s.ResolvePath(path)
+		if err != nil {
+			return 0, project.Name, err
+		}
+		pathMnt, err := s.backend.FindMount(resolved)
+		if err != nil {
+			return 0, project.Name, err
+		}
+		if pathMnt.DeviceNumber != mnt.DeviceNumber {
+			return 0, project.Name, fmt.Errorf("%s is not on the filesystem mounted at %s", path, mnt.Path)
+		}
+		if tags[resolved], err = s.backend.GetProjectID(resolved); err != nil {
+			return 0, project.Name, err
+		}
+		if id, exists := s.pathIds[resolved]; exists && uint32(id) != project.ID {
+			return 0, project.Name, fmt.Errorf("%w: %s is already managed as project %d",
+				ErrConflictingProject, resolved, id)
+		}
+		paths = append(paths, resolved)
+	}
+
+	projectID := quotaID(project.ID)
+	name := project.Name
+	used, err := s.idUsed(mnt, projectID, paths, tags)
+	if err != nil {
+		return 0, name, err
+	}
+	var conflict error
+	if nameID, named := s.nameIds[name]; name != "" && named && nameID != projectID {
+		conflict = fmt.Errorf("%w: the name %s of project %d is used by project %d",
+			ErrConflictingProject, name, project.ID, nameID)
+	}
+	if used {
+		conflict = fmt.Errorf("%w: project %d is used by other paths on %s",
+			ErrConflictingProject, project.ID, mnt.Path)
+	}
+	if conflict != nil {
+		if !opts.Remap {
+			return 0, name, conflict
+		}
+		pool := s.poolOf(projectID)
+		if pool == nil {
+			pool = &s.pools[0]
+		}
+		if projectID, err = s.allocateProjectID(pool); err != nil {
+			return 0, name, err
+		}
+		name = remapName(name, quotaID(project.ID), projectID)
+		if _, exists := s.nameIds[name]; exists && name != "" {
+			name = projectID.IdName(pool.Name)
+		}
+	}
+
+	commitment, err := s.newCommitment(mnt)
+	if err != nil {
+		return 0, name, err
+	}
+	if err := s.admit(commitment, paths[0], projectID, limits.Quota); err != nil {
+		return 0, name, err
+	}
+
+	var steps []*JournalStep
+	for _, path := range paths {
+		if _, exists := s.pathIds[path]; !exists {
+			steps = append(steps, &JournalStep{Kind: StepRecord, Path: path, ID: uint32(projectID),
+				Name: name, Added: true})
+		}
+		if quotaID(tags[path]) != projectID {
+			tag, err := s.tagStep(ctx, path, uint32(projectID), tags[path])
+			if err != nil {
+				return 0, name, err
+			}
+			steps = append(steps, tag)
+		}
+	}
+	oldQuota, err := s.backend.GetQuota(mnt, uint32(projectID))
+	if err != nil {
+		return 0, name, err
+	}
+	steps = append(steps, &JournalStep{Kind: StepLimit, Path: mnt.Path, ID: uint32(projectID),
+		Old: oldQuota, New: limits})
+	if err := s.runTransaction(ctx, "restore", paths[0], steps); err != nil {
+		return 0, name, err
+	}
+	return uint32(projectID), name, nil
+}
+
+// idUsed reports whether the project id is used on the mount by something
+// other than the given paths: other recorded paths, or a dquot with limits
+// or usage while none of the paths is tagged with it
+func (s *session) idUsed(mnt *mount.Mount, id quotaID, paths []string, tags map[string]uint32) (bool, error) {
+	for _, recorded := range s.idPaths[id] {
+		found := false
+		for _, path := range paths {
+			found = found || path == recorded
+		}
+		if !found {
+			return true, nil
+		}
+	}
+	if len(s.idPaths[id]) > 0 {
+		return false, nil
+	}
+	for _, path := range paths {
+		if quotaID(tags[path]) == id {
+			return false, nil
+		}
+	}
+	size, err := s.backend.GetQuota(mnt, uint32(id))
+	if err != nil {
+		return false, err
+	}
+	return size.HasLimits() || size.QuotaUsed != 0 || size.InodesUsed != 0, nil
+}
+
+// remapName returns the name of a remapped project: names ending with the
+// old id, like the generated ones, end with the new id
+func remapName(name string, oldID, newID quotaID) string {
+	suffix := idNameSeprator + oldID.String()
+	if strings.HasSuffix(name, suffix) {
+		return strings.TrimSuffix(name, suffix) + idNameSeprator + newID.String()
+	}
+	return name
+}
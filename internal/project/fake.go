@@ -0,0 +1,506 @@
+package project
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"xfsquotas/internal/mount"
+
+	"golang.org/x/sys/unix"
+)
+
+// FakeBackend is an in-memory Backend for unit tests. It simulates mounted
+// filesystems, directory project ids, quota limits and usage, and keeps the
+// project files in memory, so it needs neither root nor a real XFS mount.
+type FakeBackend struct {
+	mu sync.Mutex
+	// mount point => mount
+	mounts map[string]*mount.Mount
+	// path => project id
+	projectIDs map[string]uint32
+	// directories removed with RemoveDir
+	removed map[string]bool
+	// mount points of the filesystems unmounted with RemoveMount
+	unmounted map[string]bool
+	// device number => project id => limits and usage
+	quotas map[mount.DeviceNumber]map[uint32]*DiskQuotaSize
+	// project file path => content
+	files map[string][]byte
+	// device number => grace times
+	grace map[mount.DeviceNumber]GraceTimes
+	// device number => capacity
+	capacity map[mount.DeviceNumber]Capacity
+}
+
+// NewFakeBackend creates a FakeBackend with a single XFS filesystem mounted
+// at "/" with project quota enabled
+func NewFakeBackend() *FakeBackend {
+	f := &FakeBackend{
+		mounts:     make(map[string]*mount.Mount),
+		projectIDs: make(map[string]uint32),
+		removed:    make(map[string]bool),
+		unmounted:  make(map[string]bool),
+		quotas:     make(map[mount.DeviceNumber]map[uint32]*DiskQuotaSize),
+		files:      make(map[string][]byte),
+		grace:      make(map[mount.DeviceNumber]GraceTimes),
+		capacity:   make(map[mount.DeviceNumber]Capacity),
+	}
+	f.AddMount("/", "xfs")
+	return f
+}
+
+// AddMount simulates a filesystem of the given type mounted at path
+func (f *FakeBackend) AddMount(path, fsType string) *mount.Mount {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	mnt := &mount.Mount{
+		Path:           filepath.Clean(path),
+		FilesystemType: fsType,
+		Device:         fmt.Sprintf("/dev/fake%d", len(f.mounts)),
+		DeviceNumber:   mount.DeviceNumber(len(f.mounts) + 1),
+		Subtree:        "/",
+		Options:        "rw," + quotaMountOption,
+	}
+	mnt.Main = mnt
+	f.mounts[mnt.Path] = mnt
+	return mnt
+}
+
+// RemoveMount simulates unmounting the filesystem mounted at path and its
+// bind mounts. The paths below its mount point don't exist until it is
+// mounted again, their project ids are kept.
+func (f *FakeBackend) RemoveMount(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	main, ok := f.mounts[filepath.Clean(path)]
+	if !ok {
+		return
+	}
+	for mountPath, mnt := range f.mounts {
+		if mnt.Main == main.Main {
+			delete(f.mounts, mountPath)
+			f.unmounted[mountPath] = true
+		}
+	}
+}
+
+// AddBindMount simulates bind mounting the directory source of a simulated
+// filesystem at path
+func (f *FakeBackend) AddBindMount(path, source string) (*mount.Mount, error) {
+	main, err := f.FindMount(source)
+	if err != nil {
+		return nil, err
+	}
+	subtree, err := main.FilesystemPath(filepath.Clean(source))
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	mnt := *main
+	mnt.Path = filepath.Clean(path)
+	mnt.Subtree = subtree
+	mnt.Main = main.Main
+	f.mounts[mnt.Path] = &mnt
+	return &mnt, nil
+}
+
+// FindMount returns the deepest simulated mount containing the path
+func (f *FakeBackend) FindMount(path string) (*mount.Mount, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.findMount(path)
+}
+
+// findMount returns the deepest simulated mount containing the path.
+// The caller must hold f.mu.
+func (f *FakeBackend) findMount(path string) (*mount.Mount, error) {
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		if mnt, ok := f.mounts[p]; ok {
+			return mnt, nil
+		}
+		if p == "/" || p == "." {
+			return nil, fmt.Errorf("couldn't find mountpoint containing %q", path)
+		}
+	}
+}
+
+// GetProjectID returns the project id the path is tagged with, inherited
+// from the nearest tagged ancestor on its filesystem
+func (f *FakeBackend) GetProjectID(path string) (uint32, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path = f.canonicalPath(path)
+	if err := f.checkExists(path); err != nil {
+		return 0, err
+	}
+	return f.projectID(path), nil
+}
+
+// RemoveDir simulates deleting the directory at path and everything below
+// it, the project ids of paths below it can't be read or set anymore
+func (f *FakeBackend) RemoveDir(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path = f.canonicalPath(path)
+	for tagged := range f.projectIDs {
+		if withinAny(tagged, []string{path}) {
+			delete(f.projectIDs, tagged)
+		}
+	}
+	f.removed[path] = true
+}
+
+// checkExists fails with ENOENT if the canonical path was removed or is
+// below an unmounted mount point. The caller must hold f.mu.
+func (f *FakeBackend) checkExists(path string) error {
+	for dir := range f.removed {
+		if withinAny(path, []string{dir}) {
+			return wrapErrno(&os.PathError{Op: "open", Path: path, Err: unix.ENOENT})
+		}
+	}
+	for dir := range f.unmounted {
+		if _, mounted := f.mounts[dir]; !mounted && isBelow(path, dir) {
+			return wrapErrno(&os.PathError{Op: "open", Path: path, Err: unix.ENOENT})
+		}
+	}
+	return nil
+}
+
+// SetProjectID tags the path and everything below it with the project id,
+// like the recursive retag of the kernel backend
+func (f *FakeBackend) SetProjectID(path string, id uint32) error {
+	return f.SetProjectIDSkipping(context.Background(), path, id, nil)
+}
+
+// SetProjectIDSkipping tags the path and everything below it with the
+// project id, except the directories of skip and other filesystems mounted
+// below the path
+func (f *FakeBackend) SetProjectIDSkipping(ctx context.Context, path string, id uint32, skip []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path = f.canonicalPath(path)
+	if err := f.checkExists(path); err != nil {
+		return err
+	}
+	skipped := f.skipped(path, skip)
+	// The skipped trees keep their ids when their ancestor is retagged
+	for _, dir := range skipped {
+		if _, ok := f.projectIDs[dir]; !ok {
+			f.projectIDs[dir] = f.projectID(dir)
+		}
+	}
+	for tagged := range f.projectIDs {
+		if isBelow(tagged, path) && !withinAny(tagged, skipped) {
+			delete(f.projectIDs, tagged)
+		}
+	}
+	f.projectIDs[path] = id
+	// Keep only the tags differing from what is inherited
+	if _, isRoot := f.mounts[path]; isRoot && id == 0 || !isRoot && f.projectID(filepath.Dir(path)) == id {
+		delete(f.projectIDs, path)
+	}
+	return nil
+}
+
+// ProjectIDs returns the project id of the path and of the paths below it
+// tagged differently from their parent
+func (f *FakeBackend) ProjectIDs(ctx context.Context, path string, skip []string) (map[string]uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path = f.canonicalPath(path)
+	if err := f.checkExists(path); err != nil {
+		return nil, err
+	}
+	skipped := f.skipped(path, skip)
+	ids := map[string]uint32{path: f.projectID(path)}
+	for tagged, id := range f.projectIDs {
+		if isBelow(tagged, path) && !withinAny(tagged, skipped) &&
+			f.projectID(filepath.Dir(tagged)) != id {
+			ids[tagged] = id
+		}
+	}
+	return ids, nil
+}
+
+// projectID returns the id of the nearest tagged ancestor of the canonical
+// path on its filesystem. The caller must hold f.mu.
+func (f *FakeBackend) projectID(path string) uint32 {
+	for p := path; ; p = filepath.Dir(p) {
+		if id, ok := f.projectIDs[p]; ok {
+			return id
+		}
+		if _, ok := f.mounts[p]; ok || p == "/" || p == "." {
+			return 0
+		}
+	}
+}
+
+// skipped returns the canonical paths of skip and the other filesystems
+// mounted below the path. The caller must hold f.mu.
+func (f *FakeBackend) skipped(path string, skip []string) []string {
+	var skipped []string
+	for _, dir := range skip {
+		skipped = append(skipped, f.canonicalPath(dir))
+	}
+	for mountPath, mnt := range f.mounts {
+		if mnt.Main == mnt && isBelow(mountPath, path) {
+			skipped = append(skipped, mountPath)
+		}
+	}
+	return skipped
+}
+
+// GetQuota returns the limits and usage of the project on the mount
+func (f *FakeBackend) GetQuota(mnt *mount.Mount, id uint32) (*DiskQuotaSize, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := checkQuotaOn(mnt); err != nil {
+		return nil, err
+	}
+	quota := *f.dquot(mnt.DeviceNumber, id)
+	return &quota, nil
+}
+
+// SetQuota sets the limits of the project on the mount
+func (f *FakeBackend) SetQuota(mnt *mount.Mount, id uint32, size *DiskQuotaSize) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := checkQuotaOn(mnt); err != nil {
+		return err
+	}
+	dq := f.dquot(mnt.DeviceNumber, id)
+	dq.Quota = size.Quota
+	dq.Inodes = size.Inodes
+	dq.RtQuota = size.RtQuota
+	dq.QuotaSoft, dq.InodesSoft, dq.RtQuotaSoft = size.softLimits()
+	return nil
+}
+
+// checkQuotaOn fails like the quotactl of older kernels on a filesystem not
+// mounted with project quota
+func checkQuotaOn(mnt *mount.Mount) error {
+	if !projectQuotaOn(mnt) {
+		return wrapErrno(fmt.Errorf("quotactl on %s failed: %w", mnt.Path, unix.ENOSYS))
+	}
+	return nil
+}
+
+// ListQuotas returns the projects with limits or usage on the mount
+func (f *FakeBackend) ListQuotas(mnt *mount.Mount) (map[uint32]*DiskQuotaSize, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	quotas := make(map[uint32]*DiskQuotaSize)
+	for id, dq := range f.quotas[mnt.DeviceNumber] {
+		if dq.HasLimits() || dq.QuotaUsed != 0 || dq.InodesUsed != 0 {
+			quota := *dq
+			quotas[id] = &quota
+		}
+	}
+	return quotas, nil
+}
+
+// GetGrace returns the grace times of the mount, 7 days by default like
+// the kernel's
+func (f *FakeBackend) GetGrace(mnt *mount.Mount) (*GraceTimes, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	grace, ok := f.grace[mnt.DeviceNumber]
+	if !ok {
+		week := uint32(7 * 24 * 3600)
+		grace = GraceTimes{Blocks: week, Inodes: week, RtBlocks: week}
+	}
+	return &grace, nil
+}
+
+// SetGrace sets the grace times of the mount
+func (f *FakeBackend) SetGrace(mnt *mount.Mount, grace *GraceTimes) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.grace[mnt.DeviceNumber] = *grace
+	return nil
+}
+
+// Mounts returns the simulated main mounts, sorted by path
+func (f *FakeBackend) Mounts() ([]*mount.Mount, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var mounts []*mount.Mount
+	for _, mnt := range f.mounts {
+		if mnt.Main == mnt {
+			mounts = append(mounts, mnt)
+		}
+	}
+	sort.Slice(mounts, func(i, j int) bool {
+		return mounts[i].Path < mounts[j].Path
+	})
+	return mounts, nil
+}
+
+// SetCapacity simulates the size of the filesystem mounted at path
+func (f *FakeBackend) SetCapacity(path string, bytes, inodes uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	mnt, err := f.findMount(path)
+	if err != nil {
+		return err
+	}
+	f.capacity[mnt.DeviceNumber] = Capacity{Bytes: bytes, Inodes: inodes}
+	return nil
+}
+
+// Capacity returns the simulated size of the filesystem, 0 unless set with
+// SetCapacity, and its free space after the usage of all projects
+func (f *FakeBackend) Capacity(mnt *mount.Mount) (*Capacity, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	capacity := f.capacity[mnt.DeviceNumber]
+	capacity.BytesFree, capacity.InodesFree = capacity.Bytes, capacity.Inodes
+	for _, dq := range f.quotas[mnt.DeviceNumber] {
+		capacity.BytesFree -= min(dq.QuotaUsed, capacity.BytesFree)
+		capacity.InodesFree -= min(dq.InodesUsed, capacity.InodesFree)
+	}
+	return &capacity, nil
+}
+
+// FilesystemUUID returns a UUID derived from the simulated device
+func (f *FakeBackend) FilesystemUUID(mnt *mount.Mount) (string, error) {
+	return fmt.Sprintf("fa4e0000-0000-4000-8000-%012d", uint64(mnt.DeviceNumber)), nil
+}
+
+// Write simulates creating a file of size bytes at path. The usage is
+// charged to the project of the nearest tagged ancestor, and the write fails
+// with EDQUOT if it would exceed the block or inode hard limit.
+func (f *FakeBackend) Write(path string, size uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dq, err := f.projectDquot(path)
+	if err != nil {
+		return err
+	}
+	if dq.Quota > 0 && dq.QuotaUsed+size > dq.Quota {
+		return &os.PathError{Op: "write", Path: path, Err: unix.EDQUOT}
+	}
+	if dq.Inodes > 0 && dq.InodesUsed+1 > dq.Inodes {
+		return &os.PathError{Op: "create", Path: path, Err: unix.EDQUOT}
+	}
+	dq.QuotaUsed += size
+	dq.InodesUsed++
+	return nil
+}
+
+// Remove simulates deleting a file of size bytes at path, releasing its
+// usage from the project of the nearest tagged ancestor
+func (f *FakeBackend) Remove(path string, size uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dq, err := f.projectDquot(path)
+	if err != nil {
+		return err
+	}
+	dq.QuotaUsed -= min(size, dq.QuotaUsed)
+	if dq.InodesUsed > 0 {
+		dq.InodesUsed--
+	}
+	return nil
+}
+
+// ReadFile returns the content of an in-memory project file
+func (f *FakeBackend) ReadFile(name string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, ok := f.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// WriteFile replaces the content of an in-memory project file
+func (f *FakeBackend) WriteFile(name string, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.files[name] = append([]byte(nil), data...)
+	return nil
+}
+
+// RemoveFile removes an in-memory project file
+func (f *FakeBackend) RemoveFile(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.files, name)
+	return nil
+}
+
+// dquot returns the quota record of the project, creating it if needed.
+// The caller must hold f.mu.
+func (f *FakeBackend) dquot(device mount.DeviceNumber, id uint32) *DiskQuotaSize {
+	if f.quotas[device] == nil {
+		f.quotas[device] = make(map[uint32]*DiskQuotaSize)
+	}
+	dq, ok := f.quotas[device][id]
+	if !ok {
+		dq = &DiskQuotaSize{}
+		f.quotas[device][id] = dq
+	}
+	return dq
+}
+
+// canonicalPath returns the path as seen through the main mount of its
+// filesystem, so that bind mounts share project ids. The caller must hold
+// f.mu.
+func (f *FakeBackend) canonicalPath(path string) string {
+	path = filepath.Clean(path)
+	mnt, err := f.findMount(path)
+	if err != nil {
+		return path
+	}
+	return mnt.CanonicalPath(path)
+}
+
+// projectDquot returns the quota record charged for writes to path.
+// The caller must hold f.mu.
+func (f *FakeBackend) projectDquot(path string) (*DiskQuotaSize, error) {
+	path = f.canonicalPath(path)
+	id := f.projectID(path)
+	for p := path; ; p = filepath.Dir(p) {
+		if mnt, ok := f.mounts[p]; ok {
+			return f.dquot(mnt.DeviceNumber, id), nil
+		}
+		if p == "/" || p == "." {
+			return nil, fmt.Errorf("couldn't find mountpoint containing %q", path)
+		}
+	}
+}
@@ -21,37 +21,133 @@ package project
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"xfsquotas/internal/mount"
+
+	"golang.org/x/sys/unix"
 	"k8s.io/klog/v2"
 )
 
 var (
 	tmpPrefix = "."
+	// how often a busy lock is retried
+	lockRetryInterval = 50 * time.Millisecond
 
-	projectsPath = "/etc/projects"
-	projidPath   = "/etc/projid"
+	defaultProjectsPath = "/etc/projects"
+	defaultProjidPath   = "/etc/projid"
 )
 
 // projectFile used to record project quota to file
-type projectFile struct{}
+type projectFile struct {
+	store fileStore
+	// projectid:path records, /etc/projects by default
+	projectsPath string
+	// name:projectid records, /etc/projid by default
+	projidPath string
+}
+
+// locker is implemented by fileStores shared with other processes
+type locker interface {
+	// Lock locks the named lock file until the returned function is
+	// called, waiting for it until ctx is done
+	Lock(ctx context.Context, name string) (func(), error)
+}
+
+// osFileStore keeps the project files on the host filesystem
+type osFileStore struct{}
+
+// ReadFile reads the named file
+func (osFileStore) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+// WriteFile replaces the named file atomically, creating its directory
+func (osFileStore) WriteFile(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return writeByTempFile(name, data)
+}
+
+// RemoveFile removes the named file if it exists
+func (osFileStore) RemoveFile(name string) error {
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Lock takes an exclusive flock(2) on the named lock file, creating it if
+// needed, so that processes sharing the project files don't interleave
+// their updates. A busy lock is retried until ctx is done.
+func (osFileStore) Lock(ctx context.Context, name string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	fd, err := unix.Open(name, unix.O_RDWR|unix.O_CREAT|unix.O_CLOEXEC, 0644)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	for {
+		err := unix.Flock(fd, unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			unix.Close(fd)
+			return nil, &os.PathError{Op: "flock", Path: name, Err: err}
+		}
+		select {
+		case <-ctx.Done():
+			unix.Close(fd)
+			return nil, fmt.Errorf("waiting for lock %s: %w", name, ctx.Err())
+		case <-time.After(lockRetryInterval):
+		}
+	}
+	return func() {
+		unix.Flock(fd, unix.LOCK_UN)
+		unix.Close(fd)
+	}, nil
+}
 
 // NewProjectFile new project file instance
-func NewProjectFile() *projectFile {
-	//if !types.InHostNamespace {
-	//	projectsPath = path.Join(types.RootFS, projectsPath)
-	//	projidPath = path.Join(types.RootFS, projidPath)
-	//}
-	if err := projFilesAreOK(); err != nil {
-		klog.Fatalf("project files are not ok: %v", err)
+func NewProjectFile() (*projectFile, error) {
+	return newProjectFileAt(defaultProjectsPath, defaultProjidPath)
+}
+
+// newProjectFileAt new project file instance recording to the given files,
+// creating them if needed. The instance is returned along with the error if
+// they can't be created.
+func newProjectFileAt(projectsPath, projidPath string) (*projectFile, error) {
+	file := &projectFile{
+		store:        osFileStore{},
+		projectsPath: projectsPath,
+		projidPath:   projidPath,
 	}
+	if err := projFilesAreOK(projectsPath, projidPath); err != nil {
+		return file, fmt.Errorf("project files are not ok: %v", err)
+	}
+	return file, nil
+}
 
-	return &projectFile{}
+// newProjectFileWithStore new project file instance backed by store
+func newProjectFileWithStore(store fileStore, projectsPath, projidPath string) *projectFile {
+	return &projectFile{
+		store:        store,
+		projectsPath: projectsPath,
+		projidPath:   projidPath,
+	}
 }
 
 // DumpProjectIds read project quota record
@@ -89,8 +185,12 @@ func (f *projectFile) DumpProjectIds() (idPaths map[quotaID][]string, idNames ma
 		}
 		idNames[quotaID(id)] = idName
 	}
-	dumpProjectsFile(projectsPath, idPathHandleFunc)
-	dumpProjectsFile(projidPath, idNameHandleFunc)
+	if err := dumpProjectsFile(f.store, f.projectsPath, idPathHandleFunc); err != nil {
+		return nil, nil, err
+	}
+	if err := dumpProjectsFile(f.store, f.projidPath, idNameHandleFunc); err != nil {
+		return nil, nil, err
+	}
 
 	klog.V(2).Infof("dump new project paths: %+v", idPaths)
 	klog.V(2).Infof("dump new project ids: %+v", idNames)
@@ -105,7 +205,7 @@ func (f *projectFile) UpdateProjects(idPaths map[quotaID][]string) error {
 			content += fmt.Sprintf("%d:%s\n", id, path)
 		}
 	}
-	return writeByTempFile(projectsPath, []byte(content))
+	return f.store.WriteFile(f.projectsPath, []byte(content))
 }
 
 // UpdateProjIds save projectid:name to /etc/projid
@@ -114,39 +214,84 @@ func (f *projectFile) UpdateProjIds(idNames map[quotaID]string) error {
 	for id, name := range idNames {
 		content += fmt.Sprintf("%s:%d\n", name, id)
 	}
-	return writeByTempFile(projidPath, []byte(content))
+	return f.store.WriteFile(f.projidPath, []byte(content))
 }
 
-func projFilesAreOK() error {
-	// check if the project files exist and are writable
-	if _, err := os.Stat(projectsPath); os.IsNotExist(err) {
-		if err := os.MkdirAll(filepath.Dir(projectsPath), 0755); err != nil {
-			return fmt.Errorf("failed to create directory for %s: %v", projectsPath, err)
+// readDevices reads the device number of the filesystem of each recorded
+// path from the file, maj:min:path records
+func readDevices(store fileStore, devicesPath string) (map[string]mount.DeviceNumber, error) {
+	devices := make(map[string]mount.DeviceNumber)
+	data, err := store.ReadFile(devicesPath)
+	if os.IsNotExist(err) {
+		return devices, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
 		}
-		if _, err := os.Create(projectsPath); err != nil {
-			return fmt.Errorf("failed to create %s: %v", projectsPath, err)
+		ranges := strings.SplitN(line, ":", 3)
+		if len(ranges) != 3 {
+			klog.Errorf("invalid line in %s: %s", devicesPath, line)
+			continue
 		}
-	}
-	if _, err := os.Stat(projidPath); os.IsNotExist(err) {
-		if err := os.MkdirAll(filepath.Dir(projidPath), 0755); err != nil {
-			return fmt.Errorf("failed to create directory for %s: %v", projidPath, err)
+		major, majorErr := strconv.ParseUint(ranges[0], 10, 32)
+		minor, minorErr := strconv.ParseUint(ranges[1], 10, 32)
+		if majorErr != nil || minorErr != nil {
+			klog.Errorf("invalid device number in %s: %s", devicesPath, line)
+			continue
 		}
-		if _, err := os.Create(projidPath); err != nil {
-			return fmt.Errorf("failed to create %s: %v", projidPath, err)
+		devices[ranges[2]] = mount.DeviceNumber(unix.Mkdev(uint32(major), uint32(minor)))
+	}
+	return devices, nil
+}
+
+// writeDevices saves the device numbers of the recorded paths to the file
+func writeDevices(store fileStore, devicesPath string, devices map[string]mount.DeviceNumber) error {
+	paths := make([]string, 0, len(devices))
+	for path := range devices {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	content := ""
+	for _, path := range paths {
+		content += fmt.Sprintf("%s:%s\n", devices[path], path)
+	}
+	return store.WriteFile(devicesPath, []byte(content))
+}
+
+func projFilesAreOK(paths ...string) error {
+	// check if the project files exist and are writable
+	for _, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return fmt.Errorf("failed to create directory for %s: %v", path, err)
+			}
+			if _, err := os.Create(path); err != nil {
+				return fmt.Errorf("failed to create %s: %v", path, err)
+			}
 		}
 	}
 	return nil
 }
 
-func dumpProjectsFile(filePath string, handle func(ranges []string)) {
-	file, err := os.Open(filePath)
+// dumpProjectsFile passes each record of the file to handle. A missing file
+// has no records, other read errors are returned so that the files are never
+// rewritten from what couldn't be read.
+func dumpProjectsFile(store fileStore, filePath string, handle func(ranges []string)) error {
+	data, err := store.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		klog.Errorf("failed to open %s: %v", filePath, err)
-		return
+		return fmt.Errorf("failed to read %s: %w", filePath, err)
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" || strings.HasPrefix(line, "#") {
@@ -159,6 +304,7 @@ func dumpProjectsFile(filePath string, handle func(ranges []string)) {
 		}
 		handle(ranges)
 	}
+	return scanner.Err()
 }
 
 func writeByTempFile(pathFile string, data []byte) (retErr error) {
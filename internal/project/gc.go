@@ -0,0 +1,166 @@
+package project
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"xfsquotas/internal/mount"
+
+	"k8s.io/klog/v2"
+)
+
+// GC removes the records of paths that no longer exist or were retagged
+// with another project id, e.g. directories deleted without clean. Records
+// of filesystems that aren't mounted are kept. The limits of a project left
+// without paths are cleared. It returns the removed paths.
+func (p *ProjectQuota) GC() ([]string, error) {
+	return p.GCContext(context.Background())
+}
+
+// GCContext is GC, stopping when ctx is done
+func (p *ProjectQuota) GCContext(ctx context.Context) ([]string, error) {
+	return p.newSession().gc(ctx)
+}
+
+// gc removes the stale records. They are found without a lock, then each
+// is checked again and removed under the lock of its project files.
+func (s *session) gc(ctx context.Context) ([]string, error) {
+	if err := s.loadProjectIds(nil); err != nil {
+		return nil, err
+	}
+	devices, err := readDevices(s.store, s.devicesPath)
+	if err != nil {
+		return nil, err
+	}
+	var stale []string
+	for path, projectID := range s.pathIds {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if s.isStale(path, projectID) {
+			stale = append(stale, path)
+		}
+	}
+	sort.Strings(stale)
+
+	var removed []string
+	for _, path := range stale {
+		ok, err := s.gcPath(ctx, path, devices)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed = append(removed, path)
+		}
+	}
+	return removed, nil
+}
+
+// gcPath removes the record of the path if it is still stale and its
+// filesystem is mounted
+func (s *session) gcPath(ctx context.Context, path string, devices map[string]mount.DeviceNumber) (bool, error) {
+	mnt := s.findExistingMount(path)
+	mounted, err := s.recordedMounted(path, mnt, devices)
+	if err != nil || !mounted {
+		return false, err
+	}
+	unlock, err := s.lock(ctx, mnt)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	// A dry run keeps the records planned so far, so that shared
+	// projects are planned right
+	if !s.dryRun {
+		// The registry of the filesystem if it is still mounted, the
+		// global project files otherwise
+		if err := s.loadProjectIds(mnt); err != nil {
+			return false, err
+		}
+	}
+	projectID, exists := s.pathIds[path]
+	if !exists || !s.isStale(path, projectID) {
+		return false, nil
+	}
+
+	var steps []*JournalStep
+	if !s.sharesProjectId(path, projectID) {
+		oldQuota, err := s.backend.GetQuota(mnt, uint32(projectID))
+		if err != nil {
+			return false, err
+		}
+		if oldQuota.HasLimits() {
+			steps = append(steps, &JournalStep{Kind: StepLimit, Path: mnt.Path, ID: uint32(projectID),
+				Old: oldQuota, New: &DiskQuotaSize{}})
+		}
+	}
+	steps = append(steps, &JournalStep{Kind: StepRecord, Path: path, ID: uint32(projectID),
+		Name: s.idNames[projectID]})
+	if err := s.runTransaction(ctx, "gc", path, steps); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// recordedMounted reports whether the filesystem the path was recorded on is
+// mounted at the path. Below the mount point of an unmounted filesystem the
+// paths are missing or on the filesystem mounted above it. The filesystem of
+// a record is that of the registry recording it, or the one persistDevices
+// recorded if known.
+func (s *session) recordedMounted(path string, mnt *mount.Mount, devices map[string]mount.DeviceNumber) (bool, error) {
+	if mnt == nil {
+		return false, nil
+	}
+	if !s.mountRegistry {
+		device, known := devices[path]
+		return !known || device == mnt.DeviceNumber, nil
+	}
+	r, err := s.openRegistry(mnt)
+	if err != nil {
+		return false, err
+	}
+	idPaths, _, err := r.load()
+	if err != nil {
+		return false, err
+	}
+	for _, paths := range idPaths {
+		if slices.Contains(paths, path) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isStale reports whether the recorded path is gone or has another project
+// id. Paths that can't be checked are kept.
+func (p *ProjectQuota) isStale(path string, projectID quotaID) bool {
+	id, err := p.backend.GetProjectID(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true
+	}
+	if err != nil {
+		klog.Errorf("keep project %d of %s: %v", projectID, path, err)
+		return false
+	}
+	return quotaID(id) != projectID
+}
+
+// findExistingMount returns the mount of the path or of its nearest existing
+// ancestor, nil if the filesystem isn't mounted
+func (p *ProjectQuota) findExistingMount(path string) *mount.Mount {
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if mnt, err := p.backend.FindMount(dir); err == nil {
+			if !supportedFilesystems[mnt.FilesystemType] {
+				return nil
+			}
+			return mnt
+		}
+		if dir == "/" || dir == "." {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package project
+
+import (
+	"math"
+	"time"
+)
+
+// Growth is how fast a project consumed its limits between two samples of
+// its usage
+type Growth struct {
+	// negative when usage shrinks
+	BytesPerSecond  float64
+	InodesPerSecond float64
+	// time until a block or inode hard limit is hit at this rate, 0 if no
+	// limit is approached
+	UntilFull time.Duration
+}
+
+// NewGrowth returns the growth of the usage from prev to cur, sampled
+// elapsed apart. The time until full is estimated from cur.
+func NewGrowth(prev, cur *DiskQuotaSize, elapsed time.Duration) *Growth {
+	g := &Growth{}
+	if prev == nil || elapsed <= 0 {
+		return g
+	}
+	seconds := elapsed.Seconds()
+	g.BytesPerSecond = (float64(cur.QuotaUsed) - float64(prev.QuotaUsed)) / seconds
+	g.InodesPerSecond = (float64(cur.InodesUsed) - float64(prev.InodesUsed)) / seconds
+
+	until := math.Inf(1)
+	for _, limit := range []struct {
+		used, hard uint64
+		rate       float64
+	}{
+		{cur.QuotaUsed, cur.Quota, g.BytesPerSecond},
+		{cur.InodesUsed, cur.Inodes, g.InodesPerSecond},
+	} {
+		if limit.hard == 0 || limit.rate <= 0 || limit.used >= limit.hard {
+			continue
+		}
+		until = math.Min(until, float64(limit.hard-limit.used)/limit.rate)
+	}
+	// Far enough to be never, and within time.Duration
+	if until < (100 * 365 * 24 * time.Hour).Seconds() {
+		g.UntilFull = max(time.Duration(until*float64(time.Second)), time.Second)
+	}
+	return g
+}
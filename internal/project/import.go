@@ -0,0 +1,250 @@
+package project
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"xfsquotas/internal/mount"
+)
+
+// ImportSource is where Import finds the projects set up by hand, e.g. with
+// xfs_quota -x -c 'project -s'
+type ImportSource struct {
+	// project files to import, the configured ones if empty
+	ProjectsPath string
+	ProjidPath   string
+	// mount points whose dquots are checked for projects without a
+	// recorded path, besides the filesystems of the imported paths
+	Mounts []string
+}
+
+// ImportResult is the outcome of Import
+type ImportResult struct {
+	// the paths now managed, sorted by path
+	Imported []*QuotaEntry `json:"imported"`
+	// the records that were not imported
+	Skipped []*ImportSkip `json:"skipped,omitempty"`
+	// projects with limits or usage on a filesystem but no recorded path,
+	// their ids are not protected from allocation
+	Unrecorded []*UnrecordedProject `json:"unrecorded,omitempty"`
+}
+
+// ImportSkip is a record Import left alone, and why
+type ImportSkip struct {
+	Path   string `json:"path"`
+	ID     uint32 `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// UnrecordedProject is a dquot of a project without a recorded path
+type UnrecordedProject struct {
+	Mount string         `json:"mount"`
+	ID    uint32         `json:"id"`
+	Size  *DiskQuotaSize `json:"size"`
+}
+
+// Import registers the projects of existing project files as managed, so
+// that get, set and clean work on their paths with their ids. Paths are
+// resolved like any other path and must be tagged with their project id or
+// not at all, untagged trees are tagged. The dquots of the filesystems are
+// listed to report projects without a recorded path.
+func (p *ProjectQuota) Import(source ImportSource) (*ImportResult, error) {
+	return p.ImportContext(context.Background(), source)
+}
+
+// ImportContext is Import, stopping when ctx is done
+func (p *ProjectQuota) ImportContext(ctx context.Context, source ImportSource) (*ImportResult, error) {
+	file := p.prjFile
+	if source.ProjectsPath != "" || source.ProjidPath != "" {
+		// Either file left empty is the configured one
+		projectsPath, projidPath := p.projectsPath, p.projidPath
+		if source.ProjectsPath != "" {
+			projectsPath = source.ProjectsPath
+		}
+		if source.ProjidPath != "" {
+			projidPath = source.ProjidPath
+		}
+		file = newProjectFileWithStore(p.store,
+			mount.HostPath(p.hostRoot, projectsPath), mount.HostPath(p.hostRoot, projidPath))
+	}
+	idPaths, idNames, err := file.DumpProjectIds()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	pathIds := make(map[string]quotaID)
+	for id, recorded := range idPaths {
+		for _, path := range recorded {
+			paths = append(paths, path)
+			pathIds[path] = id
+		}
+	}
+	sort.Strings(paths)
+
+	result := &ImportResult{}
+	// the filesystems to check for unrecorded projects, by device number
+	mounts := make(map[mount.DeviceNumber]*mount.Mount)
+	s := p.newSession()
+	if p.dryRun {
+		// All the records, as the project files of the filesystems
+		// aren't loaded
+		if err := s.loadProjectIds(nil); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		projectID := pathIds[path]
+		entry, err := s.importPath(ctx, path, projectID, idNames[projectID], mounts)
+		if err != nil {
+			result.Skipped = append(result.Skipped, &ImportSkip{Path: path, ID: uint32(projectID), Reason: err.Error()})
+			continue
+		}
+		result.Imported = append(result.Imported, entry)
+	}
+	sort.Slice(result.Imported, func(i, j int) bool {
+		return result.Imported[i].Path < result.Imported[j].Path
+	})
+
+	for _, mountPath := range source.Mounts {
+		mnt, err := p.backend.FindMount(mountPath)
+		if err != nil {
+			return nil, err
+		}
+		if !supportedFilesystems[mnt.FilesystemType] {
+			return nil, unsupportedError(mountPath, mnt)
+		}
+		mounts[mnt.DeviceNumber] = mnt
+	}
+	result.Unrecorded, err = s.findUnrecorded(ctx, mounts)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// importPath registers the path of a project under the lock of the project
+// files of its filesystem. The session keeps the records of a dry run.
+func (s *session) importPath(ctx context.Context, path string, projectID quotaID, name string,
+	mounts map[mount.DeviceNumber]*mount.Mount) (*QuotaEntry, error) {
+	resolved, err := s.ResolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	backingDev, err := s.findAvailableBackingDev(resolved)
+	if err != nil {
+		return nil, err
+	}
+	if !backingDev.supported {
+		return nil, unsupportedError(resolved, backingDev.mount)
+	}
+	mounts[backingDev.mount.DeviceNumber] = backingDev.mount
+
+	tagged, err := s.backend.GetProjectID(resolved)
+	if err != nil {
+		return nil, err
+	}
+	if tagged != 0 && quotaID(tagged) != projectID {
+		return nil, fmt.Errorf("%w: %s is tagged with project %d", ErrConflictingProject, resolved, tagged)
+	}
+
+	unlock, err := s.lock(ctx, backingDev.mount)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	// A dry run keeps the records planned so far
+	if !s.dryRun {
+		if err := s.loadProjectIds(backingDev.mount); err != nil {
+			return nil, err
+		}
+	}
+	if id, exists := s.pathIds[resolved]; exists && id != projectID {
+		return nil, fmt.Errorf("%w: %s is already managed as project %d", ErrConflictingProject, resolved, id)
+	}
+	if current, exists := s.idNames[projectID]; exists && name != "" && current != name {
+		return nil, fmt.Errorf("%w: project %d is already named %s", ErrConflictingProject, projectID, current)
+	}
+	if name == "" {
+		name = s.idNames[projectID]
+	}
+
+	var steps []*JournalStep
+	if _, exists := s.pathIds[resolved]; !exists {
+		steps = append(steps, &JournalStep{Kind: StepRecord, Path: resolved, ID: uint32(projectID),
+			Name: name, Added: true})
+	}
+	if _, exists := s.pathIds[path]; exists && path != resolved {
+		// The resolved path replaces it
+		steps = append(steps, &JournalStep{Kind: StepRecord, Path: path, ID: uint32(projectID), Name: name})
+	}
+	if tagged == 0 {
+		tag, err := s.tagStep(ctx, resolved, uint32(projectID), 0)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, tag)
+	}
+	if len(steps) > 0 {
+		if err := s.runTransaction(ctx, "import", resolved, steps); err != nil {
+			return nil, err
+		}
+	}
+	size, err := s.backend.GetQuota(backingDev.mount, uint32(projectID))
+	if err != nil {
+		return nil, err
+	}
+	return &QuotaEntry{Path: resolved, ID: uint32(projectID), Name: name, Size: size}, nil
+}
+
+// findUnrecorded lists the dquots of the filesystems whose project has
+// limits or usage but no recorded path, if the backend can enumerate them
+func (s *session) findUnrecorded(ctx context.Context, mounts map[mount.DeviceNumber]*mount.Mount) ([]*UnrecordedProject, error) {
+	lister, ok := s.backend.(quotaLister)
+	if !ok || len(mounts) == 0 {
+		return nil, nil
+	}
+	if !s.dryRun {
+		if err := s.loadProjectIds(nil); err != nil {
+			return nil, err
+		}
+	}
+	var unrecorded []*UnrecordedProject
+	for _, mnt := range mounts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		quotas, err := lister.ListQuotas(mnt)
+		if err != nil {
+			return nil, err
+		}
+		recorded := make(map[uint32]bool)
+		for id, paths := range s.idPaths {
+			for _, path := range paths {
+				if pathMnt := s.findExistingMount(path); pathMnt != nil && pathMnt.DeviceNumber == mnt.DeviceNumber {
+					recorded[uint32(id)] = true
+				}
+			}
+		}
+		for id, size := range quotas {
+			// Project 0 accounts everything outside of projects
+			if id == 0 || recorded[id] {
+				continue
+			}
+			if !size.HasLimits() && size.QuotaUsed == 0 && size.InodesUsed == 0 {
+				continue
+			}
+			unrecorded = append(unrecorded, &UnrecordedProject{Mount: mnt.Path, ID: id, Size: size})
+		}
+	}
+	sort.Slice(unrecorded, func(i, j int) bool {
+		if unrecorded[i].Mount != unrecorded[j].Mount {
+			return unrecorded[i].Mount < unrecorded[j].Mount
+		}
+		return unrecorded[i].ID < unrecorded[j].ID
+	})
+	return unrecorded, nil
+}
@@ -0,0 +1,357 @@
+package project
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"xfsquotas/internal/mount"
+
+	"k8s.io/klog/v2"
+)
+
+// Kinds of JournalStep
+const (
+	// StepRecord adds or removes the path of a project in the project files
+	StepRecord = "record"
+	// StepTag sets the project id of a directory tree
+	StepTag = "tag"
+	// StepLimit sets the limits of a project
+	StepLimit = "limit"
+)
+
+// JournalStep is a side effect of an operation, with what is needed to
+// redo or undo it. Every step can be repeated.
+type JournalStep struct {
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+	ID   uint32 `json:"id"`
+	// StepRecord: the name of the project, and whether the path is added
+	// or removed
+	Name  string `json:"name,omitempty"`
+	Added bool   `json:"added,omitempty"`
+	// StepTag: the project id before the step, the trees of other
+	// projects below the path left alone, and the ids before the step of
+	// the directories below the path tagged differently from their parent
+	OldID  uint32            `json:"oldID,omitempty"`
+	Skip   []string          `json:"skip,omitempty"`
+	OldIDs map[string]uint32 `json:"oldIDs,omitempty"`
+	// StepLimit: the limits before and after the step
+	Old *DiskQuotaSize `json:"old,omitempty"`
+	New *DiskQuotaSize `json:"new,omitempty"`
+}
+
+// Journal records the steps of an operation before any is made. It is
+// removed when the operation finishes or is rolled back, one left behind
+// means the operation was interrupted and needs Recover. The journal file
+// keeps one Journal per lock, as operations on different filesystems run
+// concurrently.
+type Journal struct {
+	Op    string         `json:"op"`
+	Path  string         `json:"path"`
+	Steps []*JournalStep `json:"steps"`
+	// the lock the operation runs under
+	Lock string `json:"lock,omitempty"`
+}
+
+// runTransaction journals the steps of the operation on the path, then
+// makes them in order. If a step fails, the steps made so far are undone.
+// The caller must hold the lock of the project files. A dry run only records
+// the plan of the steps. When ctx is done the running step fails and the
+// steps made are undone regardless of ctx.
+func (s *session) runTransaction(ctx context.Context, op, path string, steps []*JournalStep) error {
+	if err := s.checkJournal(); err != nil {
+		return err
+	}
+	if s.dryRun {
+		s.addPlan(op, path, steps)
+		return nil
+	}
+	scope := s.scope()
+	if err := s.writeJournal(&Journal{Op: op, Path: path, Steps: steps, Lock: scope}); err != nil {
+		return err
+	}
+	if done, err := s.doSteps(ctx, op, path, steps); err != nil {
+		if undoErr := s.undoSteps(context.WithoutCancel(ctx), steps[:done]); undoErr != nil {
+			klog.Errorf("failed to roll back the %s of %s, run xfsquota recover: %v", op, path, undoErr)
+			return err
+		}
+		if removeErr := s.removeJournal(scope); removeErr != nil {
+			klog.Errorf("failed to remove journal %s: %v", s.journalPath, removeErr)
+		}
+		return err
+	}
+	return s.removeJournal(scope)
+}
+
+// doSteps makes the steps of the operation in order. If one fails, it is
+// undone and the number of steps made before it is returned, for the caller
+// to undo them.
+func (s *session) doSteps(ctx context.Context, op, path string, steps []*JournalStep) (int, error) {
+	for i, step := range steps {
+		if err := s.doStep(ctx, step); err != nil {
+			klog.Errorf("%s of %s failed at step %s, rolling back: %v", op, path, step.Kind, err)
+			// The failed step may be partly made, e.g. a tree partly
+			// retagged, but undoing it may fail the same way
+			if undoErr := s.undoStep(context.WithoutCancel(ctx), step); undoErr != nil {
+				klog.V(2).Infof("failed to undo the failed step %s of %s: %v", step.Kind, path, undoErr)
+			}
+			return i, err
+		}
+	}
+	return len(steps), nil
+}
+
+// doStep makes the step
+func (s *session) doStep(ctx context.Context, step *JournalStep) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	switch step.Kind {
+	case StepRecord:
+		if step.Added {
+			s.addProjectId(step.Path, quotaID(step.ID), step.Name)
+			if s.deferRecords {
+				return nil
+			}
+			return s.persistProjectIds()
+		}
+		return s.removeProjectId(step.Path, !s.deferRecords)
+	case StepTag:
+		return s.setProjectID(ctx, step.Path, quotaID(step.ID), step.Skip)
+	case StepLimit:
+		mnt, err := s.backend.FindMount(step.Path)
+		if err != nil {
+			return err
+		}
+		return s.backend.SetQuota(mnt, step.ID, step.New)
+	}
+	return fmt.Errorf("unknown journal step %q", step.Kind)
+}
+
+// undoStep reverts the step, whether or not it was made
+func (s *session) undoStep(ctx context.Context, step *JournalStep) error {
+	switch step.Kind {
+	case StepRecord:
+		if step.Added {
+			return s.removeProjectId(step.Path, !s.deferRecords)
+		}
+		s.addProjectId(step.Path, quotaID(step.ID), step.Name)
+		if s.deferRecords {
+			return nil
+		}
+		return s.persistProjectIds()
+	case StepTag:
+		return s.untag(ctx, step)
+	case StepLimit:
+		mnt, err := s.backend.FindMount(step.Path)
+		if err != nil {
+			return err
+		}
+		return s.backend.SetQuota(mnt, step.ID, step.Old)
+	}
+	return fmt.Errorf("unknown journal step %q", step.Kind)
+}
+
+// untag gives the tree of the tag step its ids back
+func (s *session) untag(ctx context.Context, step *JournalStep) error {
+	for _, untag := range untagSteps(step) {
+		if err := s.setProjectID(ctx, untag.Path, quotaID(untag.ID), untag.Skip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// untagSteps returns the tag steps undoing the tag step: the path gets its
+// old id back, then each subtree tagged differently from its parent its own
+func untagSteps(step *JournalStep) []*JournalStep {
+	subtrees := make([]string, 0, len(step.OldIDs))
+	for dir := range step.OldIDs {
+		subtrees = append(subtrees, dir)
+	}
+	sort.Strings(subtrees)
+	steps := []*JournalStep{{Kind: StepTag, Path: step.Path, ID: step.OldID, OldID: step.ID,
+		Skip: append(append([]string{}, subtrees...), step.Skip...)}}
+	for i, dir := range subtrees {
+		// The other subtrees are retagged on their own
+		others := append(append(append([]string{}, subtrees[:i]...), subtrees[i+1:]...), step.Skip...)
+		steps = append(steps, &JournalStep{Kind: StepTag, Path: dir, ID: step.OldIDs[dir], OldID: step.ID,
+			Skip: others})
+	}
+	return steps
+}
+
+// undoSteps reverts the steps, most recent first
+func (s *session) undoSteps(ctx context.Context, steps []*JournalStep) error {
+	for i := len(steps) - 1; i >= 0; i-- {
+		if err := s.undoStep(ctx, steps[i]); err != nil {
+			return fmt.Errorf("failed to undo step %s of %s: %v", steps[i].Kind, steps[i].Path, err)
+		}
+	}
+	return nil
+}
+
+// checkJournal fails if an interrupted operation on the loaded project files
+// hasn't been recovered. Operations journaled under the global lock, like
+// batches on several filesystems, may have changed any of them and block
+// every operation.
+func (s *session) checkJournal() error {
+	journals, err := s.readJournals()
+	if err != nil {
+		return err
+	}
+	scope := s.scope()
+	for _, pending := range journals {
+		if pending.Lock == scope || pending.Lock == s.globalLock() {
+			return fmt.Errorf("the %s of %s was interrupted, run xfsquota recover first", pending.Op, pending.Path)
+		}
+	}
+	return nil
+}
+
+// readJournals returns the journals of the interrupted or running operations
+func (p *ProjectQuota) readJournals() ([]*Journal, error) {
+	data, err := p.store.ReadFile(p.journalPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var journals []*Journal
+	if err := json.Unmarshal(data, &journals); err != nil {
+		return nil, fmt.Errorf("invalid journal %s: %v", p.journalPath, err)
+	}
+	return journals, nil
+}
+
+// writeJournal adds the journal of an operation, replacing the previous one
+// of its project files
+func (s *session) writeJournal(journal *Journal) error {
+	return s.updateJournals(journal.Lock, journal)
+}
+
+// removeJournal removes the journal of the operation on the project files of
+// the lock
+func (s *session) removeJournal(lock string) error {
+	return s.updateJournals(lock, nil)
+}
+
+// updateJournals replaces the journal of the project files of the lock with
+// journal, removing it if journal is nil
+func (s *session) updateJournals(lock string, journal *Journal) error {
+	unlock, err := s.lockGlobal()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	journals, err := s.readJournals()
+	if err != nil {
+		return err
+	}
+	kept := journals[:0]
+	for _, j := range journals {
+		if j.Lock != lock {
+			kept = append(kept, j)
+		}
+	}
+	if journal != nil {
+		kept = append(kept, journal)
+	}
+	if len(kept) == 0 {
+		return s.store.RemoveFile(s.journalPath)
+	}
+	data, err := json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	return s.store.WriteFile(s.journalPath, data)
+}
+
+// Recover finishes the operations interrupted by a crash, or rolls them
+// back, using their journals. Steps are safe to repeat, so all of them are
+// redone or undone whether or not they had been made. It returns the
+// journals, none if nothing was interrupted. A dry run plans the redone or
+// undone steps and keeps the journals.
+func (p *ProjectQuota) Recover(rollback bool) ([]*Journal, error) {
+	return p.RecoverContext(context.Background(), rollback)
+}
+
+// RecoverContext is Recover, stopping when ctx is done. A journal is kept
+// until its recovery completes, so it can be run again.
+func (p *ProjectQuota) RecoverContext(ctx context.Context, rollback bool) ([]*Journal, error) {
+	journals, err := p.readJournals()
+	if err != nil {
+		return nil, err
+	}
+	var recovered []*Journal
+	for _, journal := range journals {
+		// Each operation is recovered under the lock of its project files
+		ok, err := p.newSession().recoverJournal(ctx, journal, rollback)
+		if err != nil {
+			return recovered, err
+		}
+		if ok {
+			recovered = append(recovered, journal)
+		}
+	}
+	return recovered, nil
+}
+
+// recoverJournal redoes or undoes the steps of the journal, unless it was
+// recovered meanwhile
+func (s *session) recoverJournal(ctx context.Context, journal *Journal, rollback bool) (bool, error) {
+	mnt, err := s.backend.FindMount(journal.Path)
+	if err != nil {
+		return false, err
+	}
+	mnts := []*mount.Mount{mnt}
+	if journal.Lock == s.globalLock() {
+		// e.g. a batch on several filesystems
+		mnts = append(mnts, nil)
+	}
+	unlock, err := s.lock(ctx, mnts...)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	if err := s.loadProjectIds(mnt); err != nil {
+		return false, err
+	}
+	current, err := s.readJournals()
+	if err != nil {
+		return false, err
+	}
+	pending := false
+	for _, j := range current {
+		pending = pending || j.Lock == journal.Lock
+	}
+	if !pending {
+		return false, nil
+	}
+
+	if s.dryRun {
+		if rollback {
+			s.addPlan("rollback", journal.Path, invertSteps(journal.Steps))
+		} else {
+			s.addPlan("recover", journal.Path, journal.Steps)
+		}
+		return true, nil
+	}
+	if rollback {
+		if err := s.undoSteps(ctx, journal.Steps); err != nil {
+			return true, err
+		}
+	} else {
+		for _, step := range journal.Steps {
+			if err := s.doStep(ctx, step); err != nil {
+				return true, fmt.Errorf("failed to redo step %s of %s: %v", step.Kind, step.Path, err)
+			}
+		}
+	}
+	return true, s.removeJournal(journal.Lock)
+}
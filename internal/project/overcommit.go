@@ -0,0 +1,153 @@
+package project
+
+import (
+	"fmt"
+
+	"xfsquotas/internal/mount"
+
+	"github.com/docker/go-units"
+	"k8s.io/klog/v2"
+)
+
+// OverCommitMode is what setting a quota does when the block hard limits of
+// the projects of a filesystem would exceed its capacity by more than the
+// allowed ratio
+type OverCommitMode string
+
+const (
+	// OverCommitAllow sets any limit, the default
+	OverCommitAllow OverCommitMode = "allow"
+	// OverCommitWarn sets the limit and logs a warning
+	OverCommitWarn OverCommitMode = "warn"
+	// OverCommitReject fails with ErrOverCommitted
+	OverCommitReject OverCommitMode = "reject"
+)
+
+// OverCommitPolicy admits the block hard limits set on a filesystem. The
+// sum of the hard limits of its projects, recorded or with a dquot, is
+// compared with its capacity. Lowering a limit is always admitted.
+type OverCommitPolicy struct {
+	Mode OverCommitMode `json:"mode" yaml:"mode"`
+	// the sum of the hard limits may reach Ratio times the capacity, 1 if
+	// 0, e.g. 1.5 allows promising 50% more than there is
+	Ratio float64 `json:"ratio" yaml:"ratio"`
+}
+
+// WithOverCommitPolicy checks the hard limits set by SetQuota, ApplyBatch
+// and Restore against the capacity of their filesystem
+func WithOverCommitPolicy(policy OverCommitPolicy) Option {
+	return func(p *ProjectQuota) {
+		p.overCommit = policy
+	}
+}
+
+// check validates the policy
+func (policy *OverCommitPolicy) check() error {
+	switch policy.Mode {
+	case "", OverCommitAllow, OverCommitWarn, OverCommitReject:
+	default:
+		return fmt.Errorf("unknown over-commit mode %q, expected allow, warn or reject", policy.Mode)
+	}
+	if policy.Ratio < 0 {
+		return fmt.Errorf("invalid over-commit ratio %v", policy.Ratio)
+	}
+	return nil
+}
+
+// commitment is the block hard limits of the projects of a filesystem
+// against its capacity
+type commitment struct {
+	mount    *mount.Mount
+	capacity uint64
+	// project id => block hard limit
+	limits map[quotaID]uint64
+}
+
+// total returns the sum of the hard limits
+func (c *commitment) total() uint64 {
+	var total uint64
+	for _, limit := range c.limits {
+		total += limit
+	}
+	return total
+}
+
+// newCommitment returns the hard limits of the projects of the filesystem
+// from the loaded records and its dquots, nil if the policy doesn't check
+// them or the capacity of the filesystem is unknown
+func (s *session) newCommitment(mnt *mount.Mount) (*commitment, error) {
+	if err := s.overCommit.check(); err != nil {
+		return nil, err
+	}
+	if s.overCommit.Mode == "" || s.overCommit.Mode == OverCommitAllow {
+		return nil, nil
+	}
+	lister, ok := s.backend.(filesystemLister)
+	if !ok {
+		return nil, nil
+	}
+	capacity, err := lister.Capacity(mnt)
+	if err != nil {
+		return nil, err
+	}
+	if capacity.Bytes == 0 {
+		return nil, nil
+	}
+	c := &commitment{mount: mnt, capacity: capacity.Bytes, limits: make(map[quotaID]uint64)}
+	if quotaLister, ok := s.backend.(quotaLister); ok {
+		quotas, err := quotaLister.ListQuotas(mnt)
+		if err != nil {
+			return nil, err
+		}
+		for id, size := range quotas {
+			c.limits[quotaID(id)] = size.Quota
+		}
+	}
+	for id, paths := range s.idPaths {
+		if _, ok := c.limits[id]; ok {
+			continue
+		}
+		for _, path := range paths {
+			if pathMnt := s.findExistingMount(path); pathMnt != nil && pathMnt.DeviceNumber == mnt.DeviceNumber {
+				size, err := s.backend.GetQuota(mnt, uint32(id))
+				if err != nil {
+					return nil, err
+				}
+				c.limits[id] = size.Quota
+				break
+			}
+		}
+	}
+	// Project 0 accounts everything outside of projects
+	delete(c.limits, noQuotaID)
+	return c, nil
+}
+
+// admit checks the block hard limit of the project of the path against the
+// policy, and counts it if admitted. A nil commitment admits anything.
+func (s *session) admit(c *commitment, path string, projectID quotaID, limit uint64) error {
+	if c == nil {
+		return nil
+	}
+	old := c.limits[projectID]
+	ratio := s.overCommit.Ratio
+	if ratio == 0 {
+		ratio = 1
+	}
+	total := c.total() - old + limit
+	if limit <= old || float64(total) <= ratio*float64(c.capacity) {
+		c.limits[projectID] = limit
+		return nil
+	}
+	err := fmt.Errorf("%w: a hard limit of %s for %s brings the hard limits of the projects on %s "+
+		"from %s to %s, %.0f%% of its %s capacity, over the allowed %.0f%%",
+		ErrOverCommitted, units.BytesSize(float64(limit)), path, c.mount.Path,
+		units.BytesSize(float64(c.total())), units.BytesSize(float64(total)),
+		float64(total)*100/float64(c.capacity), units.BytesSize(float64(c.capacity)), ratio*100)
+	if s.overCommit.Mode == OverCommitReject {
+		return err
+	}
+	klog.Warningf("%v", err)
+	c.limits[projectID] = limit
+	return nil
+}
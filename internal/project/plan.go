@@ -0,0 +1,114 @@
+package project
+
+import (
+	"fmt"
+
+	"k8s.io/klog/v2"
+)
+
+// Plan is what an operation would change. With WithDryRun operations make
+// no change and record their Plan instead.
+type Plan struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// the project id allocated for the path, 0 if none is
+	NewID uint32 `json:"newID,omitempty"`
+	// directories retagged and limits changed, in the order they would be
+	Steps []*JournalStep `json:"steps"`
+	// lines added to and removed from the project files
+	ProjectsAdded   []string `json:"projectsAdded,omitempty"`
+	ProjectsRemoved []string `json:"projectsRemoved,omitempty"`
+	ProjidAdded     []string `json:"projidAdded,omitempty"`
+	ProjidRemoved   []string `json:"projidRemoved,omitempty"`
+}
+
+// WithDryRun makes operations report what they would change instead of
+// changing it, see Plans
+func WithDryRun() Option {
+	return func(p *ProjectQuota) {
+		p.dryRun = true
+	}
+}
+
+// DryRun reports whether operations only record their Plan
+func (p *ProjectQuota) DryRun() bool {
+	return p.dryRun
+}
+
+// Plans returns the plans recorded since the last call, in order
+func (p *ProjectQuota) Plans() []*Plan {
+	p.plansMu.Lock()
+	defer p.plansMu.Unlock()
+	plans := p.plans
+	p.plans = nil
+	return plans
+}
+
+// addPlan records the steps of a dry run operation. Records are applied to
+// the loaded project ids, never persisted, so that later plans of the same
+// run see them.
+func (s *session) addPlan(op, path string, steps []*JournalStep) {
+	plan := &Plan{Op: op, Path: path, Steps: steps}
+	for _, step := range steps {
+		if step.Kind != StepRecord {
+			continue
+		}
+		id := quotaID(step.ID)
+		projectsLine := fmt.Sprintf("%d:%s", id, step.Path)
+		shared := s.sharesProjectId(step.Path, id)
+		if step.Added {
+			plan.ProjectsAdded = append(plan.ProjectsAdded, projectsLine)
+			if !shared {
+				plan.NewID = step.ID
+				if step.Name != "" {
+					plan.ProjidAdded = append(plan.ProjidAdded, fmt.Sprintf("%s:%d", step.Name, id))
+				}
+			}
+			s.addProjectId(step.Path, id, step.Name)
+			continue
+		}
+		if _, exists := s.pathIds[step.Path]; !exists {
+			continue
+		}
+		plan.ProjectsRemoved = append(plan.ProjectsRemoved, projectsLine)
+		if name, exists := s.idNames[id]; exists && !shared {
+			plan.ProjidRemoved = append(plan.ProjidRemoved, fmt.Sprintf("%s:%d", name, id))
+		}
+		if err := s.removeProjectId(step.Path, !persistToFile); err != nil {
+			klog.Errorf("failed to plan the removal of %s: %v", step.Path, err)
+		}
+	}
+	s.plansMu.Lock()
+	s.plans = append(s.plans, plan)
+	s.plansMu.Unlock()
+}
+
+// sharesProjectId reports whether paths other than the given one have the
+// project id
+func (s *session) sharesProjectId(targetPath string, id quotaID) bool {
+	for _, path := range s.idPaths[id] {
+		if path != targetPath {
+			return true
+		}
+	}
+	return false
+}
+
+// invertSteps returns the steps undoing the given ones, most recent first
+func invertSteps(steps []*JournalStep) []*JournalStep {
+	inverted := make([]*JournalStep, 0, len(steps))
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := *steps[i]
+		switch step.Kind {
+		case StepRecord:
+			step.Added = !step.Added
+		case StepTag:
+			inverted = append(inverted, untagSteps(&step)...)
+			continue
+		case StepLimit:
+			step.Old, step.New = step.New, step.Old
+		}
+		inverted = append(inverted, &step)
+	}
+	return inverted
+}
@@ -0,0 +1,126 @@
+package project
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Pool is a range of project ids reserved for one consumer, e.g.
+// containers, ci or tenants. Projects allocated from a pool are named
+// <Name>-<id>.
+type Pool struct {
+	Name  string `json:"name" yaml:"name"`
+	First uint32 `json:"firstID" yaml:"firstID"`
+	Count int    `json:"count" yaml:"count"`
+}
+
+// PoolUsage is the occupancy of a Pool
+type PoolUsage struct {
+	Pool
+	Used int `json:"used"`
+}
+
+// contains reports whether the id is in the pool
+func (pool *Pool) contains(id quotaID) bool {
+	return id >= quotaID(pool.First) && int64(id) < int64(pool.First)+int64(pool.Count)
+}
+
+// last returns the last id of the pool
+func (pool *Pool) last() int64 {
+	return int64(pool.First) + int64(pool.Count) - 1
+}
+
+// WithPools adds named pools next to the default one. A project allocated
+// with SetQuotaInPool gets an id from the pool of that name.
+func WithPools(pools ...Pool) Option {
+	return func(p *ProjectQuota) {
+		p.pools = append(p.pools, pools...)
+	}
+}
+
+// checkPools validates the pools, they must have distinct names and
+// non-overlapping ranges
+func (p *ProjectQuota) checkPools() error {
+	sorted := make([]Pool, len(p.pools))
+	copy(sorted, p.pools)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].First < sorted[j].First
+	})
+	names := make(map[string]bool)
+	for i, pool := range sorted {
+		if pool.Name == "" {
+			return fmt.Errorf("pool of ids [%d, %d] has no name", pool.First, pool.last())
+		}
+		if names[pool.Name] {
+			return fmt.Errorf("duplicate pool %s", pool.Name)
+		}
+		names[pool.Name] = true
+		if pool.First == 0 || pool.Count <= 0 || pool.last() > math.MaxInt32 {
+			return fmt.Errorf("invalid id range of pool %s: first id %d, count %d", pool.Name, pool.First, pool.Count)
+		}
+		if i > 0 && sorted[i-1].last() >= int64(pool.First) {
+			return fmt.Errorf("pools %s and %s overlap", sorted[i-1].Name, pool.Name)
+		}
+	}
+	return nil
+}
+
+// findPool returns the pool of the given name, the default pool if name is
+// empty
+func (p *ProjectQuota) findPool(name string) (*Pool, error) {
+	if name == "" {
+		return &p.pools[0], nil
+	}
+	for i := range p.pools {
+		if p.pools[i].Name == name {
+			return &p.pools[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown pool %s", name)
+}
+
+// poolOf returns the pool containing the id, nil if there is none
+func (p *ProjectQuota) poolOf(id quotaID) *Pool {
+	for i := range p.pools {
+		if p.pools[i].contains(id) {
+			return &p.pools[i]
+		}
+	}
+	return nil
+}
+
+// PoolUsage returns the occupancy of every pool, counting the ids recorded
+// in the project files
+func (p *ProjectQuota) PoolUsage() ([]*PoolUsage, error) {
+	return p.newSession().poolUsage()
+}
+
+// poolUsage counts the ids of the pools
+func (s *session) poolUsage() ([]*PoolUsage, error) {
+	if err := s.checkPools(); err != nil {
+		return nil, err
+	}
+	if err := s.loadProjectIds(nil); err != nil {
+		return nil, err
+	}
+	usage := make([]*PoolUsage, 0, len(s.pools))
+	for _, pool := range s.pools {
+		usage = append(usage, &PoolUsage{Pool: pool})
+	}
+	used := make(map[quotaID]bool)
+	for id := range s.idPaths {
+		used[id] = true
+	}
+	for id := range s.idNames {
+		used[id] = true
+	}
+	for id := range used {
+		for _, u := range usage {
+			if u.contains(id) {
+				u.Used++
+			}
+		}
+	}
+	return usage, nil
+}
@@ -55,18 +55,39 @@ struct fsxattr {
 #ifndef Q_XGETPQUOTA
 #define Q_XGETPQUOTA QCMD(Q_XGETQUOTA, PRJQUOTA)
 #endif
+#ifndef Q_XGETNEXTQUOTA
+#define Q_XGETNEXTQUOTA XQM_CMD(9)
+#endif
+#ifndef Q_XGETNEXTPQUOTA
+#define Q_XGETNEXTPQUOTA QCMD(Q_XGETNEXTQUOTA, PRJQUOTA)
+#endif
 
 const int Q_XGETQSTAT_PRJQUOTA = QCMD(Q_XGETQSTAT, PRJQUOTA);
+const unsigned int Q_GETPQUOTA = QCMD(Q_GETQUOTA, PRJQUOTA);
+const unsigned int Q_SETPQUOTA = QCMD(Q_SETQUOTA, PRJQUOTA);
+const unsigned int Q_GETNEXTPQUOTA = QCMD(Q_GETNEXTQUOTA, PRJQUOTA);
+const unsigned int Q_GETPINFO = QCMD(Q_GETINFO, PRJQUOTA);
+const unsigned int Q_SETPINFO = QCMD(Q_SETINFO, PRJQUOTA);
 */
 import "C"
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/fs"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"unsafe"
 
 	"xfsquotas/internal/mount"
 
 	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
 )
 
 // DiskQuotaSize group disk quota size
@@ -75,23 +96,67 @@ type DiskQuotaSize struct {
 	Inodes     uint64 `json:"inodes"`
 	QuotaUsed  uint64 `json:"-"`
 	InodesUsed uint64 `json:"-"`
+	// blocks on the XFS realtime subvolume
+	RtQuota     uint64 `json:"rtQuota"`
+	RtQuotaUsed uint64 `json:"-"`
+	// soft limits, usage may exceed them for the grace time of the
+	// filesystem. 0 sets them to the hard limits.
+	QuotaSoft   uint64 `json:"quotaSoft,omitempty"`
+	InodesSoft  uint64 `json:"inodesSoft,omitempty"`
+	RtQuotaSoft uint64 `json:"rtQuotaSoft,omitempty"`
+}
+
+// HasLimits reports whether any limit is set, a project without limits only
+// accounts usage
+func (d *DiskQuotaSize) HasLimits() bool {
+	return d.Quota != 0 || d.Inodes != 0 || d.RtQuota != 0 ||
+		d.QuotaSoft != 0 || d.InodesSoft != 0 || d.RtQuotaSoft != 0
+}
+
+// softLimits returns the soft limits to set, the hard ones where unset
+func (d *DiskQuotaSize) softLimits() (quota, inodes, rtQuota uint64) {
+	quota, inodes, rtQuota = d.QuotaSoft, d.InodesSoft, d.RtQuotaSoft
+	if quota == 0 {
+		quota = d.Quota
+	}
+	if inodes == 0 {
+		inodes = d.Inodes
+	}
+	if rtQuota == 0 {
+		rtQuota = d.RtQuota
+	}
+	return quota, inodes, rtQuota
+}
+
+// QuotaEntry describes a managed path and its project quota
+type QuotaEntry struct {
+	Path string         `json:"path"`
+	ID   uint32         `json:"id"`
+	Name string         `json:"name"`
+	Size *DiskQuotaSize `json:"size"`
 }
 
 const (
 	noQuotaID    quotaID = 0
 	firstQuotaID quotaID = 1048577
 	// Don't go into an infinite loop searching for an unused quota id
-	maxSearch        = 256
-	idNameSeprator   = "-"
-	quotaMountOption = "prjquota"
+	maxSearch          = 256
+	idNameSeprator     = "-"
+	quotaMountOption   = "prjquota"
+	defaultProjectName = "xfsquota"
 )
+
+// supportedFilesystems are the filesystem types with project quota support
+var supportedFilesystems = map[string]bool{
+	"xfs":  true,
+	"ext4": true,
+}
+
 const (
 	projIdNoCreate = true
 	persistToFile  = true
 )
 
-var NotSupported = errors.New("not suppported")
-
 // quotaID is generic quota identifier.
 // Data type based on quotactl(2).
 type quotaID int32
@@ -106,103 +171,570 @@ func (q quotaID) IdName(projectName string) string {
 	return fmt.Sprintf("%s%s%d", projectName, idNameSeprator, q)
 }
 
-// ProjectQuota is the struct of project quota
+// ProjectQuota is the struct of project quota. It is safe for concurrent
+// use: operations on the same filesystem are serialized, those on different
+// filesystems run in parallel.
 type ProjectQuota struct {
-	// path => device
-	pathMapBackingDev map[string]*backingDev
-	// id => id with path flag
-	idNames map[quotaID]string
-	// id => path
-	idPaths map[quotaID][]string
-	// path => id
-	pathIds map[string]quotaID
 	// store project quota to file
-	nameIds map[string]quotaID
 	prjFile *projectFile
+	// why the project files couldn't be created, returned when they are
+	// loaded
+	prjFileErr error
+	backend    Backend
+	// store of the project files and registries
+	store fileStore
+	// locks of the project files held by the sessions of the process
+	locks lockTable
+	// keep a registry per filesystem, at the mount root or under
+	// registryDir keyed by the filesystem UUID
+	mountRegistry bool
+	registryDir   string
+	// files the projects are recorded to
+	projectsPath string
+	projidPath   string
+	// journals of the running operations
+	journalPath string
+	// filesystems of the paths of the project files, see persistDevices
+	devicesPath string
+	// the host's root directory, e.g. /host in a container
+	hostRoot string
+	// pools project ids are allocated from, the first one is the default
+	pools []Pool
+	// admission of the hard limits against the capacity
+	overCommit OverCommitPolicy
+	// record the plans of operations instead of making them
+	dryRun  bool
+	plansMu sync.Mutex
+	plans   []*Plan
 }
 
 type backingDev struct {
 	supported bool
 	device    string
+	mount     *mount.Mount
+}
+
+// Option configures a ProjectQuota
+type Option func(*ProjectQuota)
+
+// WithBackend replaces the kernel backend, e.g. with a FakeBackend in tests
+func WithBackend(backend Backend) Option {
+	return func(p *ProjectQuota) {
+		p.backend = backend
+	}
+}
+
+// WithProjectFiles records the projects to the given files instead of
+// /etc/projects and /etc/projid
+func WithProjectFiles(projectsPath, projidPath string) Option {
+	return func(p *ProjectQuota) {
+		p.projectsPath = projectsPath
+		p.projidPath = projidPath
+	}
+}
+
+// WithHostRoot manages the quotas of the host whose root directory is
+// mounted at root, e.g. from a privileged container. Paths are as seen by
+// the host and resolved under root, and the host's project files and
+// mountinfo of its init process are used.
+func WithHostRoot(root string) Option {
+	return func(p *ProjectQuota) {
+		p.hostRoot = root
+	}
+}
+
+// WithMountRegistry records the projects of each filesystem in a hidden
+// directory at its mount root, with paths relative to the filesystem, so the
+// registry moves with the disk. /etc/projects and /etc/projid are generated
+// from the registries for compatibility with xfs_quota.
+func WithMountRegistry() Option {
+	return func(p *ProjectQuota) {
+		p.mountRegistry = true
+	}
+}
+
+// WithRegistryDir is like WithMountRegistry but keeps the registries in the
+// state directory dir, under the UUID of each filesystem
+func WithRegistryDir(dir string) Option {
+	return func(p *ProjectQuota) {
+		p.mountRegistry = true
+		p.registryDir = dir
+	}
+}
+
+// WithIDRange allocates project ids of the default pool from
+// [first, first+count) instead of the default range
+func WithIDRange(first uint32, count int) Option {
+	return func(p *ProjectQuota) {
+		p.pools[0].First = first
+		p.pools[0].Count = count
+	}
 }
 
 // NewProjectQuota creates a new ProjectQuota
-func NewProjectQuota() *ProjectQuota {
-	return &ProjectQuota{
-		pathMapBackingDev: make(map[string]*backingDev),
-		idNames:           make(map[quotaID]string),
-		idPaths:           make(map[quotaID][]string),
-		pathIds:           make(map[string]quotaID),
-		nameIds:           make(map[string]quotaID),
-		prjFile:           NewProjectFile(),
+func NewProjectQuota(opts ...Option) *ProjectQuota {
+	p := &ProjectQuota{
+		projectsPath: defaultProjectsPath,
+		projidPath:   defaultProjidPath,
+		hostRoot:     "/",
+		pools: []Pool{{
+			Name:  defaultProjectName,
+			First: uint32(firstQuotaID),
+			Count: maxSearch,
+		}},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.backend == nil {
+		p.backend = newKernelBackend(p.hostRoot)
+	}
+	projectsPath := mount.HostPath(p.hostRoot, p.projectsPath)
+	projidPath := mount.HostPath(p.hostRoot, p.projidPath)
+	p.journalPath = projectsPath + ".journal"
+	p.devicesPath = projectsPath + ".devices"
+	// A backend keeping its own project files doesn't touch /etc
+	if store, ok := p.backend.(fileStore); ok {
+		p.store = store
+		p.prjFile = newProjectFileWithStore(store, projectsPath, projidPath)
+	} else {
+		p.store = osFileStore{}
+		p.prjFile, p.prjFileErr = newProjectFileAt(projectsPath, projidPath)
+	}
+	return p
+}
+
+// ResolvePath returns the path the project quota of the given path is
+// applied to. Paths on an overlay mount map to its upper directory on the
+// backing filesystem, paths under a bind mount map to the same directory
+// under the main mount, so that the project files record one canonical path
+// however the directory is reached.
+func (p *ProjectQuota) ResolvePath(targetPath string) (string, error) {
+	targetPath, err := p.absPath(targetPath)
+	if err != nil {
+		return "", err
+	}
+	mnt, err := p.backend.FindMount(targetPath)
+	if err != nil {
+		return "", err
 	}
+	if mnt.FilesystemType != "overlay" {
+		canonicalPath := mnt.CanonicalPath(targetPath)
+		if canonicalPath != targetPath {
+			klog.V(2).Infof("resolve bind mount path %s to %s", targetPath, canonicalPath)
+		}
+		return canonicalPath, nil
+	}
+	if mnt.UpperDir == "" {
+		return "", fmt.Errorf("overlay mount %s of %s has no upper dir", mnt.Path, targetPath)
+	}
+	rel, err := filepath.Rel(mnt.Path, targetPath)
+	if err != nil {
+		return "", err
+	}
+	upperPath := filepath.Join(mnt.UpperDir, rel)
+	klog.V(2).Infof("resolve overlay path %s to upper dir %s", targetPath, upperPath)
+	// A path only in a lower layer has no upper directory until written to
+	if _, err := p.backend.GetProjectID(upperPath); errors.Is(err, ErrPathNotFound) {
+		if _, err := p.backend.GetProjectID(targetPath); !errors.Is(err, ErrPathNotFound) {
+			return "", fmt.Errorf("%w: %s exists only in a lower layer of overlay %s, not copied up to %s",
+				ErrPathNotFound, targetPath, mnt.Path, upperPath)
+		}
+	}
+	// The upper dir may itself be reached through a bind mount
+	return p.ResolvePath(upperPath)
+}
+
+// absPath returns the absolute path on the host of the path. A relative
+// path is relative to the working directory, which must be under the host's
+// root.
+func (p *ProjectQuota) absPath(targetPath string) (string, error) {
+	if filepath.IsAbs(targetPath) {
+		return filepath.Clean(targetPath), nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	hostWd, err := filepath.Rel(p.hostRoot, wd)
+	if err != nil || hostWd == ".." || strings.HasPrefix(hostWd, "../") {
+		return "", fmt.Errorf("relative path %s: working directory %s is not under the host's root %s",
+			targetPath, wd, p.hostRoot)
+	}
+	return filepath.Join("/", hostWd, targetPath), nil
 }
 
 // GetQuota returns the quota for the given path
 func (p *ProjectQuota) GetQuota(targetPath string) (*DiskQuotaSize, error) {
+	return p.GetQuotaContext(context.Background(), targetPath)
+}
+
+// GetQuotaContext is GetQuota, failing if ctx is done
+func (p *ProjectQuota) GetQuotaContext(ctx context.Context, targetPath string) (*DiskQuotaSize, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	targetPath, err := p.ResolvePath(targetPath)
+	if err != nil {
+		return nil, err
+	}
 	backingDev, err := p.findAvailableBackingDev(targetPath)
 	if err != nil {
 		return nil, err
 	}
 	if !backingDev.supported {
-		return nil, NotSupported
+		return nil, unsupportedError(targetPath, backingDev.mount)
+	}
+	projectID, err := p.backend.GetProjectID(targetPath)
+	if err != nil {
+		return nil, err
 	}
-	projectID, err := getProjectID(targetPath)
+	return p.backend.GetQuota(backingDev.mount, projectID)
+}
+
+// GetQuotaByID returns the quota of the project id on the filesystem of the
+// mount path, e.g. an id from xfs_quota report
+func (p *ProjectQuota) GetQuotaByID(mountPath string, id uint32) (*DiskQuotaSize, error) {
+	return p.GetQuotaByIDContext(context.Background(), mountPath, id)
+}
+
+// GetQuotaByIDContext is GetQuotaByID, failing if ctx is done
+func (p *ProjectQuota) GetQuotaByIDContext(ctx context.Context, mountPath string, id uint32) (*DiskQuotaSize, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mountPath, err := p.ResolvePath(mountPath)
 	if err != nil {
 		return nil, err
 	}
-	return getProjectQuota(backingDev.device, projectID)
+	backingDev, err := p.findAvailableBackingDev(mountPath)
+	if err != nil {
+		return nil, err
+	}
+	if !backingDev.supported {
+		return nil, unsupportedError(mountPath, backingDev.mount)
+	}
+	return p.backend.GetQuota(backingDev.mount, id)
+}
+
+// GetQuotaByName returns the quota of the project with the name in the
+// project files, e.g. a name from /etc/projid. The project must have paths
+// on a single mounted filesystem.
+func (p *ProjectQuota) GetQuotaByName(name string) (*DiskQuotaSize, error) {
+	return p.GetQuotaByNameContext(context.Background(), name)
+}
+
+// GetQuotaByNameContext is GetQuotaByName, failing if ctx is done
+func (p *ProjectQuota) GetQuotaByNameContext(ctx context.Context, name string) (*DiskQuotaSize, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return p.newSession().getQuotaByName(name)
+}
+
+// getQuotaByName finds the filesystem of the named project from its paths
+func (s *session) getQuotaByName(name string) (*DiskQuotaSize, error) {
+	if err := s.loadProjectIds(nil); err != nil {
+		return nil, err
+	}
+	projectID, exists := s.nameIds[name]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrProjectNotFound, name)
+	}
+	var mnt *mount.Mount
+	for _, path := range s.idPaths[projectID] {
+		pathMnt := s.findExistingMount(path)
+		if pathMnt == nil {
+			continue
+		}
+		if mnt != nil && mnt.DeviceNumber != pathMnt.DeviceNumber {
+			return nil, fmt.Errorf("project %s has paths on %s and %s, get it by id and mount",
+				name, mnt.Path, pathMnt.Path)
+		}
+		mnt = pathMnt
+	}
+	if mnt == nil {
+		return nil, fmt.Errorf("%w: no mounted filesystem has the paths of project %s", ErrProjectNotFound, name)
+	}
+	return s.backend.GetQuota(mnt, uint32(projectID))
 }
 
 // SetQuota sets the quota for the given path
 func (p *ProjectQuota) SetQuota(targetPath string, size *DiskQuotaSize) error {
-	backingDev, err := p.findOrCreateBackingDev(targetPath)
+	return p.SetQuotaInPoolContext(context.Background(), targetPath, size, "")
+}
+
+// SetQuotaContext is SetQuota, waiting for the lock and retagging the tree
+// until ctx is done
+func (p *ProjectQuota) SetQuotaContext(ctx context.Context, targetPath string, size *DiskQuotaSize) error {
+	return p.SetQuotaInPoolContext(ctx, targetPath, size, "")
+}
+
+// SetQuotaInPool sets the quota for the given path, allocating its project
+// id from the named pool if it has none yet. An empty name is the default
+// pool.
+func (p *ProjectQuota) SetQuotaInPool(targetPath string, size *DiskQuotaSize, poolName string) error {
+	return p.SetQuotaInPoolContext(context.Background(), targetPath, size, poolName)
+}
+
+// SetQuotaInPoolContext is SetQuotaInPool, waiting for the lock and
+// retagging the tree until ctx is done. A cancelled set is rolled back.
+func (p *ProjectQuota) SetQuotaInPoolContext(ctx context.Context, targetPath string, size *DiskQuotaSize, poolName string) error {
+	return p.newSession().setQuotaInPool(ctx, targetPath, size, poolName)
+}
+
+// setQuotaInPool sets the quota of the spec
+func (s *session) setQuotaInPool(ctx context.Context, targetPath string, size *DiskQuotaSize, poolName string) error {
+	spec, err := s.prepareSpec(&QuotaSpec{Path: targetPath, Size: size, Pool: poolName})
 	if err != nil {
 		return err
 	}
-	if !backingDev.supported {
-		return NotSupported
+	unlock, err := s.lock(ctx, spec.mount)
+	if err != nil {
+		return err
 	}
-	projectID, _, err := p.findOrCreateProjectId(targetPath, projIdNoCreate, persistToFile)
+	defer unlock()
+
+	if err := s.loadProjectIds(spec.mount); err != nil {
+		return err
+	}
+	if err := s.checkJournal(); err != nil {
+		return err
+	}
+	projectID, isNewId, err := s.findOrCreateProjectId(spec.path, spec.pool, !projIdNoCreate, !persistToFile)
+	if err != nil {
+		return err
+	}
+	if err := s.setWithProjectId(ctx, spec, projectID, isNewId); err != nil {
+		if isNewId {
+			s.releaseProjectId(spec.path)
+		}
+		return err
+	}
+	return nil
+}
+
+// setWithProjectId sets the quota of the spec with the project id
+func (s *session) setWithProjectId(ctx context.Context, spec *preparedSpec, projectID quotaID, isNewId bool) error {
+	commitment, err := s.newCommitment(spec.mount)
 	if err != nil {
 		return err
 	}
-	return setProjectQuota(backingDev.device, projectID, size)
+	if err := s.admit(commitment, spec.path, projectID, spec.size.Quota); err != nil {
+		return err
+	}
+	steps, err := s.setSteps(ctx, spec, projectID, isNewId)
+	if err != nil {
+		return err
+	}
+	return s.runTransaction(ctx, "set", spec.path, steps)
+}
+
+// setSteps returns the steps setting the quota of the spec with the project
+// id, recording it first if it is new
+func (s *session) setSteps(ctx context.Context, spec *preparedSpec, projectID quotaID, isNewId bool) ([]*JournalStep, error) {
+	oldID, err := s.backend.GetProjectID(spec.path)
+	if err != nil {
+		return nil, err
+	}
+	oldQuota, err := s.backend.GetQuota(spec.mount, uint32(projectID))
+	if err != nil {
+		return nil, err
+	}
+	var steps []*JournalStep
+	if isNewId {
+		steps = append(steps, &JournalStep{Kind: StepRecord, Path: spec.path, ID: uint32(projectID),
+			Name: s.idNames[projectID], Added: true})
+	}
+	tag, err := s.tagStep(ctx, spec.path, uint32(projectID), oldID)
+	if err != nil {
+		return nil, err
+	}
+	return append(steps, tag,
+		&JournalStep{Kind: StepLimit, Path: spec.path, ID: uint32(projectID), Old: oldQuota, New: spec.size}), nil
+}
+
+// prepareSpec resolves the path of the spec and checks that its quota can
+// be set
+func (p *ProjectQuota) prepareSpec(spec *QuotaSpec) (*preparedSpec, error) {
+	if err := p.checkPools(); err != nil {
+		return nil, err
+	}
+	pool, err := p.findPool(spec.Pool)
+	if err != nil {
+		return nil, err
+	}
+	size := spec.Size
+	if size == nil {
+		size = &DiskQuotaSize{}
+	}
+	targetPath, err := p.ResolvePath(spec.Path)
+	if err != nil {
+		return nil, err
+	}
+	backingDev, err := p.findOrCreateBackingDev(targetPath)
+	if err != nil {
+		return nil, err
+	}
+	if !backingDev.supported {
+		return nil, unsupportedError(targetPath, backingDev.mount)
+	}
+	if size.RtQuota > 0 && backingDev.mount.FilesystemType != "xfs" {
+		return nil, fmt.Errorf("realtime quota is only supported on xfs, %s is on %s",
+			targetPath, backingDev.mount.FilesystemType)
+	}
+	if size.HasLimits() && hasMountOption(backingDev.mount, "pqnoenforce") {
+		return nil, fmt.Errorf("%w: %s is mounted with pqnoenforce, use track to only account usage",
+			ErrNotEnforced, backingDev.mount.Path)
+	}
+	return &preparedSpec{
+		path:  targetPath,
+		mount: backingDev.mount,
+		pool:  pool,
+		size:  size,
+	}, nil
+}
+
+// TrackQuota assigns and persists a project id for the given path without
+// any limit, so that its usage is accounted but never enforced
+func (p *ProjectQuota) TrackQuota(targetPath string) error {
+	return p.TrackQuotaContext(context.Background(), targetPath)
+}
+
+// TrackQuotaContext is TrackQuota, see SetQuotaContext
+func (p *ProjectQuota) TrackQuotaContext(ctx context.Context, targetPath string) error {
+	return p.SetQuotaContext(ctx, targetPath, &DiskQuotaSize{})
+}
+
+// ListQuotas returns the quota of every path recorded in the project files
+func (p *ProjectQuota) ListQuotas() ([]*QuotaEntry, error) {
+	return p.ListQuotasContext(context.Background())
+}
+
+// ListQuotasContext is ListQuotas, stopping when ctx is done
+func (p *ProjectQuota) ListQuotasContext(ctx context.Context) ([]*QuotaEntry, error) {
+	return p.newSession().listQuotas(ctx)
+}
+
+// listQuotas lists the quotas
+func (s *session) listQuotas(ctx context.Context) ([]*QuotaEntry, error) {
+	if err := s.loadProjectIds(nil); err != nil {
+		return nil, err
+	}
+	entries := make([]*QuotaEntry, 0, len(s.pathIds))
+	for path, projectID := range s.pathIds {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		backingDev, err := s.findAvailableBackingDev(path)
+		if err != nil {
+			klog.Errorf("skip project %d of %s: %v", projectID, path, err)
+			continue
+		}
+		size, err := s.backend.GetQuota(backingDev.mount, uint32(projectID))
+		if err != nil {
+			klog.Errorf("skip project %d of %s: %v", projectID, path, err)
+			continue
+		}
+		entries = append(entries, &QuotaEntry{
+			Path: path,
+			ID:   uint32(projectID),
+			Name: s.idNames[projectID],
+			Size: size,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries, nil
 }
 
 // ClearQuota clears the quota for the given path
 func (p *ProjectQuota) ClearQuota(targetPath string) error {
-	backingDev, err := p.findAvailableBackingDev(targetPath)
+	return p.ClearQuotaContext(context.Background(), targetPath)
+}
+
+// ClearQuotaContext is ClearQuota, waiting for the lock and untagging the
+// tree until ctx is done. A cancelled clear is rolled back.
+func (p *ProjectQuota) ClearQuotaContext(ctx context.Context, targetPath string) error {
+	return p.newSession().clearQuota(ctx, targetPath)
+}
+
+// clearQuota clears the quota of the path
+func (s *session) clearQuota(ctx context.Context, targetPath string) error {
+	targetPath, err := s.ResolvePath(targetPath)
+	if err != nil {
+		return err
+	}
+	backingDev, err := s.findAvailableBackingDev(targetPath)
 	if err != nil {
 		return err
 	}
 	if !backingDev.supported {
-		return NotSupported
+		return unsupportedError(targetPath, backingDev.mount)
+	}
+	unlock, err := s.lock(ctx, backingDev.mount)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.loadProjectIds(backingDev.mount); err != nil {
+		return err
+	}
+	projectID, err := s.backend.GetProjectID(targetPath)
+	if err != nil {
+		return err
 	}
-	projectID, err := getProjectID(targetPath)
+	oldQuota, err := s.backend.GetQuota(backingDev.mount, projectID)
 	if err != nil {
 		return err
 	}
 	// Clear the quota
-	return setProjectQuota(backingDev.device, projectID, &DiskQuotaSize{
-		Quota:  0,
-		Inodes: 0,
-	})
+	steps := []*JournalStep{{Kind: StepLimit, Path: targetPath, ID: projectID,
+		Old: oldQuota, New: &DiskQuotaSize{}}}
+	if managedID, exists := s.pathIds[targetPath]; exists {
+		// Release the project id of a managed path
+		tag, err := s.tagStep(ctx, targetPath, uint32(noQuotaID), projectID)
+		if err != nil {
+			return err
+		}
+		steps = append(steps, tag,
+			&JournalStep{Kind: StepRecord, Path: targetPath, ID: uint32(managedID), Name: s.idNames[managedID]})
+	}
+	return s.runTransaction(ctx, "clean", targetPath, steps)
 }
 
 // findAvailableBackingDev find available backing device for the path
 func (p *ProjectQuota) findAvailableBackingDev(targetPath string) (*backingDev, error) {
-	mount, err := mount.FindMount(targetPath)
+	mount, err := p.backend.FindMount(targetPath)
 	if err != nil {
 		return nil, err
 	}
 	backingDev := &backingDev{
-		supported: mount.FilesystemType == "xfs",
+		supported: supportedFilesystems[mount.FilesystemType],
 		device:    mount.Device,
+		mount:     mount,
 	}
 	return backingDev, nil
 }
 
+// unsupportedError returns the error of a path on a filesystem without
+// project quota support
+func unsupportedError(targetPath string, mnt *mount.Mount) error {
+	return fmt.Errorf("%w: %s is on %s", ErrNotXFS, targetPath, mnt.FilesystemType)
+}
+
+// hasMountOption reports whether the filesystem of the mount has the option
+func hasMountOption(mnt *mount.Mount, option string) bool {
+	for _, opt := range strings.Split(mnt.Options, ",") {
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
+
 // findOrCreateBackingDev find or create backing device for the path
 func (p *ProjectQuota) findOrCreateBackingDev(targetPath string) (*backingDev, error) {
 	backingDev, err := p.findAvailableBackingDev(targetPath)
@@ -210,117 +742,671 @@ func (p *ProjectQuota) findOrCreateBackingDev(targetPath string) (*backingDev, e
 		return nil, err
 	}
 	if !backingDev.supported {
-		return nil, NotSupported
+		return nil, unsupportedError(targetPath, backingDev.mount)
 	}
 	return backingDev, nil
 }
 
 // findOrCreateSharedProjectId check if the path already has an shared project id, creating if not.
-func (p *ProjectQuota) findOrCreateSharedProjectId(targetPath, projName string) (quotaID, bool, error) {
+func (s *session) findOrCreateSharedProjectId(targetPath, projName string) (quotaID, bool, error) {
 	isNewId := false
-	projectID, exists := p.nameIds[projName]
+	projectID, exists := s.nameIds[projName]
 	if !exists {
-		projectID = p.allocateProjectID(targetPath)
-		p.nameIds[projName] = projectID
-		p.idNames[projectID] = projName
+		var err error
+		projectID, err = s.allocateProjectID(&s.pools[0])
+		if err != nil {
+			return noQuotaID, false, err
+		}
+		s.nameIds[projName] = projectID
+		s.idNames[projectID] = projName
 		isNewId = true
 	}
 	return projectID, isNewId, nil
 }
 
-// bindProjectId bind project id to the path
-func (p *ProjectQuota) bindProjectId(targetPath string, projectId quotaID) (bool, error) {
-	// Check if the path already has a project id
-	existingProjectID, err := getProjectID(targetPath)
+// setProjectID tags the tree with the project id, stopping when ctx is done
+// if the backend supports it. The directories of skip are left alone if the
+// backend can skip them.
+func (p *ProjectQuota) setProjectID(ctx context.Context, targetPath string, projectId quotaID, skip []string) error {
+	if tagger, ok := p.backend.(treeTagger); ok {
+		return tagger.SetProjectIDSkipping(ctx, targetPath, uint32(projectId), skip)
+	}
+	if tagger, ok := p.backend.(contextTagger); ok {
+		return tagger.SetProjectIDContext(ctx, targetPath, uint32(projectId))
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return p.backend.SetProjectID(targetPath, uint32(projectId))
+}
+
+// tagStep returns the step tagging the tree of the path with the project
+// id. The trees of the other projects recorded below the path are left
+// alone, and the ids of the subtrees tagged differently from their parent
+// are kept so that the step can be undone subtree by subtree.
+func (s *session) tagStep(ctx context.Context, path string, id, oldID uint32) (*JournalStep, error) {
+	step := &JournalStep{Kind: StepTag, Path: path, ID: id, OldID: oldID, Skip: s.nestedProjects(path, quotaID(id))}
+	tagger, ok := s.backend.(treeTagger)
+	if !ok {
+		return step, nil
+	}
+	ids, err := tagger.ProjectIDs(ctx, path, step.Skip)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	if existingProjectID == projectId {
-		return false, nil
+	delete(ids, path)
+	if len(ids) > 0 {
+		step.OldIDs = ids
 	}
-	// Set the project id
-	if err := setProjectID(targetPath, projectId); err != nil {
-		return false, err
+	return step, nil
+}
+
+// nestedProjects returns the recorded paths below the path of projects other
+// than the project id, sorted
+func (s *session) nestedProjects(path string, projectID quotaID) []string {
+	var nested []string
+	for recorded, recordedID := range s.pathIds {
+		if isBelow(recorded, path) && recordedID != projectID {
+			nested = append(nested, recorded)
+		}
 	}
-	return true, nil
+	sort.Strings(nested)
+	return nested
+}
+
+// isBelow reports whether the path is strictly below the directory
+func isBelow(path, dir string) bool {
+	return path != dir && (dir == "/" || strings.HasPrefix(path, dir+"/"))
 }
 
-// findOrCreateProjectId find or create project id for the path
-func (p *ProjectQuota) findOrCreateProjectId(targetPath string,
+// withinAny reports whether the path is one of the directories or below one
+func withinAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || isBelow(path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// findOrCreateProjectId find or create project id for the path, new ids are
+// allocated from the pool
+func (s *session) findOrCreateProjectId(targetPath string, pool *Pool,
 	noCreate bool, persist bool) (quotaID, bool, error) {
 	isNewId := false
-	projectID, exists := p.pathIds[targetPath]
+	projectID, exists := s.pathIds[targetPath]
+	if exists && pool != &s.pools[0] && !pool.contains(projectID) {
+		return noQuotaID, false, fmt.Errorf("%w: %s already has project id %d outside of pool %s",
+			ErrConflictingProject, targetPath, projectID, pool.Name)
+	}
 	if !exists {
 		if noCreate {
 			return noQuotaID, false, fmt.Errorf("project id not found for path %s", targetPath)
 		}
-		projectID = p.allocateProjectID(targetPath)
-		p.pathIds[targetPath] = projectID
-		p.idPaths[projectID] = append(p.idPaths[projectID], targetPath)
+		if s.reservesIds() {
+			// Operations on other filesystems allocate from the same
+			// files, the id is recorded right away so they don't take it
+			unlock, err := s.lockGlobal()
+			if err != nil {
+				return noQuotaID, false, err
+			}
+			defer unlock()
+			if err := s.refreshProjectIds(); err != nil {
+				return noQuotaID, false, err
+			}
+			persist = true
+		}
+		var err error
+		projectID, err = s.allocateProjectID(pool)
+		if err != nil {
+			return noQuotaID, false, err
+		}
+		s.pathIds[targetPath] = projectID
+		s.idPaths[projectID] = append(s.idPaths[projectID], targetPath)
+		projName := projectID.IdName(pool.Name)
+		s.idNames[projectID] = projName
+		s.nameIds[projName] = projectID
 		isNewId = true
 	}
+	if isNewId && persist {
+		if err := s.persistProjectIds(); err != nil {
+			return noQuotaID, false, err
+		}
+	}
 	return projectID, isNewId, nil
 }
 
-// allocateProjectID allocate a new project id
-func (p *ProjectQuota) allocateProjectID(targetPath string) quotaID {
-	// Simple allocation strategy: start from firstQuotaID and find an unused one
-	for i := firstQuotaID; i < firstQuotaID+maxSearch; i++ {
-		// Check if this ID is already used
-		used := false
-		for _, paths := range p.idPaths {
-			for _, path := range paths {
-				if path == targetPath {
-					used = true
-					break
-				}
+// addProjectId record the project id and name of the path
+func (s *session) addProjectId(targetPath string, projectID quotaID, projName string) {
+	if _, exists := s.pathIds[targetPath]; exists {
+		return
+	}
+	s.pathIds[targetPath] = projectID
+	s.idPaths[projectID] = append(s.idPaths[projectID], targetPath)
+	if projName != "" {
+		s.idNames[projectID] = projName
+		s.nameIds[projName] = projectID
+	}
+}
+
+// removeProjectId forget the project id of the path
+func (s *session) removeProjectId(targetPath string, persist bool) error {
+	projectID, exists := s.pathIds[targetPath]
+	if !exists {
+		return nil
+	}
+	delete(s.pathIds, targetPath)
+	paths := s.idPaths[projectID][:0]
+	for _, path := range s.idPaths[projectID] {
+		if path != targetPath {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		delete(s.idPaths, projectID)
+		delete(s.nameIds, s.idNames[projectID])
+		delete(s.idNames, projectID)
+	} else {
+		s.idPaths[projectID] = paths
+	}
+	if persist {
+		return s.persistProjectIds()
+	}
+	return nil
+}
+
+// allocateProjectID allocate a new project id from the pool
+func (s *session) allocateProjectID(pool *Pool) (quotaID, error) {
+	// Simple allocation strategy: start from the first id of the pool and
+	// find an unused one
+	for n := int64(pool.First); n <= pool.last(); n++ {
+		i := quotaID(n)
+		if _, used := s.idPaths[i]; used {
+			continue
+		}
+		if _, used := s.idNames[i]; used {
+			continue
+		}
+		return i, nil
+	}
+	return noQuotaID, fmt.Errorf("%w in pool %s [%d, %d]", ErrIDExhausted, pool.Name, pool.First, pool.last())
+}
+
+// loadProjectIds reload the project ids recorded in the registry of the
+// filesystem of mnt, or in the global project files if there are no
+// registries or mnt is nil
+func (s *session) loadProjectIds(mnt *mount.Mount) error {
+	if s.prjFileErr != nil {
+		return s.prjFileErr
+	}
+	var idPaths map[quotaID][]string
+	var idNames map[quotaID]string
+	var err error
+	s.registry, s.loadedPaths, s.loadedNames = nil, nil, nil
+	s.lockName = s.globalLock()
+	if s.mountRegistry && mnt != nil {
+		if s.registry, err = s.openRegistry(mnt); err != nil {
+			return err
+		}
+		s.lockName = s.registry.lockName()
+		idPaths, idNames, err = s.registry.load()
+	} else {
+		if mnt != nil {
+			s.lockName = s.filesystemLock(mnt)
+		}
+		idPaths, idNames, err = s.prjFile.DumpProjectIds()
+		s.loadedPaths, s.loadedNames = copyIdPaths(idPaths), copyIdNames(idNames)
+	}
+	if err != nil {
+		return err
+	}
+	s.idPaths = make(map[quotaID][]string)
+	s.idNames = make(map[quotaID]string)
+	s.pathIds = make(map[string]quotaID)
+	s.nameIds = make(map[string]quotaID)
+	s.setProjectIds(idPaths, idNames)
+	return nil
+}
+
+// setProjectIds replaces the loaded project ids. The maps are kept, as
+// batch groups share them.
+func (s *session) setProjectIds(idPaths map[quotaID][]string, idNames map[quotaID]string) {
+	clear(s.idPaths)
+	clear(s.idNames)
+	clear(s.pathIds)
+	clear(s.nameIds)
+	for id, paths := range idPaths {
+		s.idPaths[id] = paths
+		for _, path := range paths {
+			s.pathIds[path] = id
+		}
+	}
+	for id, name := range idNames {
+		s.idNames[id] = name
+		s.nameIds[name] = id
+	}
+}
+
+// persistProjectIds save the project ids to the registry they were loaded
+// from and the global project files
+func (s *session) persistProjectIds() error {
+	if s.registry != nil {
+		// The global project files are shared with the other registries
+		unlock, err := s.lockGlobal()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		return s.registry.persist(s.prjFile, s.idPaths, s.idNames)
+	}
+	// Operations on other filesystems update the files meanwhile
+	unlock, err := s.lockGlobal()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	_, _, idPaths, idNames, err := s.mergeProjectIds()
+	if err != nil {
+		return err
+	}
+	if err := s.prjFile.UpdateProjects(idPaths); err != nil {
+		return err
+	}
+	if err := s.prjFile.UpdateProjIds(idNames); err != nil {
+		return err
+	}
+	if err := s.persistDevices(idPaths); err != nil {
+		return err
+	}
+	s.loadedPaths, s.loadedNames = copyIdPaths(idPaths), copyIdNames(idNames)
+	s.setProjectIds(idPaths, idNames)
+	return nil
+}
+
+// persistDevices records the device number of the filesystem of each path
+// of the project files, so that gc can tell the paths of an unmounted
+// filesystem from removed ones. A path is looked up when it is first
+// recorded, those not found stay unknown. The caller holds the global lock.
+func (s *session) persistDevices(idPaths map[quotaID][]string) error {
+	recorded, err := readDevices(s.store, s.devicesPath)
+	if err != nil {
+		return err
+	}
+	devices := make(map[string]mount.DeviceNumber)
+	for _, paths := range idPaths {
+		for _, path := range paths {
+			if device, ok := recorded[path]; ok {
+				devices[path] = device
+				continue
+			}
+			if _, err := s.backend.GetProjectID(path); err != nil {
+				continue
+			}
+			if mnt, err := s.backend.FindMount(path); err == nil {
+				devices[path] = mnt.DeviceNumber
+			}
+		}
+	}
+	if maps.Equal(devices, recorded) {
+		return nil
+	}
+	return writeDevices(s.store, s.devicesPath, devices)
+}
+
+// reservesIds reports whether new ids are recorded as soon as they are
+// allocated, as the loaded project files are shared with the operations on
+// other filesystems. A batch records them all at once instead.
+func (s *session) reservesIds() bool {
+	return s.registry == nil && !s.dryRun && !s.deferRecords
+}
+
+// releaseProjectId forgets the id reserved for the path by an operation
+// that failed before its transaction recorded it
+func (s *session) releaseProjectId(targetPath string) {
+	if !s.reservesIds() {
+		return
+	}
+	if err := s.removeProjectId(targetPath, persistToFile); err != nil {
+		klog.Errorf("failed to release the project id of %s: %v", targetPath, err)
+	}
+}
+
+// refreshProjectIds rereads the global project files, keeping the changes of
+// the session, so that ids recorded meanwhile for other filesystems are seen.
+// The caller holds the global lock.
+func (s *session) refreshProjectIds() error {
+	readPaths, readNames, idPaths, idNames, err := s.mergeProjectIds()
+	if err != nil {
+		return err
+	}
+	s.loadedPaths, s.loadedNames = readPaths, readNames
+	s.setProjectIds(idPaths, idNames)
+	return nil
+}
+
+// mergeProjectIds reads the global project files and applies to them the
+// records the session added and removed since they were last read. It
+// returns the files as read and merged, and fails if an id the session
+// added was recorded meanwhile for another path. The caller holds the
+// global lock.
+func (s *session) mergeProjectIds() (map[quotaID][]string, map[quotaID]string,
+	map[quotaID][]string, map[quotaID]string, error) {
+	readPaths, readNames, err := s.prjFile.DumpProjectIds()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	idPaths, idNames := copyIdPaths(readPaths), copyIdNames(readNames)
+	loaded := make(map[string]quotaID)
+	for id, paths := range s.loadedPaths {
+		for _, path := range paths {
+			loaded[path] = id
+		}
+	}
+	read := make(map[string]quotaID)
+	for id, paths := range readPaths {
+		for _, path := range paths {
+			read[path] = id
+		}
+	}
+	for path, id := range loaded {
+		if current, kept := s.pathIds[path]; !kept || current != id {
+			idPaths[id] = removePath(idPaths[id], path)
+		}
+	}
+	for path, id := range s.pathIds {
+		if loadedID, kept := loaded[path]; kept && loadedID == id {
+			continue
+		}
+		for _, other := range readPaths[id] {
+			if _, known := loaded[other]; !known && s.pathIds[other] != id {
+				return nil, nil, nil, nil, fmt.Errorf("%w: project id %d was recorded for %s meanwhile, retry",
+					ErrConflictingProject, id, other)
 			}
-			if used {
-				break
+		}
+		if readID, exists := read[path]; exists {
+			idPaths[readID] = removePath(idPaths[readID], path)
+		}
+		idPaths[id] = append(idPaths[id], path)
+	}
+	for id, paths := range idPaths {
+		if len(paths) == 0 {
+			delete(idPaths, id)
+		}
+	}
+	for id, name := range s.loadedNames {
+		if _, kept := s.idNames[id]; !kept && idNames[id] == name {
+			if _, used := idPaths[id]; !used {
+				delete(idNames, id)
 			}
 		}
-		if !used {
-			return i
+	}
+	for id, name := range s.idNames {
+		if s.loadedNames[id] != name {
+			idNames[id] = name
 		}
 	}
-	// If we can't find an unused ID, just return the next one
-	return firstQuotaID + maxSearch
+	return readPaths, readNames, idPaths, idNames, nil
 }
 
-func getProjectQuota(backingFsBlockDev string, projectID quotaID) (*DiskQuotaSize, error) {
-	var dqblk C.struct_fs_disk_quota
-	var cs = C.CString(backingFsBlockDev)
-	defer C.free(unsafe.Pointer(cs))
+// quotaTarget is the filesystem a quotactl command is issued on, either
+// through its block device or quotactl_fd(2) on an fd of its mount point
+type quotaTarget struct {
+	device    string
+	mountPath string
+	mountFd   int
+}
 
-	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, C.Q_XGETPQUOTA,
-		uintptr(unsafe.Pointer(cs)), uintptr(projectID),
-		uintptr(unsafe.Pointer(&dqblk)), 0, 0)
+// quotactl issue the quota command for the project on the target
+func (t *quotaTarget) quotactl(cmd uintptr, projectID quotaID, addr unsafe.Pointer) error {
+	if t.device != "" {
+		var cs = C.CString(t.device)
+		defer C.free(unsafe.Pointer(cs))
+
+		_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, cmd,
+			uintptr(unsafe.Pointer(cs)), uintptr(projectID), uintptr(addr), 0, 0)
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL_FD, uintptr(t.mountFd), cmd,
+		uintptr(projectID), uintptr(addr), 0, 0)
 	if errno != 0 {
-		return nil, fmt.Errorf("failed to get quota for project %d: %v", projectID, errno)
+		return errno
+	}
+	return nil
+}
+
+// hasQuotactlFd probes once whether the kernel has quotactl_fd(2). It is
+// called on an invalid fd, which fails with EBADF when the call exists, so
+// ENOSYS from the quota command itself isn't taken for a missing call.
+var hasQuotactlFd = sync.OnceValue(func() bool {
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL_FD, ^uintptr(0), 0, 0, 0, 0, 0)
+	return errno != unix.ENOSYS
+})
+
+// close releases the mount point fd of the target
+func (t *quotaTarget) close() {
+	if t.mountFd >= 0 {
+		unix.Close(t.mountFd)
+	}
+}
+
+// String returns the device or mount point of the target
+func (t *quotaTarget) String() string {
+	if t.device != "" {
+		return t.device
+	}
+	return t.mountPath
+}
+
+func getProjectQuota(target *quotaTarget, projectID quotaID) (*DiskQuotaSize, error) {
+	var dqblk C.struct_fs_disk_quota
+
+	err := target.quotactl(C.Q_XGETPQUOTA, projectID, unsafe.Pointer(&dqblk))
+	if errors.Is(err, unix.ENOENT) {
+		// The project has no dquot yet, so no limits and no usage
+		return &DiskQuotaSize{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get quota for project %d on %s: %w", projectID, target, err)
 	}
 
 	return &DiskQuotaSize{
-		Quota:      uint64(dqblk.d_blk_hardlimit) * 512,
-		Inodes:     uint64(dqblk.d_ino_hardlimit),
-		QuotaUsed:  uint64(dqblk.d_bcount) * 512,
-		InodesUsed: uint64(dqblk.d_icount),
+		Quota:       uint64(dqblk.d_blk_hardlimit) * 512,
+		Inodes:      uint64(dqblk.d_ino_hardlimit),
+		QuotaUsed:   uint64(dqblk.d_bcount) * 512,
+		InodesUsed:  uint64(dqblk.d_icount),
+		RtQuota:     uint64(dqblk.d_rtb_hardlimit) * 512,
+		RtQuotaUsed: uint64(dqblk.d_rtbcount) * 512,
+		QuotaSoft:   uint64(dqblk.d_blk_softlimit) * 512,
+		InodesSoft:  uint64(dqblk.d_ino_softlimit),
+		RtQuotaSoft: uint64(dqblk.d_rtb_softlimit) * 512,
 	}, nil
 }
 
-func setProjectQuota(backingFsBlockDev string, projectID quotaID, quota *DiskQuotaSize) error {
+func setProjectQuota(target *quotaTarget, projectID quotaID, quota *DiskQuotaSize) error {
 	var dqblk C.struct_fs_disk_quota
-	var cs = C.CString(backingFsBlockDev)
-	defer C.free(unsafe.Pointer(cs))
 
-	// Set the quota limits
+	dqblk.d_version = C.FS_DQUOT_VERSION
+	dqblk.d_id = C.__u32(projectID)
+	dqblk.d_flags = C.FS_PROJ_QUOTA
+
+	// Set the quota limits, the kernel ignores the fields not in the mask
+	softQuota, softInodes, softRtQuota := quota.softLimits()
+	dqblk.d_fieldmask = C.FS_DQ_LIMIT_MASK
 	dqblk.d_blk_hardlimit = C.__u64(quota.Quota / 512)
+	dqblk.d_blk_softlimit = C.__u64(softQuota / 512)
 	dqblk.d_ino_hardlimit = C.__u64(quota.Inodes)
+	dqblk.d_ino_softlimit = C.__u64(softInodes)
+	dqblk.d_rtb_hardlimit = C.__u64(quota.RtQuota / 512)
+	dqblk.d_rtb_softlimit = C.__u64(softRtQuota / 512)
 
-	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, C.Q_XSETPQLIM,
-		uintptr(unsafe.Pointer(cs)), uintptr(projectID),
-		uintptr(unsafe.Pointer(&dqblk)), 0, 0)
-	if errno != 0 {
-		return fmt.Errorf("failed to set quota for project %d: %v", projectID, errno)
+	err := target.quotactl(C.Q_XSETPQLIM, projectID, unsafe.Pointer(&dqblk))
+	if err != nil {
+		return fmt.Errorf("failed to set quota for project %d on %s: %w", projectID, target, err)
+	}
+
+	return nil
+}
+
+// getGenericProjectQuota get project quota via the generic quotactl
+// interface, used by filesystems other than XFS such as ext4
+func getGenericProjectQuota(target *quotaTarget, projectID quotaID) (*DiskQuotaSize, error) {
+	var dqblk C.struct_if_dqblk
+
+	err := target.quotactl(uintptr(C.Q_GETPQUOTA), projectID, unsafe.Pointer(&dqblk))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get quota for project %d on %s: %w", projectID, target, err)
+	}
+
+	return &DiskQuotaSize{
+		Quota:      uint64(dqblk.dqb_bhardlimit) * C.QIF_DQBLKSIZE,
+		Inodes:     uint64(dqblk.dqb_ihardlimit),
+		QuotaUsed:  uint64(dqblk.dqb_curspace),
+		InodesUsed: uint64(dqblk.dqb_curinodes),
+		QuotaSoft:  uint64(dqblk.dqb_bsoftlimit) * C.QIF_DQBLKSIZE,
+		InodesSoft: uint64(dqblk.dqb_isoftlimit),
+	}, nil
+}
+
+// listProjectQuotas returns the projects with a dquot on the filesystem,
+// found with Q_XGETNEXTQUOTA (Linux 4.6+)
+func listProjectQuotas(target *quotaTarget) (map[uint32]*DiskQuotaSize, error) {
+	quotas := make(map[uint32]*DiskQuotaSize)
+	for id := int64(0); id <= math.MaxInt32; {
+		var dqblk C.struct_fs_disk_quota
+		err := target.quotactl(C.Q_XGETNEXTPQUOTA, quotaID(id), unsafe.Pointer(&dqblk))
+		if errors.Is(err, unix.ENOENT) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list project quotas on %s: %w", target, err)
+		}
+		quotas[uint32(dqblk.d_id)] = &DiskQuotaSize{
+			Quota:       uint64(dqblk.d_blk_hardlimit) * 512,
+			Inodes:      uint64(dqblk.d_ino_hardlimit),
+			QuotaUsed:   uint64(dqblk.d_bcount) * 512,
+			InodesUsed:  uint64(dqblk.d_icount),
+			RtQuota:     uint64(dqblk.d_rtb_hardlimit) * 512,
+			RtQuotaUsed: uint64(dqblk.d_rtbcount) * 512,
+			QuotaSoft:   uint64(dqblk.d_blk_softlimit) * 512,
+			InodesSoft:  uint64(dqblk.d_ino_softlimit),
+			RtQuotaSoft: uint64(dqblk.d_rtb_softlimit) * 512,
+		}
+		id = int64(dqblk.d_id) + 1
+	}
+	return quotas, nil
+}
+
+// listGenericProjectQuotas returns the projects with a dquot on the
+// filesystem, found with Q_GETNEXTQUOTA (Linux 4.6+)
+func listGenericProjectQuotas(target *quotaTarget) (map[uint32]*DiskQuotaSize, error) {
+	quotas := make(map[uint32]*DiskQuotaSize)
+	for id := int64(0); id <= math.MaxInt32; {
+		var dqblk C.struct_if_nextdqblk
+		err := target.quotactl(uintptr(C.Q_GETNEXTPQUOTA), quotaID(id), unsafe.Pointer(&dqblk))
+		if errors.Is(err, unix.ENOENT) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list project quotas on %s: %w", target, err)
+		}
+		quotas[uint32(dqblk.dqb_id)] = &DiskQuotaSize{
+			Quota:      uint64(dqblk.dqb_bhardlimit) * C.QIF_DQBLKSIZE,
+			Inodes:     uint64(dqblk.dqb_ihardlimit),
+			QuotaUsed:  uint64(dqblk.dqb_curspace),
+			InodesUsed: uint64(dqblk.dqb_curinodes),
+			QuotaSoft:  uint64(dqblk.dqb_bsoftlimit) * C.QIF_DQBLKSIZE,
+			InodesSoft: uint64(dqblk.dqb_isoftlimit),
+		}
+		id = int64(dqblk.dqb_id) + 1
+	}
+	return quotas, nil
+}
+
+// getGraceTimes returns the grace times of project quota on the filesystem
+func getGraceTimes(target *quotaTarget) (*GraceTimes, error) {
+	var stat C.struct_fs_quota_stat
+
+	stat.qs_version = C.FS_QSTAT_VERSION
+	err := target.quotactl(uintptr(C.Q_XGETQSTAT_PRJQUOTA), 0, unsafe.Pointer(&stat))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get grace times on %s: %w", target, err)
+	}
+	return &GraceTimes{
+		Blocks:   uint32(stat.qs_btimelimit),
+		Inodes:   uint32(stat.qs_itimelimit),
+		RtBlocks: uint32(stat.qs_rtbtimelimit),
+	}, nil
+}
+
+// setGraceTimes sets the grace times of project quota on the filesystem,
+// which XFS keeps as the timers of project 0
+func setGraceTimes(target *quotaTarget, grace *GraceTimes) error {
+	var dqblk C.struct_fs_disk_quota
+
+	dqblk.d_version = C.FS_DQUOT_VERSION
+	dqblk.d_flags = C.FS_PROJ_QUOTA
+	dqblk.d_fieldmask = C.FS_DQ_TIMER_MASK
+	dqblk.d_btimer = C.__s32(grace.Blocks)
+	dqblk.d_itimer = C.__s32(grace.Inodes)
+	dqblk.d_rtbtimer = C.__s32(grace.RtBlocks)
+
+	err := target.quotactl(C.Q_XSETPQLIM, 0, unsafe.Pointer(&dqblk))
+	if err != nil {
+		return fmt.Errorf("failed to set grace times on %s: %w", target, err)
+	}
+	return nil
+}
+
+// getGenericGraceTimes returns the grace times of project quota on the
+// filesystem via the generic quotactl interface
+func getGenericGraceTimes(target *quotaTarget) (*GraceTimes, error) {
+	var info C.struct_if_dqinfo
+
+	err := target.quotactl(uintptr(C.Q_GETPINFO), 0, unsafe.Pointer(&info))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get grace times on %s: %w", target, err)
+	}
+	return &GraceTimes{
+		Blocks: uint32(info.dqi_bgrace),
+		Inodes: uint32(info.dqi_igrace),
+	}, nil
+}
+
+// setGenericGraceTimes sets the grace times of project quota on the
+// filesystem via the generic quotactl interface
+func setGenericGraceTimes(target *quotaTarget, grace *GraceTimes) error {
+	var info C.struct_if_dqinfo
+
+	info.dqi_valid = C.IIF_BGRACE | C.IIF_IGRACE
+	info.dqi_bgrace = C.__u64(grace.Blocks)
+	info.dqi_igrace = C.__u64(grace.Inodes)
+
+	err := target.quotactl(uintptr(C.Q_SETPINFO), 0, unsafe.Pointer(&info))
+	if err != nil {
+		return fmt.Errorf("failed to set grace times on %s: %w", target, err)
+	}
+	return nil
+}
+
+// setGenericProjectQuota set project quota via the generic quotactl
+// interface, used by filesystems other than XFS such as ext4
+func setGenericProjectQuota(target *quotaTarget, projectID quotaID, quota *DiskQuotaSize) error {
+	var dqblk C.struct_if_dqblk
+
+	// Limits are in QIF_DQBLKSIZE blocks, round up so the limit isn't lowered
+	softQuota, softInodes, _ := quota.softLimits()
+	dqblk.dqb_valid = C.QIF_LIMITS
+	dqblk.dqb_bhardlimit = C.__u64((quota.Quota + C.QIF_DQBLKSIZE - 1) / C.QIF_DQBLKSIZE)
+	dqblk.dqb_bsoftlimit = C.__u64((softQuota + C.QIF_DQBLKSIZE - 1) / C.QIF_DQBLKSIZE)
+	dqblk.dqb_ihardlimit = C.__u64(quota.Inodes)
+	dqblk.dqb_isoftlimit = C.__u64(softInodes)
+
+	err := target.quotactl(uintptr(C.Q_SETPQUOTA), projectID, unsafe.Pointer(&dqblk))
+	if err != nil {
+		return fmt.Errorf("failed to set quota for project %d on %s: %w", projectID, target, err)
 	}
 
 	return nil
@@ -328,14 +1414,16 @@ func setProjectQuota(backingFsBlockDev string, projectID quotaID, quota *DiskQuo
 
 func getProjectID(targetPath string) (quotaID, error) {
 	var fsx C.struct_fsxattr
-	var cs = C.CString(targetPath)
-	defer C.free(unsafe.Pointer(cs))
+	fd, err := unix.Open(targetPath, unix.O_RDONLY|unix.O_CLOEXEC|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %w", targetPath, err)
+	}
+	defer unix.Close(fd)
 
-	_, _, errno := unix.Syscall6(unix.SYS_IOCTL, 0,
-		uintptr(unsafe.Pointer(cs)), uintptr(C.FS_IOC_FSGETXATTR),
-		uintptr(unsafe.Pointer(&fsx)), 0, 0)
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd),
+		uintptr(C.FS_IOC_FSGETXATTR), uintptr(unsafe.Pointer(&fsx)))
 	if errno != 0 {
-		return 0, fmt.Errorf("failed to get project id for %s: %v", targetPath, errno)
+		return 0, fmt.Errorf("failed to get project id for %s: %w", targetPath, errno)
 	}
 
 	return quotaID(fsx.fsx_projid), nil
@@ -343,30 +1431,107 @@ func getProjectID(targetPath string) (quotaID, error) {
 
 func setProjectID(targetPath string, projectID quotaID) error {
 	var fsx C.struct_fsxattr
-	var cs = C.CString(targetPath)
-	defer C.free(unsafe.Pointer(cs))
+	fd, err := unix.Open(targetPath, unix.O_RDONLY|unix.O_CLOEXEC|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", targetPath, err)
+	}
+	defer unix.Close(fd)
 
 	// Get current attributes
-	_, _, errno := unix.Syscall6(unix.SYS_IOCTL, 0,
-		uintptr(unsafe.Pointer(cs)), uintptr(C.FS_IOC_FSGETXATTR),
-		uintptr(unsafe.Pointer(&fsx)), 0, 0)
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd),
+		uintptr(C.FS_IOC_FSGETXATTR), uintptr(unsafe.Pointer(&fsx)))
 	if errno != 0 {
-		return fmt.Errorf("failed to get current attributes for %s: %v", targetPath, errno)
+		return fmt.Errorf("failed to get current attributes for %s: %w", targetPath, errno)
 	}
 
-	// Set the project ID
+	// Set the project ID, new entries of a directory inherit it
 	fsx.fsx_projid = C.__u32(projectID)
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err == nil && stat.Mode&unix.S_IFMT == unix.S_IFDIR {
+		if projectID == noQuotaID {
+			fsx.fsx_xflags &^= C.FS_XFLAG_PROJINHERIT
+		} else {
+			fsx.fsx_xflags |= C.FS_XFLAG_PROJINHERIT
+		}
+	}
 
-	_, _, errno = unix.Syscall6(unix.SYS_IOCTL, 0,
-		uintptr(unsafe.Pointer(cs)), uintptr(C.FS_IOC_FSSETXATTR),
-		uintptr(unsafe.Pointer(&fsx)), 0, 0)
+	_, _, errno = unix.Syscall(unix.SYS_IOCTL, uintptr(fd),
+		uintptr(C.FS_IOC_FSSETXATTR), uintptr(unsafe.Pointer(&fsx)))
 	if errno != 0 {
-		return fmt.Errorf("failed to set project id for %s: %v", targetPath, errno)
+		return fmt.Errorf("failed to set project id for %s: %w", targetPath, errno)
 	}
 
 	return nil
 }
 
+// setProjectIDRecursive set the project id of the path and all the files and
+// directories below it, so that existing content is accounted to the project.
+// Symlinks, other filesystems mounted below the path and the directories of
+// skip are skipped. The walk stops when ctx is done.
+func setProjectIDRecursive(ctx context.Context, targetPath string, projectID quotaID, skip map[string]bool) error {
+	return walkTree(ctx, targetPath, skip, func(path string, d fs.DirEntry) error {
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		return setProjectID(path, projectID)
+	})
+}
+
+// getProjectIDs returns the project id of the path and of the directories
+// below it whose id differs from their parent's
+func getProjectIDs(ctx context.Context, targetPath string, skip map[string]bool) (map[string]quotaID, error) {
+	// directory => project id, of all the directories walked
+	all := make(map[string]quotaID)
+	ids := make(map[string]quotaID)
+	err := walkTree(ctx, targetPath, skip, func(path string, d fs.DirEntry) error {
+		if !d.IsDir() {
+			return nil
+		}
+		id, err := getProjectID(path)
+		if err != nil {
+			return err
+		}
+		all[path] = id
+		if parent, ok := all[filepath.Dir(path)]; path == targetPath || !ok || parent != id {
+			ids[path] = id
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// walkTree calls fn for the path and every file and directory below it on
+// the same filesystem, except the directories of skip and what is below
+// them. The walk stops when ctx is done.
+func walkTree(ctx context.Context, targetPath string, skip map[string]bool,
+	fn func(path string, d fs.DirEntry) error) error {
+	var root unix.Stat_t
+	if err := unix.Stat(targetPath, &root); err != nil {
+		return fmt.Errorf("failed to stat %s: %w", targetPath, err)
+	}
+	return filepath.WalkDir(targetPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() && path != targetPath {
+			if skip[path] {
+				return filepath.SkipDir
+			}
+			var stat unix.Stat_t
+			if err := unix.Lstat(path, &stat); err != nil {
+				return err
+			}
+			if stat.Dev != root.Dev {
+				return filepath.SkipDir
+			}
+		}
+		return fn(path, d)
+	})
+}
+
 func free(p *C.char) {
 	C.free(unsafe.Pointer(p))
 }
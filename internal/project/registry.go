@@ -0,0 +1,164 @@
+package project
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"xfsquotas/internal/mount"
+
+	"k8s.io/klog/v2"
+)
+
+// registryDirName is the hidden directory at the root of a filesystem
+// keeping its registry
+const registryDirName = ".xfsquota"
+
+// registry is the project files of a single filesystem. Paths are recorded
+// relative to the root of the filesystem, so the registry stays valid when
+// the disk is attached to another host or mounted elsewhere.
+type registry struct {
+	file *projectFile
+	// the main mount of the filesystem
+	mount *mount.Mount
+	// projects of the filesystem as last loaded or persisted, these are
+	// replaced in the global project files on persist
+	idPaths map[quotaID][]string
+	idNames map[quotaID]string
+}
+
+// openRegistry returns the registry of the filesystem of the mount. It is
+// kept in the state directory under the filesystem's UUID if one is
+// configured, in a hidden directory at the mount root otherwise.
+func (p *ProjectQuota) openRegistry(mnt *mount.Mount) (*registry, error) {
+	main := mnt
+	if mnt.Main != nil {
+		main = mnt.Main
+	}
+	var dir string
+	if p.registryDir != "" {
+		uuid, err := p.backend.FilesystemUUID(main)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get uuid of the filesystem mounted at %s: %v", main.Path, err)
+		}
+		dir = filepath.Join(p.registryDir, uuid)
+	} else {
+		dir = filepath.Join(main.Path, registryDirName)
+	}
+	dir = mount.HostPath(p.hostRoot, dir)
+	return &registry{
+		file:  newProjectFileWithStore(p.store, filepath.Join(dir, "projects"), filepath.Join(dir, "projid")),
+		mount: main,
+	}, nil
+}
+
+// lockName returns the lock file of the registry
+func (r *registry) lockName() string {
+	return r.file.projectsPath + ".lock"
+}
+
+// load reads the projects of the filesystem, returning absolute paths
+func (r *registry) load() (map[quotaID][]string, map[quotaID]string, error) {
+	fsIdPaths, idNames, err := r.file.DumpProjectIds()
+	if err != nil {
+		return nil, nil, err
+	}
+	idPaths := make(map[quotaID][]string, len(fsIdPaths))
+	for id, fsPaths := range fsIdPaths {
+		for _, fsPath := range fsPaths {
+			path, err := r.mount.PathOf(fsPath)
+			if err != nil {
+				klog.Errorf("skip project %d of %s: %v", id, fsPath, err)
+				continue
+			}
+			idPaths[id] = append(idPaths[id], path)
+		}
+	}
+	r.idPaths = copyIdPaths(idPaths)
+	r.idNames = copyIdNames(idNames)
+	return idPaths, idNames, nil
+}
+
+// persist saves the projects of the filesystem, then regenerates the global
+// project files from it for tools like xfs_quota
+func (r *registry) persist(global *projectFile, idPaths map[quotaID][]string, idNames map[quotaID]string) error {
+	fsIdPaths := make(map[quotaID][]string, len(idPaths))
+	for id, paths := range idPaths {
+		for _, path := range paths {
+			fsPath, err := r.mount.FilesystemPath(path)
+			if err != nil {
+				return err
+			}
+			fsIdPaths[id] = append(fsIdPaths[id], fsPath)
+		}
+	}
+	if err := r.file.UpdateProjects(fsIdPaths); err != nil {
+		return err
+	}
+	if err := r.file.UpdateProjIds(idNames); err != nil {
+		return err
+	}
+
+	globalIdPaths, globalIdNames, err := global.DumpProjectIds()
+	if err != nil {
+		return err
+	}
+	// Other filesystems may use the same ids, only replace the records of
+	// this one
+	for id, paths := range r.idPaths {
+		for _, path := range paths {
+			globalIdPaths[id] = removePath(globalIdPaths[id], path)
+		}
+		if len(globalIdPaths[id]) == 0 {
+			delete(globalIdPaths, id)
+		}
+	}
+	for id, paths := range idPaths {
+		for _, path := range paths {
+			globalIdPaths[id] = append(removePath(globalIdPaths[id], path), path)
+		}
+	}
+	for id := range r.idNames {
+		if _, used := globalIdPaths[id]; !used {
+			delete(globalIdNames, id)
+		}
+	}
+	for id, name := range idNames {
+		globalIdNames[id] = name
+	}
+	if err := global.UpdateProjects(globalIdPaths); err != nil {
+		return err
+	}
+	if err := global.UpdateProjIds(globalIdNames); err != nil {
+		return err
+	}
+	r.idPaths = copyIdPaths(idPaths)
+	r.idNames = copyIdNames(idNames)
+	return nil
+}
+
+// removePath returns paths without path
+func removePath(paths []string, path string) []string {
+	kept := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if p != path {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+func copyIdPaths(idPaths map[quotaID][]string) map[quotaID][]string {
+	copied := make(map[quotaID][]string, len(idPaths))
+	for id, paths := range idPaths {
+		copied[id] = append([]string(nil), paths...)
+	}
+	return copied
+}
+
+func copyIdNames(idNames map[quotaID]string) map[quotaID]string {
+	copied := make(map[quotaID]string, len(idNames))
+	for id, name := range idNames {
+		copied[id] = name
+	}
+	return copied
+}
@@ -0,0 +1,248 @@
+package project
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"xfsquotas/internal/mount"
+)
+
+// Capacity is the size of a filesystem and what is left of it
+type Capacity struct {
+	Bytes      uint64 `json:"bytes"`
+	BytesFree  uint64 `json:"bytesFree"`
+	Inodes     uint64 `json:"inodes"`
+	InodesFree uint64 `json:"inodesFree"`
+}
+
+// ReportEntry is a project of a filesystem with its limits and usage
+type ReportEntry struct {
+	ID   uint32 `json:"id"`
+	Name string `json:"name,omitempty"`
+	// the recorded paths, none for a dquot nobody recorded
+	Paths []string       `json:"paths"`
+	Size  *DiskQuotaSize `json:"size"`
+}
+
+// FilesystemReport is the projects of a filesystem with project quota, and
+// their total limits against its capacity
+type FilesystemReport struct {
+	Mount  string `json:"mount"`
+	Device string `json:"device"`
+	Type   string `json:"type"`
+	// false if mounted to only account usage, e.g. with pqnoenforce
+	Enforced bool           `json:"enforced"`
+	Projects []*ReportEntry `json:"projects"`
+	// the sums of the hard limits and usage of the projects
+	Total *DiskQuotaSize `json:"total"`
+	// nil if the backend can't tell
+	Capacity *Capacity `json:"capacity,omitempty"`
+}
+
+// OverCommit returns the ratio of the sum of the block hard limits to the
+// capacity of the filesystem, above 1 when more is promised than there is.
+// It is 0 if the capacity is unknown.
+func (r *FilesystemReport) OverCommit() float64 {
+	if r.Capacity == nil || r.Capacity.Bytes == 0 {
+		return 0
+	}
+	return float64(r.Total.Quota) / float64(r.Capacity.Bytes)
+}
+
+// UsedPercent returns the highest usage of a limit of the project, in
+// percent of the limit, 0 if it has no limits
+func (d *DiskQuotaSize) UsedPercent() float64 {
+	percent := 0.0
+	for _, pair := range [][2]uint64{
+		{d.QuotaUsed, d.Quota}, {d.InodesUsed, d.Inodes}, {d.RtQuotaUsed, d.RtQuota},
+	} {
+		if pair[1] != 0 {
+			percent = max(percent, float64(pair[0])*100/float64(pair[1]))
+		}
+	}
+	return percent
+}
+
+// OverSoftLimit reports whether the usage exceeds a soft limit, the grace
+// time is running
+func (d *DiskQuotaSize) OverSoftLimit() bool {
+	quota, inodes, rtQuota := d.softLimits()
+	return quota != 0 && d.QuotaUsed > quota || inodes != 0 && d.InodesUsed > inodes ||
+		rtQuota != 0 && d.RtQuotaUsed > rtQuota
+}
+
+// AtHardLimit reports whether the usage reached a hard limit, writes fail
+// with EDQUOT
+func (d *DiskQuotaSize) AtHardLimit() bool {
+	return d.Quota != 0 && d.QuotaUsed >= d.Quota || d.Inodes != 0 && d.InodesUsed >= d.Inodes ||
+		d.RtQuota != 0 && d.RtQuotaUsed >= d.RtQuota
+}
+
+// Report returns the projects of every mounted filesystem with project
+// quota enabled, or of the filesystems of the given mount points. Projects
+// with a dquot but no recorded path are included if the backend can list
+// dquots.
+func (p *ProjectQuota) Report(mountPaths ...string) ([]*FilesystemReport, error) {
+	return p.ReportContext(context.Background(), mountPaths...)
+}
+
+// ReportContext is Report, stopping when ctx is done
+func (p *ProjectQuota) ReportContext(ctx context.Context, mountPaths ...string) ([]*FilesystemReport, error) {
+	mounts, err := p.reportMounts(mountPaths)
+	if err != nil {
+		return nil, err
+	}
+	return p.newSession().report(ctx, mounts)
+}
+
+// reportMounts returns the main mounts of the filesystems to report
+func (p *ProjectQuota) reportMounts(mountPaths []string) ([]*mount.Mount, error) {
+	var mounts []*mount.Mount
+	if len(mountPaths) == 0 {
+		lister, ok := p.backend.(filesystemLister)
+		if !ok {
+			return nil, fmt.Errorf("the backend can't list filesystems, give the mount points")
+		}
+		all, err := lister.Mounts()
+		if err != nil {
+			return nil, err
+		}
+		for _, mnt := range all {
+			if supportedFilesystems[mnt.FilesystemType] && projectQuotaOn(mnt) {
+				mounts = append(mounts, mnt)
+			}
+		}
+		return mounts, nil
+	}
+	seen := make(map[mount.DeviceNumber]bool)
+	for _, mountPath := range mountPaths {
+		mnt, err := p.backend.FindMount(mountPath)
+		if err != nil {
+			return nil, err
+		}
+		if mnt.Main != nil {
+			mnt = mnt.Main
+		}
+		if !supportedFilesystems[mnt.FilesystemType] {
+			return nil, unsupportedError(mountPath, mnt)
+		}
+		if !projectQuotaOn(mnt) {
+			return nil, fmt.Errorf("%w: %s", ErrQuotaDisabled, mnt.Path)
+		}
+		if !seen[mnt.DeviceNumber] {
+			seen[mnt.DeviceNumber] = true
+			mounts = append(mounts, mnt)
+		}
+	}
+	return mounts, nil
+}
+
+// report collects the projects of the mounts from the records and the
+// dquots
+func (s *session) report(ctx context.Context, mounts []*mount.Mount) ([]*FilesystemReport, error) {
+	if err := s.loadProjectIds(nil); err != nil {
+		return nil, err
+	}
+	reports := make([]*FilesystemReport, 0, len(mounts))
+	byDevice := make(map[mount.DeviceNumber]*FilesystemReport)
+	entries := make(map[mount.DeviceNumber]map[quotaID]*ReportEntry)
+	for _, mnt := range mounts {
+		report := &FilesystemReport{
+			Mount:    mnt.Path,
+			Device:   mnt.Device,
+			Type:     mnt.FilesystemType,
+			Enforced: !hasMountOption(mnt, "pqnoenforce"),
+			Projects: []*ReportEntry{},
+			Total:    &DiskQuotaSize{},
+		}
+		if lister, ok := s.backend.(filesystemLister); ok {
+			capacity, err := lister.Capacity(mnt)
+			if err != nil {
+				return nil, err
+			}
+			report.Capacity = capacity
+		}
+		reports = append(reports, report)
+		byDevice[mnt.DeviceNumber] = report
+		entries[mnt.DeviceNumber] = make(map[quotaID]*ReportEntry)
+	}
+
+	paths := make([]string, 0, len(s.pathIds))
+	for path := range s.pathIds {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		mnt, err := s.backend.FindMount(path)
+		if err != nil || byDevice[mnt.DeviceNumber] == nil {
+			continue
+		}
+		projectID := s.pathIds[path]
+		entry, ok := entries[mnt.DeviceNumber][projectID]
+		if !ok {
+			entry = &ReportEntry{ID: uint32(projectID), Name: s.idNames[projectID], Paths: []string{}}
+			entries[mnt.DeviceNumber][projectID] = entry
+		}
+		entry.Paths = append(entry.Paths, path)
+	}
+
+	lister, canList := s.backend.(quotaLister)
+	for _, mnt := range mounts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		report := byDevice[mnt.DeviceNumber]
+		if canList {
+			quotas, err := lister.ListQuotas(mnt)
+			if err != nil {
+				return nil, err
+			}
+			for id, size := range quotas {
+				// Project 0 accounts everything outside of projects
+				if id == 0 {
+					continue
+				}
+				entry, ok := entries[mnt.DeviceNumber][quotaID(id)]
+				if !ok && !size.HasLimits() && size.QuotaUsed == 0 && size.InodesUsed == 0 {
+					continue
+				}
+				if !ok {
+					entry = &ReportEntry{ID: id, Name: s.idNames[quotaID(id)], Paths: []string{}}
+					entries[mnt.DeviceNumber][quotaID(id)] = entry
+				}
+				entry.Size = size
+			}
+		}
+		for id, entry := range entries[mnt.DeviceNumber] {
+			if entry.Size == nil {
+				size, err := s.backend.GetQuota(mnt, uint32(id))
+				if err != nil {
+					return nil, err
+				}
+				entry.Size = size
+			}
+			report.Projects = append(report.Projects, entry)
+			report.Total.Quota += entry.Size.Quota
+			report.Total.Inodes += entry.Size.Inodes
+			report.Total.RtQuota += entry.Size.RtQuota
+			report.Total.QuotaUsed += entry.Size.QuotaUsed
+			report.Total.InodesUsed += entry.Size.InodesUsed
+			report.Total.RtQuotaUsed += entry.Size.RtQuotaUsed
+		}
+		sort.Slice(report.Projects, func(i, j int) bool {
+			return report.Projects[i].ID < report.Projects[j].ID
+		})
+	}
+	return reports, nil
+}
+
+// projectQuotaOn reports whether the filesystem of the mount accounts
+// project quota
+func projectQuotaOn(mnt *mount.Mount) bool {
+	return hasMountOption(mnt, quotaMountOption) || hasMountOption(mnt, "pquota") ||
+		hasMountOption(mnt, "pqnoenforce")
+}
@@ -0,0 +1,193 @@
+package project
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"xfsquotas/internal/mount"
+)
+
+// session is the state of one operation: the project ids loaded from the
+// project files it works on. Sessions of a ProjectQuota run concurrently,
+// those working on the same filesystem are serialized by its lock.
+type session struct {
+	*ProjectQuota
+	// id => name
+	idNames map[quotaID]string
+	// id => path
+	idPaths map[quotaID][]string
+	// path => id
+	pathIds map[string]quotaID
+	// name => id
+	nameIds map[string]quotaID
+	// registry of the filesystem the projects were loaded from, nil when
+	// they were loaded from the global project files
+	registry *registry
+	// the global project ids as last read, the changes of the session are
+	// merged into the files changed meanwhile by other filesystems
+	loadedPaths map[quotaID][]string
+	loadedNames map[quotaID]string
+	// the lock file of the loaded project files
+	lockName string
+	// the lock files held by the session
+	held map[string]bool
+	// the records of the steps are written by the caller, see
+	// allocateBatchIds
+	deferRecords bool
+}
+
+// newSession starts an operation
+func (p *ProjectQuota) newSession() *session {
+	return &session{
+		ProjectQuota: p,
+		idNames:      make(map[quotaID]string),
+		idPaths:      make(map[quotaID][]string),
+		pathIds:      make(map[string]quotaID),
+		nameIds:      make(map[string]quotaID),
+		held:         make(map[string]bool),
+	}
+}
+
+// lockTable serializes the goroutines of the process taking the same lock
+// file, like flock(2) serializes processes
+type lockTable struct {
+	mu    sync.Mutex
+	locks map[string]chan struct{}
+}
+
+// acquire takes the named lock until the returned function is called,
+// waiting for it until ctx is done
+func (t *lockTable) acquire(ctx context.Context, name string) (func(), error) {
+	t.mu.Lock()
+	if t.locks == nil {
+		t.locks = make(map[string]chan struct{})
+	}
+	lock, ok := t.locks[name]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		t.locks[name] = lock
+	}
+	t.mu.Unlock()
+
+	select {
+	case lock <- struct{}{}:
+		return func() { <-lock }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for lock %s: %w", name, ctx.Err())
+	}
+}
+
+// globalLock is the lock file of the global project files and the journal
+func (p *ProjectQuota) globalLock() string {
+	return p.prjFile.projectsPath + ".lock"
+}
+
+// filesystemLock is the lock file of the operations on the filesystem of the
+// mount when its projects are recorded in the global project files
+func (p *ProjectQuota) filesystemLock(mnt *mount.Mount) string {
+	return fmt.Sprintf("%s.%s.lock", p.prjFile.projectsPath, strings.ReplaceAll(mnt.DeviceNumber.String(), ":", "-"))
+}
+
+// scopeOf returns the lock file an operation on the mount works under: the
+// registry of its filesystem, or a lock of the filesystem if the projects
+// are recorded in the global project files. The global project files
+// themselves are only locked while they are updated, see lockGlobal.
+func (s *session) scopeOf(mnt *mount.Mount) (string, error) {
+	if mnt == nil {
+		return s.globalLock(), nil
+	}
+	if !s.mountRegistry {
+		return s.filesystemLock(mnt), nil
+	}
+	r, err := s.openRegistry(mnt)
+	if err != nil {
+		return "", err
+	}
+	return r.lockName(), nil
+}
+
+// scope returns the lock file of the loaded project files
+func (s *session) scope() string {
+	if s.lockName == "" {
+		return s.globalLock()
+	}
+	return s.lockName
+}
+
+// lock takes the locks of the project files of the mounts, in order, until
+// the returned function is called. A nil mount is the global project files.
+// A dry run changes nothing and doesn't need them.
+func (s *session) lock(ctx context.Context, mnts ...*mount.Mount) (func(), error) {
+	if s.dryRun {
+		return func() {}, ctx.Err()
+	}
+	names := make(map[string]bool)
+	for _, mnt := range mnts {
+		name, err := s.scopeOf(mnt)
+		if err != nil {
+			return nil, err
+		}
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	// The global project files are locked last, see lockGlobal
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i] == s.globalLock() || sorted[j] == s.globalLock() {
+			return sorted[j] == s.globalLock()
+		}
+		return sorted[i] < sorted[j]
+	})
+
+	var unlocks []func()
+	unlockAll := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for _, name := range sorted {
+		unlock, err := s.lockFile(ctx, name)
+		if err != nil {
+			unlockAll()
+			return nil, err
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	return unlockAll, nil
+}
+
+// lockGlobal takes the lock of the global project files and the journal for
+// a short update, unless the session holds it already. Sessions take it
+// after the lock of their filesystem or registry, never before.
+func (s *session) lockGlobal() (func(), error) {
+	if s.dryRun || s.held[s.globalLock()] {
+		return func() {}, nil
+	}
+	return s.lockFile(context.Background(), s.globalLock())
+}
+
+// lockFile takes the lock of the process, then the flock(2) of the lock file
+func (s *session) lockFile(ctx context.Context, name string) (func(), error) {
+	release, err := s.locks.acquire(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	unlock := func() {}
+	if l, ok := s.store.(locker); ok {
+		if unlock, err = l.Lock(ctx, name); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	s.held[name] = true
+	return func() {
+		delete(s.held, name)
+		unlock()
+		release()
+	}, nil
+}
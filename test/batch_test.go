@@ -0,0 +1,134 @@
+package test
+
+import (
+	"errors"
+	"testing"
+
+	"xfsquotas/api"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFakeBackendApplyBatch(t *testing.T) {
+	fake, quota := newFakeQuota()
+	fake.AddMount("/tmp", "tmpfs")
+	specs := []api.QuotaSpec{
+		{Path: "/data/user1", Size: &api.DiskQuotaSize{Quota: 1 << 20}},
+		{Path: "/tmp/user2", Size: &api.DiskQuotaSize{Quota: 1 << 20}},
+		{Path: "/data/user3"},
+	}
+
+	results, err := quota.ApplyBatch(specs, api.AllOrNothing)
+	if err == nil {
+		t.Fatal("Expected the batch to fail")
+	}
+	if !errors.Is(results[0].Err, api.ErrBatchAborted) || results[1].Err == nil ||
+		!errors.Is(results[2].Err, api.ErrBatchAborted) {
+		t.Errorf("Unexpected results %+v %+v %+v", results[0], results[1], results[2])
+	}
+	if entries, _ := quota.List(); len(entries) != 0 {
+		t.Errorf("Expected nothing to be applied, got %+v", entries)
+	}
+	if id, _ := fake.GetProjectID("/data/user1"); id != 0 {
+		t.Errorf("Expected /data/user1 to be untouched, got id %d", id)
+	}
+
+	results, err = quota.ApplyBatch(specs, api.ContinueOnError)
+	if err == nil {
+		t.Fatal("Expected the batch to report the failed spec")
+	}
+	if results[0].Err != nil || results[1].Err == nil || results[2].Err != nil {
+		t.Fatalf("Unexpected results %+v %+v %+v", results[0], results[1], results[2])
+	}
+	if results[0].ID == 0 || results[0].ID == results[2].ID {
+		t.Errorf("Expected distinct ids, got %d and %d", results[0].ID, results[2].ID)
+	}
+	entries, err := quota.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].ID != results[0].ID || entries[1].Size.HasLimits() {
+		t.Errorf("Expected the applied specs to be recorded, got %+v", entries)
+	}
+	if err := fake.Write("/data/user1/file", 2<<20); !errors.Is(err, unix.EDQUOT) {
+		t.Errorf("Expected EDQUOT, got %v", err)
+	}
+}
+
+// readOnlyProjects makes writing /etc/projects of a FakeBackend fail
+type readOnlyProjects struct {
+	*api.FakeBackend
+}
+
+func (b *readOnlyProjects) WriteFile(name string, data []byte) error {
+	if name == "/etc/projects" {
+		return errors.New("read-only file system")
+	}
+	return b.FakeBackend.WriteFile(name, data)
+}
+
+func TestFakeBackendApplyBatchPersistFailure(t *testing.T) {
+	for _, mode := range []api.BatchMode{api.AllOrNothing, api.ContinueOnError} {
+		backend := &readOnlyProjects{api.NewFakeBackend()}
+		quota := api.NewQuotaManager(api.WithBackend(backend))
+		specs := []api.QuotaSpec{
+			{Path: "/data/user1", Size: &api.DiskQuotaSize{Quota: 1 << 20}},
+			{Path: "/data/user2", Size: &api.DiskQuotaSize{Quota: 1 << 20}},
+		}
+		results, err := quota.ApplyBatch(specs, mode)
+		if err == nil || results[0].Err == nil || results[1].Err == nil {
+			t.Fatalf("Expected the batch to fail in mode %d, got %+v %+v, %v", mode, results[0], results[1], err)
+		}
+		// Nothing unrecorded is left tagged or limited
+		for _, spec := range specs {
+			if id, _ := backend.GetProjectID(spec.Path); id != 0 {
+				t.Errorf("Expected %s to be rolled back in mode %d, got id %d", spec.Path, mode, id)
+			}
+		}
+		mnt, _ := backend.FindMount("/data")
+		quotas, _ := backend.ListQuotas(mnt)
+		for id, size := range quotas {
+			if size.HasLimits() {
+				t.Errorf("Expected the limits of project %d to be rolled back in mode %d", id, mode)
+			}
+		}
+		if journals, err := quota.Recover(false); len(journals) != 0 || err != nil {
+			t.Errorf("Expected no journal to be left, got %+v, %v", journals, err)
+		}
+	}
+}
+
+// countingStore counts the writes of each file of a FakeBackend
+type countingStore struct {
+	*api.FakeBackend
+	writes map[string]int
+}
+
+func (b *countingStore) WriteFile(name string, data []byte) error {
+	b.writes[name]++
+	return b.FakeBackend.WriteFile(name, data)
+}
+
+func TestFakeBackendApplyBatchWritesOnce(t *testing.T) {
+	for _, mode := range []api.BatchMode{api.AllOrNothing, api.ContinueOnError} {
+		backend := &countingStore{FakeBackend: api.NewFakeBackend(), writes: make(map[string]int)}
+		backend.AddMount("/disk2", "xfs")
+		quota := api.NewQuotaManager(api.WithBackend(backend))
+		specs := []api.QuotaSpec{
+			{Path: "/data/user1", Size: &api.DiskQuotaSize{Quota: 1 << 20}},
+			{Path: "/data/user2"},
+			{Path: "/disk2/user3", Size: &api.DiskQuotaSize{Quota: 1 << 20}},
+		}
+		if _, err := quota.ApplyBatch(specs, mode); err != nil {
+			t.Fatalf("ApplyBatch failed in mode %d: %v", mode, err)
+		}
+		for _, name := range []string{"/etc/projects", "/etc/projid"} {
+			if backend.writes[name] != 1 {
+				t.Errorf("Expected %s to be written once in mode %d, got %d", name, mode, backend.writes[name])
+			}
+		}
+		if entries, _ := quota.List(); len(entries) != len(specs) {
+			t.Errorf("Expected every spec to be recorded in mode %d, got %+v", mode, entries)
+		}
+	}
+}
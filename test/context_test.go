@@ -0,0 +1,45 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"xfsquotas/api"
+)
+
+// cancelingBackend cancels the context of the operation once a directory
+// was retagged, as if SIGINT arrived during the walk
+type cancelingBackend struct {
+	*api.FakeBackend
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBackend) SetProjectIDSkipping(ctx context.Context, path string, id uint32, skip []string) error {
+	err := b.FakeBackend.SetProjectIDSkipping(ctx, path, id, skip)
+	b.cancel()
+	return err
+}
+
+func TestFakeBackendContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	backend := &cancelingBackend{FakeBackend: api.NewFakeBackend(), cancel: cancel}
+	quota := api.NewQuotaManager(api.WithBackend(backend))
+
+	if err := quota.SetQuotaContext(ctx, "/data/user1", "1MiB", "0"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the set to be cancelled, got %v", err)
+	}
+	// The cancelled set is rolled back
+	if id, _ := backend.GetProjectID("/data/user1"); id != 0 {
+		t.Errorf("Expected the project id to be rolled back, got %d", id)
+	}
+	if entries, _ := quota.List(); len(entries) != 0 {
+		t.Errorf("Expected no recorded paths, got %+v", entries)
+	}
+	if _, err := quota.GetQuotaContext(ctx, "/data/user1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected GetQuotaContext to fail, got %v", err)
+	}
+	if err := quota.SetQuotaContext(context.Background(), "/data/user1", "1MiB", "0"); err != nil {
+		t.Errorf("SetQuotaContext failed: %v", err)
+	}
+}
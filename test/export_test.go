@@ -0,0 +1,98 @@
+package test
+
+import (
+	"errors"
+	"testing"
+
+	"xfsquotas/api"
+)
+
+func TestFakeBackendExportRestore(t *testing.T) {
+	source := api.NewFakeBackend()
+	quota := api.NewQuotaManager(api.WithBackend(source))
+	if err := quota.SetQuotaLimits("/data/user1", &api.DiskQuotaSize{Quota: 4 << 20, QuotaSoft: 3 << 20, Inodes: 100}); err != nil {
+		t.Fatalf("SetQuotaLimits failed: %v", err)
+	}
+	mustSetQuota(t, quota, "/data/user2", "1MiB", "0")
+	mnt, _ := source.FindMount("/")
+	source.SetGrace(mnt, &api.GraceTimes{Blocks: 3600, Inodes: 60})
+
+	export, err := quota.Export()
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if len(export.Filesystems) != 1 || len(export.Filesystems[0].Projects) != 2 {
+		t.Fatalf("Unexpected export %+v", export.Filesystems)
+	}
+	if limits := export.Filesystems[0].Projects[0].Limits; limits.QuotaSoft != 3<<20 || limits.InodesSoft != 100 {
+		t.Errorf("Expected the soft limits to be exported, got %+v", limits)
+	}
+
+	// The target already uses the first id for another path
+	target := api.NewFakeBackend()
+	restored := api.NewQuotaManager(api.WithBackend(target))
+	mustSetQuota(t, restored, "/data/other", "1MiB", "0")
+	results, err := restored.Restore(export, api.RestoreOptions{})
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if len(results) != 2 || !errors.Is(results[0].Err, api.ErrConflictingProject) || results[1].Err != nil {
+		t.Fatalf("Expected only the first project to conflict, got %+v", results)
+	}
+	results, err = restored.Restore(export, api.RestoreOptions{Remap: true})
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if results[0].Err != nil || results[0].NewID == results[0].ID {
+		t.Fatalf("Expected the first project to be remapped, got %+v", results[0])
+	}
+	if results[1].Err != nil || results[1].NewID != results[1].ID {
+		t.Errorf("Expected the second project to be kept, got %+v", results[1])
+	}
+	size, err := restored.GetQuota("/data/user1")
+	if err != nil {
+		t.Fatalf("GetQuota failed: %v", err)
+	}
+	if size.Quota != 4<<20 || size.QuotaSoft != 3<<20 || size.Inodes != 100 {
+		t.Errorf("Unexpected restored limits %+v", size)
+	}
+	if id, _ := target.GetProjectID("/data/user1"); id != results[0].NewID {
+		t.Errorf("Expected /data/user1 to be tagged with %d, got %d", results[0].NewID, id)
+	}
+	grace, _ := target.GetGrace(mnt)
+	if grace.Blocks != 3600 || grace.Inodes != 60 {
+		t.Errorf("Unexpected restored grace times %+v", grace)
+	}
+}
+
+func TestFakeBackendExportRestoreWithoutDevices(t *testing.T) {
+	source, quota := newFakeQuota()
+	source.AddMount("/disk2", "xfs")
+	clearDevices(t, source, "/", "/disk2")
+	mustSetQuota(t, quota, "/data/user1", "1MiB", "0")
+	mustSetQuota(t, quota, "/disk2/user2", "2MiB", "0")
+
+	export, err := quota.Export()
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if len(export.Filesystems) != 2 || export.Filesystems[0].Mount != "/" || export.Filesystems[1].Mount != "/disk2" {
+		t.Fatalf("Expected a filesystem per mount point, got %+v", export.Filesystems)
+	}
+
+	target, restored := newFakeQuota()
+	target.AddMount("/disk2", "xfs")
+	clearDevices(t, target, "/", "/disk2")
+	// A path is restored only on the filesystem it was exported from
+	export.Filesystems[1].Projects = append(export.Filesystems[1].Projects, export.Filesystems[0].Projects...)
+	results, err := restored.Restore(export, api.RestoreOptions{})
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if len(results) != 3 || results[0].Err != nil || results[1].Err != nil || results[2].Err == nil {
+		t.Fatalf("Expected only the project moved to /disk2 to fail, got %+v", results)
+	}
+	if size, err := restored.GetQuota("/disk2/user2"); err != nil || size.Quota != 2<<20 {
+		t.Errorf("Expected the limit of /disk2/user2 to be restored, got %+v, %v", size, err)
+	}
+}
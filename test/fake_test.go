@@ -0,0 +1,171 @@
+package test
+
+import (
+	"errors"
+	"testing"
+
+	"xfsquotas/api"
+
+	"golang.org/x/sys/unix"
+)
+
+// newFakeQuota returns a FakeBackend and a QuotaManager using it
+func newFakeQuota(opts ...api.Option) (*api.FakeBackend, *api.QuotaManager) {
+	fake := api.NewFakeBackend()
+	return fake, api.NewQuotaManager(append([]api.Option{api.WithBackend(fake)}, opts...)...)
+}
+
+// clearDevices clears the device names of the mounts of fake at paths, like
+// those of filesystems reached only through quotactl_fd
+func clearDevices(t *testing.T, fake *api.FakeBackend, paths ...string) {
+	t.Helper()
+	for _, path := range paths {
+		mnt, err := fake.FindMount(path)
+		if err != nil {
+			t.Fatalf("FindMount failed: %v", err)
+		}
+		mnt.Device = ""
+	}
+}
+
+// mustSetQuota sets the quota of path, failing the test on error
+func mustSetQuota(t *testing.T, quota *api.QuotaManager, path, size, inodes string) {
+	t.Helper()
+	if err := quota.SetQuota(path, size, inodes); err != nil {
+		t.Fatalf("SetQuota failed: %v", err)
+	}
+}
+
+func TestFakeBackendSetGetClean(t *testing.T) {
+	fake, quota := newFakeQuota()
+
+	mustSetQuota(t, quota, "/data/user1", "1MiB", "10")
+	if err := fake.Write("/data/user1/file", 512*1024); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	info, err := quota.GetQuota("/data/user1")
+	if err != nil {
+		t.Fatalf("GetQuota failed: %v", err)
+	}
+	if info.Quota != 1024*1024 || info.Inodes != 10 {
+		t.Errorf("Expected limits 1MiB/10, got %d/%d", info.Quota, info.Inodes)
+	}
+	if info.QuotaUsed != 512*1024 || info.InodesUsed != 1 {
+		t.Errorf("Expected usage 512KiB/1, got %d/%d", info.QuotaUsed, info.InodesUsed)
+	}
+
+	if err := quota.CleanQuota("/data/user1"); err != nil {
+		t.Fatalf("CleanQuota failed: %v", err)
+	}
+	id, _ := fake.GetProjectID("/data/user1")
+	if id != 0 {
+		t.Errorf("Expected project id to be released, got %d", id)
+	}
+}
+
+func TestFakeBackendEDQUOT(t *testing.T) {
+	fake, quota := newFakeQuota()
+
+	mustSetQuota(t, quota, "/data/user1", "1MiB", "0")
+	mustSetQuota(t, quota, "/data/user2", "1MiB", "0")
+	if err := fake.Write("/data/user1/a", 1024*1024); err != nil {
+		t.Fatalf("Write within limit failed: %v", err)
+	}
+	if err := fake.Write("/data/user1/b", 1); !errors.Is(err, unix.EDQUOT) {
+		t.Errorf("Expected EDQUOT, got %v", err)
+	}
+	// Projects are accounted separately
+	if err := fake.Write("/data/user2/a", 1024*1024); err != nil {
+		t.Errorf("Write to other project failed: %v", err)
+	}
+}
+
+func TestFakeBackendFilesystemTypes(t *testing.T) {
+	fake, quota := newFakeQuota()
+	fake.AddMount("/ext4", "ext4")
+	fake.AddMount("/tmp", "tmpfs")
+
+	if err := quota.SetQuota("/ext4/user1", "1MiB", "10"); err != nil {
+		t.Errorf("SetQuota on ext4 failed: %v", err)
+	}
+	if err := quota.SetQuota("/tmp/user1", "1MiB", "10"); err == nil {
+		t.Error("Expected SetQuota on tmpfs to fail")
+	}
+}
+
+func TestFakeBackendRealtimeQuota(t *testing.T) {
+	fake, quota := newFakeQuota()
+	fake.AddMount("/ext4", "ext4")
+
+	limits := &api.DiskQuotaSize{Quota: 1 << 20, RtQuota: 1 << 30}
+	if err := quota.SetQuotaLimits("/media/user1", limits); err != nil {
+		t.Fatalf("SetQuotaLimits failed: %v", err)
+	}
+	info, err := quota.GetQuota("/media/user1")
+	if err != nil {
+		t.Fatalf("GetQuota failed: %v", err)
+	}
+	if info.RtQuota != 1<<30 {
+		t.Errorf("Expected RtQuota 1GiB, got %d", info.RtQuota)
+	}
+	if err := quota.SetQuotaLimits("/ext4/user1", limits); err == nil {
+		t.Error("Expected realtime quota on ext4 to fail")
+	}
+}
+
+func TestFakeBackendTrackAndList(t *testing.T) {
+	fake, quota := newFakeQuota()
+
+	if err := quota.Track("/data/tracked"); err != nil {
+		t.Fatalf("Track failed: %v", err)
+	}
+	mustSetQuota(t, quota, "/data/limited", "1MiB", "0")
+	// Usage of a tracked path is accounted but not capped
+	if err := fake.Write("/data/tracked/big", 1<<30); err != nil {
+		t.Fatalf("Write to tracked path failed: %v", err)
+	}
+
+	entries, err := quota.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+	if entries[0].Path != "/data/limited" || !entries[0].Size.HasLimits() {
+		t.Errorf("Expected /data/limited with limits, got %+v", entries[0])
+	}
+	if entries[1].Path != "/data/tracked" || entries[1].Size.HasLimits() {
+		t.Errorf("Expected /data/tracked without limits, got %+v", entries[1])
+	}
+	if entries[1].Size.QuotaUsed != 1<<30 {
+		t.Errorf("Expected tracked usage 1GiB, got %d", entries[1].Size.QuotaUsed)
+	}
+	if entries[0].ID == entries[1].ID {
+		t.Errorf("Expected distinct project ids, got %d", entries[0].ID)
+	}
+}
+
+func TestFakeBackendErrorKinds(t *testing.T) {
+	fake, quota := newFakeQuota()
+	fake.AddMount("/proc", "proc")
+	fake.AddMount("/acct", "xfs").Options = "rw,pqnoenforce"
+
+	if err := quota.SetQuota("/proc/user1", "1MiB", "0"); !errors.Is(err, api.ErrNotXFS) {
+		t.Errorf("Expected ErrNotXFS, got %v", err)
+	}
+	if err := quota.SetQuota("/acct/user1", "1MiB", "0"); !errors.Is(err, api.ErrNotEnforced) {
+		t.Errorf("Expected ErrNotEnforced, got %v", err)
+	}
+	// Older kernels fail quotactl with ENOSYS when quota is off
+	fake.AddMount("/noquota", "xfs").Options = "rw"
+	if err := quota.SetQuota("/noquota/user1", "1MiB", "0"); !errors.Is(err, api.ErrQuotaDisabled) ||
+		!errors.Is(err, unix.ENOSYS) {
+		t.Errorf("Expected ErrQuotaDisabled, got %v", err)
+	}
+	// Usage is still accounted without limits
+	if err := quota.Track("/acct/user1"); err != nil {
+		t.Errorf("Track failed: %v", err)
+	}
+}
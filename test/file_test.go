@@ -0,0 +1,41 @@
+package test
+
+import (
+	"errors"
+	"testing"
+
+	"xfsquotas/api"
+)
+
+// unreadableProjects makes reading /etc/projects of a FakeBackend fail
+type unreadableProjects struct {
+	*api.FakeBackend
+	fail bool
+}
+
+func (b *unreadableProjects) ReadFile(name string) ([]byte, error) {
+	if b.fail && name == "/etc/projects" {
+		return nil, errors.New("input/output error")
+	}
+	return b.FakeBackend.ReadFile(name)
+}
+
+func TestFakeBackendUnreadableProjectFiles(t *testing.T) {
+	backend := &unreadableProjects{FakeBackend: api.NewFakeBackend()}
+	quota := api.NewQuotaManager(api.WithBackend(backend))
+	mustSetQuota(t, quota, "/data/user1", "1MiB", "0")
+
+	// Nothing is recorded from the records that couldn't be read
+	backend.fail = true
+	if err := quota.SetQuota("/data/user2", "1MiB", "0"); err == nil {
+		t.Error("Expected SetQuota to fail")
+	}
+	if _, err := quota.List(); err == nil {
+		t.Error("Expected List to fail")
+	}
+	backend.fail = false
+	entries, err := quota.List()
+	if err != nil || len(entries) != 1 || entries[0].Path != "/data/user1" {
+		t.Errorf("Expected only /data/user1 to be recorded, got %+v, %v", entries, err)
+	}
+}
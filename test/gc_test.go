@@ -0,0 +1,71 @@
+package test
+
+import (
+	"testing"
+
+	"xfsquotas/api"
+)
+
+func TestFakeBackendGC(t *testing.T) {
+	fake, quota := newFakeQuota()
+	for _, path := range []string{"/data/user1", "/data/user2"} {
+		mustSetQuota(t, quota, path, "1MiB", "0")
+	}
+	// user1 is removed without clean
+	if err := fake.SetProjectID("/data/user1", 0); err != nil {
+		t.Fatalf("SetProjectID failed: %v", err)
+	}
+
+	dryRun := api.NewQuotaManager(api.WithBackend(fake), api.WithDryRun())
+	removed, err := dryRun.GC()
+	if err != nil || len(removed) != 1 || removed[0] != "/data/user1" {
+		t.Fatalf("Unexpected dry run gc %v, %v", removed, err)
+	}
+	if plans := dryRun.Plans(); len(plans) != 1 || plans[0].Op != "gc" {
+		t.Errorf("Unexpected plans %+v", plans)
+	}
+	if entries, _ := quota.List(); len(entries) != 2 {
+		t.Errorf("Expected the dry run to keep both paths, got %+v", entries)
+	}
+
+	removed, err = quota.GC()
+	if err != nil || len(removed) != 1 || removed[0] != "/data/user1" {
+		t.Fatalf("Unexpected gc %v, %v", removed, err)
+	}
+	entries, _ := quota.List()
+	if len(entries) != 1 || entries[0].Path != "/data/user2" {
+		t.Errorf("Expected only /data/user2 to be left, got %+v", entries)
+	}
+	mustSetQuota(t, quota, "/data/user3", "1MiB", "0")
+	// The id of the stale path is free again
+	if id, _ := fake.GetProjectID("/data/user3"); id != 1048577 {
+		t.Errorf("Expected the released id 1048577, got %d", id)
+	}
+}
+
+func TestFakeBackendGCUnmounted(t *testing.T) {
+	for _, opts := range [][]api.Option{nil, {api.WithMountRegistry()}} {
+		fake, quota := newFakeQuota(opts...)
+		fake.AddMount("/disk2", "xfs")
+		for _, path := range []string{"/data/user1", "/disk2/user2"} {
+			mustSetQuota(t, quota, path, "1MiB", "0")
+		}
+		fake.RemoveDir("/data/user1")
+		fake.RemoveMount("/disk2")
+
+		// Only the removed directory is gone, /disk2/user2 is just
+		// not mounted
+		removed, err := quota.GC()
+		if err != nil || len(removed) != 1 || removed[0] != "/data/user1" {
+			t.Fatalf("Unexpected gc %v, %v with %d options", removed, err, len(opts))
+		}
+		fake.AddMount("/disk2", "xfs")
+		if removed, err := quota.GC(); err != nil || len(removed) != 0 {
+			t.Errorf("Expected nothing to be removed, got %v, %v", removed, err)
+		}
+		entries, err := quota.List()
+		if err != nil || len(entries) != 1 || entries[0].Path != "/disk2/user2" || entries[0].Size.Quota != 1<<20 {
+			t.Errorf("Expected /disk2/user2 to be kept with its limit, got %+v, %v", entries, err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"xfsquotas/api"
+)
+
+func TestFakeBackendImport(t *testing.T) {
+	fake, quota := newFakeQuota()
+
+	// Projects set up by hand with xfs_quota -x -c 'project -s'
+	fake.WriteFile("/etc/projects", []byte("42:/data/tenant-a\n43:/data/./tenant-b\n44:/data/tenant-c\n"))
+	fake.WriteFile("/etc/projid", []byte("tenant-a:42\ntenant-b:43\n"))
+	fake.SetProjectID("/data/tenant-a", 42)
+	fake.SetProjectID("/data/tenant-c", 99)
+	mnt, _ := fake.FindMount("/")
+	fake.SetQuota(mnt, 42, &api.DiskQuotaSize{Quota: 1 << 20})
+	fake.SetQuota(mnt, 77, &api.DiskQuotaSize{Quota: 2 << 20})
+
+	result, err := quota.Import(api.ImportSource{})
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if len(result.Imported) != 2 || result.Imported[0].Path != "/data/tenant-a" || result.Imported[1].Path != "/data/tenant-b" {
+		t.Fatalf("Unexpected imported paths %+v", result.Imported)
+	}
+	if result.Imported[0].Size.Quota != 1<<20 {
+		t.Errorf("Expected the limits of project 42, got %+v", result.Imported[0].Size)
+	}
+	if len(result.Skipped) != 1 || result.Skipped[0].Path != "/data/tenant-c" {
+		t.Errorf("Expected the retagged tenant-c to be skipped, got %+v", result.Skipped)
+	} else if !strings.Contains(result.Skipped[0].Reason, "tagged with project 99") {
+		t.Errorf("Unexpected reason %q", result.Skipped[0].Reason)
+	}
+	if len(result.Unrecorded) != 1 || result.Unrecorded[0].ID != 77 {
+		t.Errorf("Expected project 77 to be reported, got %+v", result.Unrecorded)
+	}
+	// The untagged tree is tagged
+	if id, _ := fake.GetProjectID("/data/tenant-b"); id != 43 {
+		t.Errorf("Expected /data/tenant-b to be tagged with 43, got %d", id)
+	}
+
+	// Imported paths keep their ids, new ones don't clobber them
+	mustSetQuota(t, quota, "/data/tenant-a", "4MiB", "0")
+	mustSetQuota(t, quota, "/data/user1", "1MiB", "0")
+	size, err := quota.GetQuotaByName("tenant-a")
+	if err != nil || size.Quota != 4<<20 {
+		t.Errorf("Expected tenant-a to keep project 42, got %+v, %v", size, err)
+	}
+	entries, err := quota.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	ids := make(map[string]uint32)
+	for _, entry := range entries {
+		ids[entry.Path] = entry.ID
+	}
+	if ids["/data/tenant-a"] != 42 || ids["/data/tenant-b"] != 43 || ids["/data/user1"] == 0 {
+		t.Errorf("Unexpected ids after import %+v", ids)
+	}
+	if _, exists := ids["/data/./tenant-b"]; exists {
+		t.Errorf("Expected the unresolved path to be replaced, got %+v", ids)
+	}
+}
+
+func TestFakeBackendImportProjectsFile(t *testing.T) {
+	fake, quota := newFakeQuota()
+
+	// Only the projid file is given, the paths are in the configured
+	// projects file
+	fake.WriteFile("/etc/projects", []byte("42:/data/tenant-a\n"))
+	fake.WriteFile("/backup/projid", []byte("tenant-a:42\n"))
+	result, err := quota.Import(api.ImportSource{ProjidPath: "/backup/projid"})
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if len(result.Imported) != 1 || result.Imported[0].Path != "/data/tenant-a" ||
+		result.Imported[0].Name != "tenant-a" {
+		t.Fatalf("Unexpected imported projects %+v", result.Imported)
+	}
+}
+
+func TestFakeBackendImportWithoutDevices(t *testing.T) {
+	fake, quota := newFakeQuota()
+	disk2 := fake.AddMount("/disk2", "xfs")
+	clearDevices(t, fake, "/", "/disk2")
+	fake.WriteFile("/etc/projects", []byte("42:/data/tenant-a\n"))
+	fake.WriteFile("/etc/projid", []byte("tenant-a:42\n"))
+	// The id recorded on / is used by nothing recorded on /disk2
+	fake.SetQuota(disk2, 42, &api.DiskQuotaSize{Quota: 1 << 20})
+
+	result, err := quota.Import(api.ImportSource{Mounts: []string{"/disk2"}})
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if len(result.Imported) != 1 {
+		t.Fatalf("Unexpected imported paths %+v", result.Imported)
+	}
+	if len(result.Unrecorded) != 1 || result.Unrecorded[0].ID != 42 || result.Unrecorded[0].Mount != "/disk2" {
+		t.Errorf("Expected project 42 of /disk2 to be reported, got %+v", result.Unrecorded)
+	}
+}
@@ -0,0 +1,227 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"xfsquotas/internal/project"
+
+	"golang.org/x/sys/unix"
+)
+
+// imageSize is the size of the sparse loopback image, recent xfsprogs
+// refuse to create filesystems smaller than 300MiB
+const imageSize = 320 << 20
+
+// mkfsArgs are the mkfs arguments for each filesystem type under test
+var mkfsArgs = map[string][]string{
+	"xfs":  {"-q"},
+	"ext4": {"-q", "-F", "-O", "quota,project", "-I", "256"},
+}
+
+// forEachFilesystem runs test as a subtest on each supported filesystem
+func forEachFilesystem(t *testing.T, test func(t *testing.T, mnt string)) {
+	for _, fsType := range []string{"xfs", "ext4"} {
+		t.Run(fsType, func(t *testing.T) {
+			test(t, setupFilesystem(t, fsType))
+		})
+	}
+}
+
+// setupFilesystem creates a sparse image, formats it with mkfs and
+// loop-mounts it with prjquota. The filesystem is unmounted and removed when
+// the test finishes. Tests are skipped when not run as root or without mkfs.
+func setupFilesystem(t *testing.T, fsType string) string {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("integration tests need root")
+	}
+	for _, tool := range []string{"mkfs." + fsType, "mount", "umount"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found: %v", tool, err)
+		}
+	}
+
+	dir := t.TempDir()
+	image := filepath.Join(dir, fsType+".img")
+	file, err := os.Create(image)
+	if err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+	if err := file.Truncate(imageSize); err != nil {
+		file.Close()
+		t.Fatalf("failed to size image: %v", err)
+	}
+	file.Close()
+
+	args := append(append([]string{}, mkfsArgs[fsType]...), image)
+	if out, err := exec.Command("mkfs."+fsType, args...).CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.%s failed: %v: %s", fsType, err, out)
+	}
+	mnt := filepath.Join(dir, "mnt")
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		t.Fatalf("failed to create mount point: %v", err)
+	}
+	if out, err := exec.Command("mount", "-o", "loop,prjquota", image, mnt).CombinedOutput(); err != nil {
+		t.Skipf("loop mount not available: %v: %s", err, out)
+	}
+	// Cleanups run in reverse order, so this unmounts before the temp dir
+	// is removed
+	t.Cleanup(func() {
+		if out, err := exec.Command("umount", "-d", mnt).CombinedOutput(); err != nil {
+			t.Errorf("umount %s failed: %v: %s", mnt, err, out)
+		}
+	})
+	return mnt
+}
+
+// newTestQuota creates a ProjectQuota recording projects in the test's temp
+// dir instead of /etc
+func newTestQuota(t *testing.T) *project.ProjectQuota {
+	t.Helper()
+	dir := t.TempDir()
+	return project.NewProjectQuota(project.WithProjectFiles(
+		filepath.Join(dir, "projects"), filepath.Join(dir, "projid")))
+}
+
+// fill writes to path in 1MiB chunks until the write fails or limit bytes
+// have been written
+func fill(path string, limit int) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	chunk := bytes.Repeat([]byte{'x'}, 1<<20)
+	for written := 0; written < limit; written += len(chunk) {
+		if _, err := file.Write(chunk); err != nil {
+			return err
+		}
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestIntegrationSetGetClean(t *testing.T) {
+	forEachFilesystem(t, testIntegrationSetGetClean)
+}
+
+func testIntegrationSetGetClean(t *testing.T, mnt string) {
+	quota := newTestQuota(t)
+	dir := filepath.Join(mnt, "user1")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := quota.SetQuota(dir, &project.DiskQuotaSize{Quota: 8 << 20, Inodes: 100}); err != nil {
+		t.Fatalf("SetQuota failed: %v", err)
+	}
+	if err := fill(filepath.Join(dir, "file"), 1<<20); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	info, err := quota.GetQuota(dir)
+	if err != nil {
+		t.Fatalf("GetQuota failed: %v", err)
+	}
+	if info.Quota != 8<<20 || info.Inodes != 100 {
+		t.Errorf("Expected limits 8MiB/100, got %d/%d", info.Quota, info.Inodes)
+	}
+	if info.QuotaUsed < 1<<20 || info.InodesUsed < 2 {
+		t.Errorf("Expected usage of at least 1MiB/2, got %d/%d", info.QuotaUsed, info.InodesUsed)
+	}
+
+	if err := quota.ClearQuota(dir); err != nil {
+		t.Fatalf("ClearQuota failed: %v", err)
+	}
+	info, err = quota.GetQuota(dir)
+	if err != nil {
+		t.Fatalf("GetQuota after clean failed: %v", err)
+	}
+	if info.Quota != 0 || info.Inodes != 0 {
+		t.Errorf("Expected limits to be cleared, got %d/%d", info.Quota, info.Inodes)
+	}
+}
+
+func TestIntegrationEDQUOT(t *testing.T) {
+	forEachFilesystem(t, testIntegrationEDQUOT)
+}
+
+func testIntegrationEDQUOT(t *testing.T, mnt string) {
+	quota := newTestQuota(t)
+	dir := filepath.Join(mnt, "user1")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := quota.SetQuota(dir, &project.DiskQuotaSize{Quota: 4 << 20}); err != nil {
+		t.Fatalf("SetQuota failed: %v", err)
+	}
+	err := fill(filepath.Join(dir, "file"), 16<<20)
+	if !errors.Is(err, unix.EDQUOT) {
+		t.Fatalf("Expected EDQUOT, got %v", err)
+	}
+}
+
+func TestIntegrationRecursive(t *testing.T) {
+	forEachFilesystem(t, testIntegrationRecursive)
+}
+
+func testIntegrationRecursive(t *testing.T, mnt string) {
+	quota := newTestQuota(t)
+	dir := filepath.Join(mnt, "user1")
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Content created before the quota is set must be accounted too
+	if err := fill(filepath.Join(dir, "a", "b", "file"), 2<<20); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	if err := quota.SetQuota(dir, &project.DiskQuotaSize{Quota: 8 << 20}); err != nil {
+		t.Fatalf("SetQuota failed: %v", err)
+	}
+	info, err := quota.GetQuota(dir)
+	if err != nil {
+		t.Fatalf("GetQuota failed: %v", err)
+	}
+	if info.QuotaUsed < 2<<20 || info.InodesUsed < 4 {
+		t.Errorf("Expected existing content to be accounted, got %d bytes/%d inodes",
+			info.QuotaUsed, info.InodesUsed)
+	}
+}
+
+func TestIntegrationTrackAndList(t *testing.T) {
+	forEachFilesystem(t, testIntegrationTrackAndList)
+}
+
+func testIntegrationTrackAndList(t *testing.T, mnt string) {
+	quota := newTestQuota(t)
+	dir := filepath.Join(mnt, "tracked")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := quota.TrackQuota(dir); err != nil {
+		t.Fatalf("TrackQuota failed: %v", err)
+	}
+	if err := fill(filepath.Join(dir, "file"), 2<<20); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	entries, err := quota.ListQuotas()
+	if err != nil {
+		t.Fatalf("ListQuotas failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Path != dir {
+		t.Fatalf("Expected %s to be listed, got %+v", dir, entries)
+	}
+	if entries[0].Size.HasLimits() || entries[0].Size.QuotaUsed < 2<<20 {
+		t.Errorf("Expected unlimited usage of at least 2MiB, got %+v", entries[0].Size)
+	}
+}
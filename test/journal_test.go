@@ -0,0 +1,171 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"xfsquotas/api"
+	"xfsquotas/internal/mount"
+)
+
+// faultyBackend makes SetQuota of a FakeBackend fail or, to simulate a
+// crash, panic
+type faultyBackend struct {
+	*api.FakeBackend
+	fail  bool
+	crash bool
+}
+
+func (b *faultyBackend) SetQuota(mnt *mount.Mount, id uint32, size *api.DiskQuotaSize) error {
+	if b.crash {
+		panic("crash")
+	}
+	if b.fail {
+		return errors.New("quotactl failed")
+	}
+	return b.FakeBackend.SetQuota(mnt, id, size)
+}
+
+func TestFakeBackendSetRollback(t *testing.T) {
+	backend := &faultyBackend{FakeBackend: api.NewFakeBackend(), fail: true}
+	quota := api.NewQuotaManager(api.WithBackend(backend))
+
+	if err := quota.SetQuota("/data/user1", "1MiB", "0"); err == nil {
+		t.Fatal("Expected SetQuota to fail")
+	}
+	// The directory is untagged and its record removed again
+	if id, _ := backend.GetProjectID("/data/user1"); id != 0 {
+		t.Errorf("Expected the project id to be rolled back, got %d", id)
+	}
+	if entries, _ := quota.List(); len(entries) != 0 {
+		t.Errorf("Expected no recorded paths, got %+v", entries)
+	}
+	if journals, err := quota.Recover(false); len(journals) != 0 || err != nil {
+		t.Errorf("Expected no journal to be left, got %+v, %v", journals, err)
+	}
+}
+
+func TestFakeBackendNestedProjects(t *testing.T) {
+	fake, quota := newFakeQuota()
+	mustSetQuota(t, quota, "/mnt/a", "1MiB", "0")
+	nested, _ := fake.GetProjectID("/mnt/a")
+
+	// Setting and cleaning the parent leaves the nested project alone
+	mustSetQuota(t, quota, "/mnt", "4MiB", "0")
+	parent, _ := fake.GetProjectID("/mnt")
+	if id, _ := fake.GetProjectID("/mnt/a/dir"); id != nested || parent == nested {
+		t.Errorf("Expected /mnt/a to keep project %d, got %d", nested, id)
+	}
+	if id, _ := fake.GetProjectID("/mnt/b"); id != parent {
+		t.Errorf("Expected /mnt/b to be tagged with %d, got %d", parent, id)
+	}
+	if err := quota.CleanQuota("/mnt"); err != nil {
+		t.Fatalf("CleanQuota failed: %v", err)
+	}
+	if id, _ := fake.GetProjectID("/mnt/a"); id != nested {
+		t.Errorf("Expected /mnt/a to keep project %d after clean, got %d", nested, id)
+	}
+	if removed, err := quota.GC(); err != nil || len(removed) != 0 {
+		t.Errorf("Expected gc to keep /mnt/a, got %v, %v", removed, err)
+	}
+
+	// A rollback gives each subtree its own id back
+	fake.SetProjectID("/mnt/c", 42)
+	faulty := &faultyBackend{FakeBackend: fake, fail: true}
+	if err := api.NewQuotaManager(api.WithBackend(faulty)).SetQuota("/mnt", "4MiB", "0"); err == nil {
+		t.Fatal("Expected SetQuota to fail")
+	}
+	for path, want := range map[string]uint32{"/mnt": 0, "/mnt/a": nested, "/mnt/c": 42} {
+		if id, _ := fake.GetProjectID(path); id != want {
+			t.Errorf("Expected %s to be tagged with %d after the rollback, got %d", path, want, id)
+		}
+	}
+}
+
+func TestFakeBackendRecover(t *testing.T) {
+	for _, rollback := range []bool{false, true} {
+		backend := &faultyBackend{FakeBackend: api.NewFakeBackend(), crash: true}
+		quota := api.NewQuotaManager(api.WithBackend(backend))
+		func() {
+			defer func() { recover() }()
+			quota.SetQuota("/data/user1", "1MiB", "0")
+		}()
+		if err := quota.Track("/data/user2"); err == nil {
+			t.Error("Expected operations to be refused before recovery")
+		}
+
+		backend.crash = false
+		journals, err := quota.Recover(rollback)
+		if err != nil || len(journals) != 1 || journals[0].Op != "set" || journals[0].Path != "/data/user1" {
+			t.Fatalf("Unexpected recovery %+v, %v", journals, err)
+		}
+		id, _ := backend.GetProjectID("/data/user1")
+		info, err := quota.GetQuota("/data/user1")
+		if err != nil {
+			t.Fatalf("GetQuota failed: %v", err)
+		}
+		if rollback && (id != 0 || info.Quota != 0) {
+			t.Errorf("Expected the set to be rolled back, got id %d, quota %d", id, info.Quota)
+		}
+		if !rollback && (id == 0 || info.Quota != 1<<20) {
+			t.Errorf("Expected the set to be finished, got id %d, quota %d", id, info.Quota)
+		}
+		if err := quota.Track("/data/user2"); err != nil {
+			t.Errorf("Track after recovery failed: %v", err)
+		}
+	}
+}
+
+// partialTagger makes retagging with a FakeBackend stop halfway, leaving
+// the directories of left as they were, and crash
+type partialTagger struct {
+	*api.FakeBackend
+	left []string
+}
+
+func (b *partialTagger) SetProjectIDSkipping(ctx context.Context, path string, id uint32, skip []string) error {
+	if b.left == nil {
+		return b.FakeBackend.SetProjectIDSkipping(ctx, path, id, skip)
+	}
+	if err := b.FakeBackend.SetProjectIDSkipping(ctx, path, id, append(append([]string{}, skip...), b.left...)); err != nil {
+		return err
+	}
+	panic("crash")
+}
+
+func TestFakeBackendRecoverPartialRetag(t *testing.T) {
+	crash := func(f func()) {
+		defer func() { recover() }()
+		f()
+	}
+
+	// Redoing finishes the retag of the directories left behind
+	backend := &partialTagger{FakeBackend: api.NewFakeBackend(), left: []string{"/data/user1/sub"}}
+	quota := api.NewQuotaManager(api.WithBackend(backend))
+	crash(func() { quota.SetQuota("/data/user1", "1MiB", "0") })
+	backend.left = nil
+	if _, err := quota.Recover(false); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	id, _ := backend.GetProjectID("/data/user1")
+	if sub, _ := backend.GetProjectID("/data/user1/sub"); id == 0 || sub != id {
+		t.Errorf("Expected /data/user1/sub to be tagged with %d, got %d", id, sub)
+	}
+
+	// Rolling back after a rollback that stopped halfway untags them too
+	backend = &partialTagger{FakeBackend: api.NewFakeBackend(), left: []string{}}
+	quota = api.NewQuotaManager(api.WithBackend(backend))
+	crash(func() { quota.SetQuota("/data/user1", "1MiB", "0") })
+	backend.left = []string{"/data/user1/sub"}
+	crash(func() { quota.Recover(true) })
+	backend.left = nil
+	if _, err := quota.Recover(true); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	for _, path := range []string{"/data/user1", "/data/user1/sub"} {
+		if id, _ := backend.GetProjectID(path); id != 0 {
+			t.Errorf("Expected %s to be untagged, got %d", path, id)
+		}
+	}
+}
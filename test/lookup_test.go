@@ -0,0 +1,48 @@
+package test
+
+import (
+	"errors"
+	"testing"
+
+	"xfsquotas/api"
+)
+
+func TestFakeBackendGetByIDAndName(t *testing.T) {
+	_, quota := newFakeQuota()
+
+	mustSetQuota(t, quota, "/data/user1", "1MiB", "10")
+	entries, err := quota.List()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("List failed: %+v, %v", entries, err)
+	}
+	byID, err := quota.GetQuotaByID("/", entries[0].ID)
+	if err != nil {
+		t.Fatalf("GetQuotaByID failed: %v", err)
+	}
+	if byID.Quota != 1<<20 || byID.Inodes != 10 {
+		t.Errorf("Unexpected quota by id %+v", byID)
+	}
+	byName, err := quota.GetQuotaByName(entries[0].Name)
+	if err != nil {
+		t.Fatalf("GetQuotaByName failed: %v", err)
+	}
+	if *byName != *byID {
+		t.Errorf("Expected the same quota by name and id, got %+v and %+v", byName, byID)
+	}
+	if _, err := quota.GetQuotaByName("unknown"); !errors.Is(err, api.ErrProjectNotFound) {
+		t.Errorf("Expected ErrProjectNotFound, got %v", err)
+	}
+}
+
+func TestFakeBackendGetByNameWithoutDevices(t *testing.T) {
+	fake, quota := newFakeQuota()
+	fake.AddMount("/disk2", "xfs")
+	clearDevices(t, fake, "/", "/disk2")
+	fake.WriteFile("/etc/projects", []byte("42:/data/a\n42:/disk2/b\n"))
+	fake.WriteFile("/etc/projid", []byte("shared:42\n"))
+
+	// The project is on two filesystems, its quota is ambiguous
+	if size, err := quota.GetQuotaByName("shared"); err == nil {
+		t.Errorf("Expected the project on two filesystems to be refused, got %+v", size)
+	}
+}
@@ -0,0 +1,204 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"xfsquotas/internal/mount"
+
+	"golang.org/x/sys/unix"
+)
+
+// writeMountInfo writes a single mountinfo line mounting dir with fsType
+func writeMountInfo(t *testing.T, file, dir, fsType string) {
+	t.Helper()
+	var stat unix.Stat_t
+	if err := unix.Stat(dir, &stat); err != nil {
+		t.Fatal(err)
+	}
+	line := fmt.Sprintf("36 35 %d:%d / %s rw,relatime shared:1 - %s /dev/test rw,prjquota\n",
+		unix.Major(stat.Dev), unix.Minor(stat.Dev), dir, fsType)
+	if err := os.WriteFile(file, []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMountCacheRefresh(t *testing.T) {
+	dir := t.TempDir()
+	mountInfo := filepath.Join(t.TempDir(), "mountinfo")
+	writeMountInfo(t, mountInfo, dir, "xfs")
+
+	cache := mount.NewCache(mountInfo)
+	defer cache.Close()
+	mnt, err := cache.FindMount(dir)
+	if err != nil {
+		t.Fatalf("FindMount failed: %v", err)
+	}
+	if mnt.Path != dir || mnt.FilesystemType != "xfs" {
+		t.Errorf("Expected xfs mount at %s, got %+v", dir, mnt)
+	}
+
+	// A regular file raises no POLLPRI, the change is only seen on Refresh
+	writeMountInfo(t, mountInfo, dir, "ext4")
+	if mnt, _ := cache.FindMount(dir); mnt.FilesystemType != "xfs" {
+		t.Errorf("Expected cached xfs mount, got %s", mnt.FilesystemType)
+	}
+	if err := cache.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if mnt, _ := cache.FindMount(dir); mnt.FilesystemType != "ext4" {
+		t.Errorf("Expected refreshed ext4 mount, got %s", mnt.FilesystemType)
+	}
+}
+
+func TestMountCacheInvalidation(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting needs root")
+	}
+	dir := t.TempDir()
+	cache := mount.NewCache("/proc/self/mountinfo")
+	defer cache.Close()
+	if _, err := cache.FindMount(dir); err != nil {
+		t.Fatalf("FindMount failed: %v", err)
+	}
+
+	if out, err := exec.Command("mount", "-t", "tmpfs", "tmpfs", dir).CombinedOutput(); err != nil {
+		t.Skipf("mount not available: %v: %s", err, out)
+	}
+	defer exec.Command("umount", dir).Run()
+
+	// The new mount is picked up without an explicit Refresh
+	mnt, err := cache.FindMount(dir)
+	if err != nil {
+		t.Fatalf("FindMount failed: %v", err)
+	}
+	if mnt.Path != dir || mnt.FilesystemType != "tmpfs" {
+		t.Errorf("Expected tmpfs mount at %s, got %+v", dir, mnt)
+	}
+}
+
+func TestMountCacheHostRoot(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "data")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var stat unix.Stat_t
+	if err := unix.Stat(dir, &stat); err != nil {
+		t.Fatal(err)
+	}
+	sysBlock := filepath.Join(root, "sys", "dev", "block")
+	if err := os.MkdirAll(sysBlock, 0755); err != nil {
+		t.Fatal(err)
+	}
+	devNum := fmt.Sprintf("%d:%d", unix.Major(stat.Dev), unix.Minor(stat.Dev))
+	if err := os.Symlink("../../devices/virtual/block/sdz", filepath.Join(sysBlock, devNum)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The host's mountinfo lists host paths
+	mountInfo := filepath.Join(t.TempDir(), "mountinfo")
+	line := fmt.Sprintf("36 35 %s / /data rw - xfs /dev/sdz rw,prjquota\n", devNum)
+	if err := os.WriteFile(mountInfo, []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := mount.NewHostCache(root, mountInfo)
+	defer cache.Close()
+	mnt, err := cache.FindMount("/data")
+	if err != nil {
+		t.Fatalf("FindMount failed: %v", err)
+	}
+	if mnt.Path != "/data" {
+		t.Errorf("Expected host mount path /data, got %s", mnt.Path)
+	}
+	// Without a block device node of the right number no device is reported
+	if mnt.Device != "" {
+		t.Errorf("Expected no device without a device node, got %s", mnt.Device)
+	}
+
+	devDir := filepath.Join(root, "dev")
+	if err := os.Mkdir(devDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mknod(filepath.Join(devDir, "sdz"), unix.S_IFBLK|0600, int(stat.Dev)); err != nil {
+		t.Skipf("can't create block device node: %v", err)
+	}
+	if err := cache.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	mnt, err = cache.FindMount("/data")
+	if err != nil {
+		t.Fatalf("FindMount failed: %v", err)
+	}
+	if want := filepath.Join(devDir, "sdz"); mnt.Device != want {
+		t.Errorf("Expected device %s, got %s", want, mnt.Device)
+	}
+}
+
+func TestMountCacheOverlay(t *testing.T) {
+	dir := t.TempDir()
+	var stat unix.Stat_t
+	if err := unix.Stat(dir, &stat); err != nil {
+		t.Fatal(err)
+	}
+	mountInfo := filepath.Join(t.TempDir(), "mountinfo")
+	line := fmt.Sprintf("36 35 %d:%d / %s rw - overlay overlay "+
+		"rw,lowerdir=/l1:/l2,upperdir=/var/lib/c\\0541/upper,workdir=/var/lib/c1/work\n",
+		unix.Major(stat.Dev), unix.Minor(stat.Dev), dir)
+	if err := os.WriteFile(mountInfo, []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := mount.NewCache(mountInfo)
+	defer cache.Close()
+	mnt, err := cache.FindMount(dir)
+	if err != nil {
+		t.Fatalf("FindMount failed: %v", err)
+	}
+	if mnt.UpperDir != "/var/lib/c,1/upper" || mnt.WorkDir != "/var/lib/c1/work" {
+		t.Errorf("Unexpected overlay dirs upper=%q work=%q", mnt.UpperDir, mnt.WorkDir)
+	}
+}
+
+func TestMountCacheBindMount(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "bind", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var stat unix.Stat_t
+	if err := unix.Stat(dir, &stat); err != nil {
+		t.Fatal(err)
+	}
+	// /data of the filesystem mounted at dir is bind mounted at dir/bind
+	mountInfo := filepath.Join(t.TempDir(), "mountinfo")
+	devNum := fmt.Sprintf("%d:%d", unix.Major(stat.Dev), unix.Minor(stat.Dev))
+	lines := fmt.Sprintf("36 35 %s / %s rw - xfs /dev/sdz rw,prjquota\n", devNum, dir) +
+		fmt.Sprintf("37 36 %s /data %s/bind rw - xfs /dev/sdz rw,prjquota\n", devNum, dir)
+	if err := os.WriteFile(mountInfo, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := mount.NewCache(mountInfo)
+	defer cache.Close()
+	path := filepath.Join(dir, "bind", "sub")
+	mnt, err := cache.FindMount(path)
+	if err != nil {
+		t.Fatalf("FindMount failed: %v", err)
+	}
+	if mnt.Path != filepath.Join(dir, "bind") || mnt.Subtree != "/data" {
+		t.Errorf("Expected bind mount %s/bind of /data, got %s of %s", dir, mnt.Path, mnt.Subtree)
+	}
+	if mnt.Main == nil || mnt.Main.Path != dir {
+		t.Fatalf("Expected main mount %s, got %+v", dir, mnt.Main)
+	}
+	if fsPath, err := mnt.FilesystemPath(path); err != nil || fsPath != "/data/sub" {
+		t.Errorf("Expected filesystem path /data/sub, got %s (%v)", fsPath, err)
+	}
+	if want := filepath.Join(dir, "data", "sub"); mnt.CanonicalPath(path) != want {
+		t.Errorf("Expected canonical path %s, got %s", want, mnt.CanonicalPath(path))
+	}
+}
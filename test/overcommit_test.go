@@ -0,0 +1,76 @@
+package test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"xfsquotas/api"
+)
+
+func TestFakeBackendOverCommit(t *testing.T) {
+	fake, quota := newFakeQuota(
+		api.WithOverCommitPolicy(api.OverCommitPolicy{Mode: api.OverCommitReject, Ratio: 1.5}))
+	fake.SetCapacity("/", 10<<20, 1000)
+
+	mustSetQuota(t, quota, "/data/user1", "8MiB", "0")
+	// A project nobody recorded counts too
+	mnt, _ := fake.FindMount("/")
+	fake.SetQuota(mnt, 77, &api.DiskQuotaSize{Quota: 4 << 20})
+
+	err := quota.SetQuota("/data/user2", "4MiB", "0")
+	if !errors.Is(err, api.ErrOverCommitted) {
+		t.Fatalf("Expected ErrOverCommitted, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "from 12MiB to 16MiB, 160% of its 10MiB capacity, over the allowed 150%") {
+		t.Errorf("Expected the decision to be explained, got %q", err)
+	}
+	if id, _ := fake.GetProjectID("/data/user2"); id != 0 {
+		t.Errorf("Expected /data/user2 to be left alone, got project %d", id)
+	}
+	if err := quota.SetQuota("/data/user2", "3MiB", "0"); err != nil {
+		t.Errorf("Expected 150%% to be allowed, got %v", err)
+	}
+	// Lowering a limit is always allowed
+	if err := quota.SetQuota("/data/user1", "7MiB", "0"); err != nil {
+		t.Errorf("Expected a lower limit to be allowed, got %v", err)
+	}
+
+	results, err := quota.ApplyBatch([]api.QuotaSpec{
+		{Path: "/data/user3", Size: &api.DiskQuotaSize{Quota: 1 << 20}},
+		{Path: "/data/user4", Size: &api.DiskQuotaSize{Quota: 1 << 20}},
+	}, api.ContinueOnError)
+	if err == nil || results[0].Err != nil || !errors.Is(results[1].Err, api.ErrOverCommitted) {
+		t.Fatalf("Expected only the second spec to over-commit, got %+v, %v", results, err)
+	}
+	if size, _ := quota.GetQuota("/data/user4"); size != nil && size.Quota != 0 {
+		t.Errorf("Expected no limit on /data/user4, got %+v", size)
+	}
+
+	warn := api.NewQuotaManager(api.WithBackend(fake),
+		api.WithOverCommitPolicy(api.OverCommitPolicy{Mode: api.OverCommitWarn}))
+	if err := warn.SetQuota("/data/user4", "10MiB", "0"); err != nil {
+		t.Errorf("Expected warn to set the limit, got %v", err)
+	}
+}
+
+func TestFakeBackendOverCommitWithoutDevices(t *testing.T) {
+	fake, quota := newFakeQuota(
+		api.WithOverCommitPolicy(api.OverCommitPolicy{Mode: api.OverCommitReject, Ratio: 1}))
+	fake.AddMount("/disk2", "xfs")
+	clearDevices(t, fake, "/", "/disk2")
+	fake.SetCapacity("/", 10<<20, 1000)
+	fake.SetCapacity("/disk2", 10<<20, 1000)
+
+	// Each filesystem commits its own capacity
+	results, err := quota.ApplyBatch([]api.QuotaSpec{
+		{Path: "/data/user1", Size: &api.DiskQuotaSize{Quota: 8 << 20}},
+		{Path: "/disk2/user2", Size: &api.DiskQuotaSize{Quota: 8 << 20}},
+	}, api.AllOrNothing)
+	if err != nil {
+		t.Fatalf("Expected both specs to fit, got %+v, %v", results, err)
+	}
+	if err := quota.SetQuota("/disk2/user3", "4MiB", "0"); !errors.Is(err, api.ErrOverCommitted) {
+		t.Errorf("Expected ErrOverCommitted, got %v", err)
+	}
+}
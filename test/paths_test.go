@@ -0,0 +1,146 @@
+package test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"xfsquotas/api"
+	"xfsquotas/internal/mount"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFakeBackendOverlay(t *testing.T) {
+	fake, quota := newFakeQuota()
+	overlay := fake.AddMount("/run/containers/c1/rootfs", "overlay")
+	overlay.UpperDir = "/var/lib/overlay/c1/upper"
+
+	if err := quota.SetQuota("/run/containers/c1/rootfs", "1MiB", "0"); err != nil {
+		t.Fatalf("SetQuota on overlay failed: %v", err)
+	}
+	// The quota is applied to the upper dir on the backing filesystem
+	id, _ := fake.GetProjectID("/var/lib/overlay/c1/upper")
+	if id == 0 {
+		t.Error("Expected upper dir to be tagged")
+	}
+	if err := fake.Write("/var/lib/overlay/c1/upper/file", 2<<20); !errors.Is(err, unix.EDQUOT) {
+		t.Errorf("Expected EDQUOT, got %v", err)
+	}
+	info, err := quota.GetQuota("/run/containers/c1/rootfs")
+	if err != nil {
+		t.Fatalf("GetQuota on overlay failed: %v", err)
+	}
+	if info.Quota != 1<<20 {
+		t.Errorf("Expected limit 1MiB, got %d", info.Quota)
+	}
+
+	// /usr is only in the image, it has no upper directory yet
+	fake.RemoveDir("/var/lib/overlay/c1/upper/usr")
+	err = quota.SetQuota("/run/containers/c1/rootfs/usr", "1MiB", "0")
+	if !errors.Is(err, api.ErrPathNotFound) || !strings.Contains(err.Error(), "only in a lower layer") {
+		t.Errorf("Expected the lower layer path to be explained, got %v", err)
+	}
+}
+
+func TestFakeBackendBindMount(t *testing.T) {
+	fake, quota := newFakeQuota()
+	if _, err := fake.AddBindMount("/mnt/volume", "/data/volumes/v1"); err != nil {
+		t.Fatalf("AddBindMount failed: %v", err)
+	}
+
+	if err := quota.SetQuota("/mnt/volume/user1", "1MiB", "0"); err != nil {
+		t.Fatalf("SetQuota through bind mount failed: %v", err)
+	}
+	// The canonical path is recorded and matched from either location
+	entries, err := quota.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Path != "/data/volumes/v1/user1" {
+		t.Fatalf("Expected canonical path to be recorded, got %+v", entries)
+	}
+	if err := fake.Write("/data/volumes/v1/user1/file", 2<<20); !errors.Is(err, unix.EDQUOT) {
+		t.Errorf("Expected EDQUOT, got %v", err)
+	}
+	if err := quota.CleanQuota("/data/volumes/v1/user1"); err != nil {
+		t.Fatalf("CleanQuota failed: %v", err)
+	}
+	if entries, _ := quota.List(); len(entries) != 0 {
+		t.Errorf("Expected no managed paths after clean, got %+v", entries)
+	}
+}
+
+func TestFakeBackendRelativePath(t *testing.T) {
+	fake, quota := newFakeQuota()
+
+	// Relative paths are relative to the working directory
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	mustSetQuota(t, quota, "d", "1MiB", "0")
+	if entries, _ := quota.List(); len(entries) != 1 || entries[0].Path != filepath.Join(dir, "d") {
+		t.Errorf("Expected %s to be recorded, got %+v", filepath.Join(dir, "d"), entries)
+	}
+	if id, _ := fake.GetProjectID("/d"); id != 0 {
+		t.Errorf("Expected /d to be left alone, got project %d", id)
+	}
+
+	mustSetQuota(t, quota, "/data/user1/../user2", "1MiB", "0")
+	if id, _ := fake.GetProjectID("/data/user2"); id == 0 {
+		t.Errorf("Expected /data/user2 to be tagged")
+	}
+	// .. can't escape the host's root
+	for path, want := range map[string]string{
+		"/../../etc/projects": "/host/etc/projects",
+		"../etc":              "/host/etc",
+		"/data/../..":         "/host",
+	} {
+		if got := mount.HostPath("/host", path); got != want {
+			t.Errorf("Expected %s under /host to be %s, got %s", path, want, got)
+		}
+	}
+}
+
+func TestFakeBackendRelativePathHostRoot(t *testing.T) {
+	root := t.TempDir()
+	fake, quota := newFakeQuota(api.WithHostRoot(root))
+
+	// Relative paths are relative to the working directory as seen by the
+	// host
+	dir := filepath.Join(root, "data")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	mustSetQuota(t, quota, "user1", "1MiB", "0")
+	if entries, _ := quota.List(); len(entries) != 1 || entries[0].Path != "/data/user1" {
+		t.Errorf("Expected /data/user1 to be recorded, got %+v", entries)
+	}
+	if id, _ := fake.GetProjectID("/data/user1"); id == 0 {
+		t.Errorf("Expected /data/user1 to be tagged")
+	}
+
+	// Outside of the host's root they can't be resolved
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if err := quota.SetQuota("user2", "1MiB", "0"); err == nil {
+		t.Error("Expected a path relative to a directory outside of the host's root to be refused")
+	}
+}
@@ -0,0 +1,58 @@
+package test
+
+import (
+	"testing"
+
+	"xfsquotas/api"
+)
+
+func TestFakeBackendDryRun(t *testing.T) {
+	fake, quota := newFakeQuota()
+	dryRun := api.NewQuotaManager(api.WithBackend(fake), api.WithDryRun())
+
+	mustSetQuota(t, dryRun, "/data/user1", "1MiB", "10")
+	plans := dryRun.Plans()
+	if len(plans) != 1 || plans[0].Op != "set" || plans[0].NewID != 1048577 {
+		t.Fatalf("Unexpected plans %+v", plans)
+	}
+	plan := plans[0]
+	if len(plan.ProjectsAdded) != 1 || plan.ProjectsAdded[0] != "1048577:/data/user1" ||
+		len(plan.ProjidAdded) != 1 || plan.ProjidAdded[0] != "xfsquota-1048577:1048577" {
+		t.Errorf("Unexpected project file changes %+v", plan)
+	}
+	if len(plan.Steps) != 3 || plan.Steps[2].New.Quota != 1<<20 {
+		t.Errorf("Unexpected steps %+v", plan.Steps)
+	}
+	// Nothing was changed
+	if id, _ := fake.GetProjectID("/data/user1"); id != 0 {
+		t.Errorf("Expected no project id, got %d", id)
+	}
+	if entries, _ := quota.List(); len(entries) != 0 {
+		t.Errorf("Expected no recorded paths, got %+v", entries)
+	}
+
+	mustSetQuota(t, quota, "/data/user1", "1MiB", "10")
+	if err := dryRun.CleanQuota("/data/user1"); err != nil {
+		t.Fatalf("CleanQuota failed: %v", err)
+	}
+	plans = dryRun.Plans()
+	if len(plans) != 1 || len(plans[0].ProjectsRemoved) != 1 || len(plans[0].ProjidRemoved) != 1 {
+		t.Errorf("Unexpected plans %+v", plans)
+	}
+	if info, _ := quota.GetQuota("/data/user1"); info == nil || info.Quota != 1<<20 {
+		t.Errorf("Expected the quota to be kept, got %+v", info)
+	}
+
+	// The retag lists the subtrees it overwrites and the nested projects
+	// it leaves alone
+	mustSetQuota(t, quota, "/data/user1/nested", "1MiB", "0")
+	fake.SetProjectID("/data/user1/c", 42)
+	mustSetQuota(t, dryRun, "/data/user1", "2MiB", "10")
+	plans = dryRun.Plans()
+	if len(plans) != 1 || len(plans[0].Steps) != 2 {
+		t.Fatalf("Unexpected plans %+v", plans)
+	}
+	if tag := plans[0].Steps[0]; tag.OldIDs["/data/user1/c"] != 42 || len(tag.Skip) != 1 || tag.Skip[0] != "/data/user1/nested" {
+		t.Errorf("Unexpected tag step %+v", tag)
+	}
+}
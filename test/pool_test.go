@@ -0,0 +1,69 @@
+package test
+
+import (
+	"errors"
+	"testing"
+
+	"xfsquotas/api"
+)
+
+func TestFakeBackendIDRange(t *testing.T) {
+	fake, quota := newFakeQuota(api.WithIDRange(100, 2))
+
+	for _, path := range []string{"/data/user1", "/data/user2"} {
+		if err := quota.Track(path); err != nil {
+			t.Fatalf("Track %s failed: %v", path, err)
+		}
+		if id, _ := fake.GetProjectID(path); id < 100 || id >= 102 {
+			t.Errorf("Expected id of %s in [100, 102), got %d", path, id)
+		}
+	}
+	if err := quota.Track("/data/user3"); !errors.Is(err, api.ErrIDExhausted) {
+		t.Errorf("Expected the id range to be exhausted, got %v", err)
+	}
+}
+
+func TestFakeBackendPools(t *testing.T) {
+	fake, quota := newFakeQuota(api.WithPools(
+		api.Pool{Name: "containers", First: 2000000, Count: 10},
+		api.Pool{Name: "ci", First: 3000000, Count: 1},
+	))
+
+	if err := quota.SetQuotaInPool("/data/c1", &api.DiskQuotaSize{Quota: 1 << 20}, "containers"); err != nil {
+		t.Fatalf("SetQuotaInPool failed: %v", err)
+	}
+	if err := quota.SetQuotaInPool("/data/job1", &api.DiskQuotaSize{}, "ci"); err != nil {
+		t.Fatalf("SetQuotaInPool failed: %v", err)
+	}
+	if err := quota.SetQuotaInPool("/data/job2", &api.DiskQuotaSize{}, "ci"); !errors.Is(err, api.ErrIDExhausted) {
+		t.Errorf("Expected the ci pool to be exhausted, got %v", err)
+	}
+	if err := quota.SetQuotaInPool("/data/c1", &api.DiskQuotaSize{}, "ci"); !errors.Is(err, api.ErrConflictingProject) {
+		t.Errorf("Expected a path of another pool to be rejected, got %v", err)
+	}
+
+	entries, err := quota.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Name != "containers-2000000" || entries[1].Name != "ci-3000000" {
+		t.Fatalf("Expected projects named after their pools, got %+v", entries)
+	}
+	usage, err := quota.PoolUsage()
+	if err != nil {
+		t.Fatalf("PoolUsage failed: %v", err)
+	}
+	used := make(map[string]int)
+	for _, pool := range usage {
+		used[pool.Name] = pool.Used
+	}
+	if used["xfsquota"] != 0 || used["containers"] != 1 || used["ci"] != 1 {
+		t.Errorf("Unexpected pool usage %v", used)
+	}
+
+	overlapping := api.NewQuotaManager(api.WithBackend(fake), api.WithPools(
+		api.Pool{Name: "a", First: 1048600, Count: 10}))
+	if err := overlapping.Track("/data/a"); err == nil {
+		t.Error("Expected overlapping pools to be rejected")
+	}
+}
@@ -1,6 +1,8 @@
 package test
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"xfsquotas/internal/project"
@@ -37,3 +39,16 @@ func TestNewProjectQuota(t *testing.T) {
 		t.Error("Expected NewProjectQuota to return non-nil")
 	}
 }
+
+func TestNewProjectQuotaUnwritableFiles(t *testing.T) {
+	// The project files can't be created below a regular file
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pq := project.NewProjectQuota(project.WithProjectFiles(
+		filepath.Join(file, "projects"), filepath.Join(file, "projid")))
+	if _, err := pq.ListQuotas(); err == nil {
+		t.Error("Expected ListQuotas to fail")
+	}
+}
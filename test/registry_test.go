@@ -0,0 +1,48 @@
+package test
+
+import (
+	"testing"
+
+	"xfsquotas/api"
+)
+
+func TestFakeBackendMountRegistry(t *testing.T) {
+	fake, quota := newFakeQuota(api.WithMountRegistry())
+	fake.AddMount("/disk2", "xfs")
+
+	mustSetQuota(t, quota, "/data/user1", "1MiB", "0")
+	mustSetQuota(t, quota, "/disk2/user1", "1MiB", "0")
+	// Paths are recorded relative to the filesystem
+	registry, err := fake.ReadFile("/disk2/.xfsquota/projects")
+	if err != nil {
+		t.Fatalf("registry not written: %v", err)
+	}
+	if string(registry) != "1048577:/user1\n" {
+		t.Errorf("Unexpected registry content %q", registry)
+	}
+	entries, err := quota.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Path != "/data/user1" || entries[1].Path != "/disk2/user1" {
+		t.Fatalf("Expected both filesystems in the generated project files, got %+v", entries)
+	}
+
+	// The disk is attached to a host without its /etc/projects records
+	if err := fake.WriteFile("/etc/projects", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := quota.Track("/disk2/user2"); err != nil {
+		t.Fatalf("Track failed: %v", err)
+	}
+	entries, err = quota.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Path != "/disk2/user1" || entries[1].Path != "/disk2/user2" {
+		t.Fatalf("Expected /etc/projects to be regenerated from the registry, got %+v", entries)
+	}
+	if entries[0].ID == entries[1].ID {
+		t.Errorf("Expected the registry ids to be kept, got %d twice", entries[0].ID)
+	}
+}
@@ -0,0 +1,110 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"xfsquotas/api"
+)
+
+func TestFakeBackendReport(t *testing.T) {
+	fake, quota := newFakeQuota()
+	fake.AddMount("/disk2", "xfs")
+	fake.AddMount("/tmp", "tmpfs")
+	fake.SetCapacity("/", 4<<20, 1000)
+
+	mustSetQuota(t, quota, "/data/user1", "2MiB", "0")
+	if err := quota.SetQuotaLimits("/data/user2", &api.DiskQuotaSize{Quota: 4 << 20, QuotaSoft: 1 << 20}); err != nil {
+		t.Fatalf("SetQuotaLimits failed: %v", err)
+	}
+	mustSetQuota(t, quota, "/disk2/user3", "1MiB", "0")
+	if err := fake.Write("/data/user1/file", 2<<20); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := fake.Write("/data/user2/file", 2<<20); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// A project nobody recorded
+	mnt, _ := fake.FindMount("/")
+	fake.SetQuota(mnt, 77, &api.DiskQuotaSize{Quota: 1 << 20})
+
+	reports, err := quota.Report()
+	if err != nil {
+		t.Fatalf("Report failed: %v", err)
+	}
+	if len(reports) != 2 || reports[0].Mount != "/" || reports[1].Mount != "/disk2" {
+		t.Fatalf("Expected the two xfs filesystems, got %+v", reports)
+	}
+	root := reports[0]
+	if len(root.Projects) != 3 || root.Projects[0].ID != 77 || len(root.Projects[0].Paths) != 0 {
+		t.Fatalf("Expected two recorded projects and project 77, got %+v", root.Projects)
+	}
+	if root.Total.Quota != 7<<20 || root.Total.QuotaUsed != 4<<20 {
+		t.Errorf("Unexpected totals %+v", root.Total)
+	}
+	if root.OverCommit() != 1.75 || root.Capacity.BytesFree != 0 {
+		t.Errorf("Expected 175%% committed and no space left, got %v, %+v", root.OverCommit(), root.Capacity)
+	}
+	user1, user2 := root.Projects[1].Size, root.Projects[2].Size
+	if user1.UsedPercent() != 100 || !user1.AtHardLimit() {
+		t.Errorf("Expected user1 at its hard limit, got %+v", user1)
+	}
+	if user2.UsedPercent() != 50 || !user2.OverSoftLimit() || user2.AtHardLimit() {
+		t.Errorf("Expected user2 over its soft limit only, got %+v", user2)
+	}
+
+	reports, err = quota.Report("/disk2/user3")
+	if err != nil || len(reports) != 1 || reports[0].Mount != "/disk2" || len(reports[0].Projects) != 1 {
+		t.Errorf("Expected the report of /disk2, got %+v, %v", reports, err)
+	}
+	if _, err := quota.Report("/tmp"); err == nil {
+		t.Errorf("Expected tmpfs to be refused")
+	}
+}
+
+func TestFakeBackendGrowth(t *testing.T) {
+	fake, quota := newFakeQuota()
+	mustSetQuota(t, quota, "/data/user1", "10MiB", "100")
+	prev, _ := quota.GetQuota("/data/user1")
+	for i := 0; i < 4; i++ {
+		if err := fake.Write(fmt.Sprintf("/data/user1/file%d", i), 1<<20); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	cur, _ := quota.GetQuota("/data/user1")
+
+	// 4MiB and 4 inodes in 2s, 6MiB left is hit in 3s before 96 inodes
+	growth := api.NewGrowth(prev, cur, 2*time.Second)
+	if growth.BytesPerSecond != 2<<20 || growth.InodesPerSecond != 2 {
+		t.Errorf("Unexpected rates %+v", growth)
+	}
+	if growth.UntilFull != 3*time.Second {
+		t.Errorf("Expected to be full in 3s, got %s", growth.UntilFull)
+	}
+	if growth := api.NewGrowth(cur, cur, 2*time.Second); growth.UntilFull != 0 {
+		t.Errorf("Expected no estimate without growth, got %s", growth.UntilFull)
+	}
+	if growth := api.NewGrowth(nil, cur, 0); growth.BytesPerSecond != 0 || growth.UntilFull != 0 {
+		t.Errorf("Expected no rates for a first sample, got %+v", growth)
+	}
+}
+
+func TestFakeBackendReportWithoutDevices(t *testing.T) {
+	fake, quota := newFakeQuota()
+	fake.AddMount("/disk2", "xfs")
+	clearDevices(t, fake, "/", "/disk2")
+
+	mustSetQuota(t, quota, "/data/user1", "1MiB", "0")
+	mustSetQuota(t, quota, "/disk2/user2", "2MiB", "0")
+	reports, err := quota.Report()
+	if err != nil {
+		t.Fatalf("Report failed: %v", err)
+	}
+	if len(reports) != 2 || len(reports[0].Projects) != 1 || len(reports[1].Projects) != 1 {
+		t.Fatalf("Expected a project on each filesystem, got %+v", reports)
+	}
+	if reports[0].Total.Quota != 1<<20 || reports[1].Total.Quota != 2<<20 {
+		t.Errorf("Unexpected totals %+v and %+v", reports[0].Total, reports[1].Total)
+	}
+}
@@ -0,0 +1,137 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"xfsquotas/api"
+	"xfsquotas/internal/mount"
+)
+
+func TestFakeBackendConcurrent(t *testing.T) {
+	// With the global project files each filesystem is locked on its own too
+	for name, opts := range map[string][]api.Option{
+		"global":   nil,
+		"registry": {api.WithMountRegistry()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			testFakeBackendConcurrent(t, opts...)
+		})
+	}
+}
+
+func testFakeBackendConcurrent(t *testing.T, opts ...api.Option) {
+	fake, quota := newFakeQuota(opts...)
+	fake.AddMount("/disk2", "xfs")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 16; i++ {
+		for _, dir := range []string{"/data", "/disk2"} {
+			path := fmt.Sprintf("%s/user%d", dir, i)
+			clean := i%2 == 1
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := quota.SetQuota(path, "1MiB", "0"); err != nil {
+					errs <- fmt.Errorf("SetQuota %s: %v", path, err)
+					return
+				}
+				size, err := quota.GetQuota(path)
+				if err != nil || size.Quota != 1<<20 {
+					errs <- fmt.Errorf("GetQuota %s: %+v, %v", path, size, err)
+					return
+				}
+				if clean {
+					if err := quota.CleanQuota(path); err != nil {
+						errs <- fmt.Errorf("CleanQuota %s: %v", path, err)
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	entries, err := quota.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(entries) != 16 {
+		t.Fatalf("Expected 16 recorded paths, got %d: %+v", len(entries), entries)
+	}
+	// Paths of a filesystem never share an id
+	ids := make(map[string]bool)
+	for _, entry := range entries {
+		key := fmt.Sprintf("%s:%d", filepath.Dir(entry.Path), entry.ID)
+		if ids[key] {
+			t.Errorf("Project id %d allocated twice on %s", entry.ID, filepath.Dir(entry.Path))
+		}
+		ids[key] = true
+	}
+}
+
+// blockingBackend makes setting limits on the mount at path with a
+// FakeBackend wait for release, then fail
+type blockingBackend struct {
+	*api.FakeBackend
+	path    string
+	blocked chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (b *blockingBackend) SetQuota(mnt *mount.Mount, id uint32, size *api.DiskQuotaSize) error {
+	// The rollback clears the limits again
+	if mnt.Path != b.path || !size.HasLimits() {
+		return b.FakeBackend.SetQuota(mnt, id, size)
+	}
+	b.once.Do(func() { close(b.blocked) })
+	select {
+	case <-b.release:
+	case <-time.After(5 * time.Second):
+	}
+	return errors.New("quotactl failed")
+}
+
+func TestFakeBackendFilesystemLocks(t *testing.T) {
+	fake := api.NewFakeBackend()
+	fake.AddMount("/disk2", "xfs")
+	backend := &blockingBackend{FakeBackend: fake, path: "/",
+		blocked: make(chan struct{}), release: make(chan struct{})}
+	quota := api.NewQuotaManager(api.WithBackend(backend))
+
+	errs := make(chan error, 1)
+	go func() { errs <- quota.SetQuota("/data/user1", "1MiB", "0") }()
+	<-backend.blocked
+	// A set on another filesystem doesn't wait for the blocked one
+	done := make(chan error, 1)
+	go func() { done <- quota.SetQuota("/disk2/user2", "1MiB", "0") }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("SetQuota failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected /disk2 not to wait for the lock of /")
+	}
+	close(backend.release)
+	if err := <-errs; err == nil {
+		t.Fatal("Expected the blocked set to fail")
+	}
+	// The rollback of the failed set keeps the record made meanwhile
+	entries, err := quota.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Path != "/disk2/user2" {
+		t.Errorf("Expected only /disk2/user2 to be recorded, got %+v", entries)
+	}
+}